@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiLogFileName = "api.log"
+
+const defaultAPIAddr = "127.0.0.1:8765"
+const defaultAPIRunsLimit = 20
+
+const apiShutdownTimeout = 5 * time.Second
+const apiProgressInterval = time.Second
+
+// apiServer はローカルの HTTP API（実行の開始・停止、進捗、実行履歴、SSE）と重複の確認の画面
+type apiServer struct {
+	logger   *slog.Logger
+	cfg      Config
+	ctx      context.Context
+	metaRoot string
+	toSt     storage
+	// API から開始したパイプライン
+	runs sync.WaitGroup
+}
+
+// serveAPI は operation: 13 で HTTP API だけを起動し、キャンセルされるまで待つ
+func serveAPI(ctx context.Context, cfg Config) {
+	logger, closeLogFile := openAPILogFile(ctx, getMetaRoot(cfg))
+	defer closeLogFile()
+
+	logger.Info("START")
+
+	wait := startAPIServer(ctx, logger, cfg)
+	<-ctx.Done()
+	logger.Info("canceled, waiting for running pipelines", "err", ctx.Err())
+	wait()
+	logger.Info("END")
+}
+
+// startAPIServer は HTTP API をバックグラウンドで起動し、終了（ctx のキャンセル後）を待つ関数を返す
+func startAPIServer(ctx context.Context, logger *slog.Logger, cfg Config) func() {
+	addr := getAPIAddr(cfg)
+	if err := checkLoopbackAddr(addr); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.API.Token == "" {
+		log.Fatal("api.token is required")
+	}
+
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &apiServer{logger: logger, cfg: cfg, ctx: ctx, metaRoot: getMetaRoot(cfg), toSt: toSt}
+	srv := &http.Server{Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.Info("api listening", "url", fmt.Sprintf("http://%s", ln.Addr()))
+	logger.Info("review duplicates", "url", fmt.Sprintf("http://%s/review?token=...", ln.Addr()))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("api server error", "err", err)
+		}
+	}()
+
+	return func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), apiShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to shutdown api server", "err", err)
+		}
+		<-served
+		s.runs.Wait()
+		closeToSt()
+	}
+}
+
+func getAPIAddr(cfg Config) string {
+	if cfg.API.Addr == "" {
+		return defaultAPIAddr
+	}
+	return cfg.API.Addr
+}
+
+// checkLoopbackAddr は localhost 以外で待ち受けないよう、アドレスがループバックかどうかを確認する
+func checkLoopbackAddr(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("api.addr must be a loopback address: %s", addr)
+}
+
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/runs", s.handleRuns)
+	mux.HandleFunc("/api/runs/", s.handleRun)
+	mux.HandleFunc("/api/progress", s.handleProgress)
+	mux.HandleFunc("/api/events", s.handleEvents)
+	mux.HandleFunc("/api/duplicates", s.handleDuplicates)
+	mux.HandleFunc("/api/duplicates/", s.handleDuplicate)
+	mux.HandleFunc("/review", s.handleReviewPage)
+	return s.auth(mux)
+}
+
+// auth は Authorization: Bearer <token>（SSE 用に ?token= も可）を確認する
+func (s *apiServer) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.API.Token)) != 1 {
+			s.writeJSONError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startRunRequest は POST /api/runs の本文（pipeline か steps のどちらかを指定する）
+type startRunRequest struct {
+	Pipeline string   `json:"pipeline"`
+	Steps    []string `json:"steps"`
+}
+
+// handleRuns は GET で実行中・実行履歴の一覧を返し、POST でパイプラインを開始する
+func (s *apiServer) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		limit := defaultAPIRunsLimit
+		if v, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && v > 0 {
+			limit = v
+		}
+		history, err := loadRunHistory(s.logger, s.metaRoot)
+		if err != nil {
+			s.writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		// 新しい順に返す
+		recent := make([]runRecord, 0, limit)
+		for i := len(history) - 1; i >= 0 && len(recent) < limit; i-- {
+			recent = append(recent, history[i])
+		}
+		s.writeJSON(w, http.StatusOK, map[string]any{"active": activeRuns.list(), "history": recent})
+	case http.MethodPost:
+		var req startRunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		p, err := s.findPipeline(req)
+		if err != nil {
+			s.writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(activeRuns.list()) > 0 {
+			s.writeJSONError(w, http.StatusConflict, errRunLocked)
+			return
+		}
+
+		runID := uuid.NewString()
+		s.runs.Add(1)
+		go func() {
+			defer s.runs.Done()
+			runPipeline(s.ctx, s.logger, s.cfg, runID, p)
+		}()
+		s.logger.Info("api start", "pipeline", p.Name, "pipelineRunId", runID)
+		s.writeJSON(w, http.StatusAccepted, map[string]string{"runId": runID})
+	default:
+		s.writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+func (s *apiServer) findPipeline(req startRunRequest) (PipelineConfig, error) {
+	if req.Pipeline != "" {
+		for _, p := range s.cfg.Pipelines {
+			if p.Name == req.Pipeline {
+				return p, nil
+			}
+		}
+		return PipelineConfig{}, fmt.Errorf("unknown pipeline: %s", req.Pipeline)
+	}
+
+	p := PipelineConfig{Name: "api", Steps: req.Steps}
+	if err := validatePipeline(p); err != nil {
+		return PipelineConfig{}, err
+	}
+	return p, nil
+}
+
+// handleRun は /api/runs/{id}、/api/runs/{id}/stop、/api/runs/{id}/errors、/api/runs/{id}/logs を扱う
+func (s *apiServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	runID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/")
+
+	if action == "stop" {
+		if r.Method != http.MethodPost {
+			s.writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		if !activeRuns.stop(runID) {
+			s.writeJSONError(w, http.StatusNotFound, fmt.Errorf("run is not active: %s", runID))
+			return
+		}
+		s.logger.Info("api stop", "pipelineRunId", runID)
+		s.writeJSON(w, http.StatusAccepted, map[string]string{"runId": runID})
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		s.writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	record, ok, err := s.findRun(runID)
+	if err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		s.writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown run: %s", runID))
+		return
+	}
+
+	switch action {
+	case "":
+		s.writeJSON(w, http.StatusOK, record)
+	case "errors":
+		errs, err := s.readRunErrors(record)
+		if err != nil {
+			s.writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, errs)
+	case "logs":
+		logs, err := s.readRunLogs(record)
+		if err != nil {
+			s.writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		s.writeJSON(w, http.StatusOK, logs)
+	default:
+		s.writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown action: %s", action))
+	}
+}
+
+// findRun は実行履歴（実行中のものは開始時の情報）から実行を探す
+func (s *apiServer) findRun(runID string) (runRecord, bool, error) {
+	for _, status := range activeRuns.list() {
+		if status.RunID == runID {
+			return runRecord{RunID: status.RunID, Pipeline: status.Pipeline, Steps: status.Steps, StartedAt: status.StartedAt}, true, nil
+		}
+	}
+
+	history, err := loadRunHistory(s.logger, s.metaRoot)
+	if err != nil {
+		return runRecord{}, false, err
+	}
+	for _, record := range history {
+		if record.RunID == runID {
+			return record, true, nil
+		}
+	}
+	return runRecord{}, false, nil
+}
+
+// runError は errorList.txt の1行分
+type runError struct {
+	FromPath string `json:"fromPath"`
+	ToPath   string `json:"toPath"`
+}
+
+// readRunErrors はその実行で errorList.txt に追記された行を返す
+func (s *apiServer) readRunErrors(record runRecord) ([]runError, error) {
+	lines, err := readLines(filepath.Join(s.metaRoot, metaDir, errorListName), record.ErrorListStart, record.ErrorCount)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make([]runError, 0, len(lines))
+	for _, line := range lines {
+		fromPath, toPath, _ := strings.Cut(line, seps)
+		errs = append(errs, runError{FromPath: fromPath, ToPath: toPath})
+	}
+	return errs, nil
+}
+
+// readRunLogs は各ステップのログファイル（ローテーションした古いファイルも含む）から、その実行の行をステップ毎に返す
+func (s *apiServer) readRunLogs(record runRecord) (map[string][]string, error) {
+	logs := make(map[string][]string)
+	for _, step := range record.Steps {
+		lines, err := readRunLogLines(filepath.Join(s.metaRoot, metaDir, stepLogFileNames[step]), record.RunID)
+		if err != nil {
+			return nil, err
+		}
+		logs[step] = lines
+	}
+	return logs, nil
+}
+
+// readRunLogLines はログファイルとそのバックアップ（古い順）から、runId 属性が runID の行を返す
+func readRunLogLines(path string, runID string) ([]string, error) {
+	paths, err := getLogFilePaths(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, p := range paths {
+		found, err := readLogLinesOfRun(p, runID)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, found...)
+	}
+	return lines, nil
+}
+
+// getLogFilePaths はローテーションしたバックアップ（<name>-<日時>.<ext>）を古い順に並べ、最後に現在のログファイルを加えて返す
+func getLogFilePaths(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	backups, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	// バックアップのファイル名の日時は文字列の順が日時の順になる
+	sort.Strings(backups)
+	return append(backups, path), nil
+}
+
+// readLogLinesOfRun はログファイル（text / json）のうち runId 属性が runID の行を返す
+func readLogLinesOfRun(path string, runID string) (lines []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	textAttr := "runId=" + runID
+	jsonAttr := `"runId":"` + runID + `"`
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, " "+textAttr+" ") || strings.HasSuffix(line, " "+textAttr) || strings.Contains(line, jsonAttr) {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func (s *apiServer) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var snapshot *progressSnapshot
+	if prog := activeProgress.Load(); prog != nil {
+		ps := prog.snapshot()
+		snapshot = &ps
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{"active": activeRuns.list(), "progress": snapshot})
+}
+
+// handleEvents は実行のイベントと、コピー中の進捗（1秒毎）を Server-Sent Events で送る
+func (s *apiServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeJSONError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	events, unsubscribe := runEvents.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(apiProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		var e runEvent
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case e = <-events:
+		case <-ticker.C:
+			prog := activeProgress.Load()
+			if prog == nil {
+				continue
+			}
+			ps := prog.snapshot()
+			e = runEvent{Type: runEventProgress, Time: time.Now(), Progress: &ps}
+		}
+
+		b, err := json.Marshal(e)
+		if err != nil {
+			s.logger.Error("failed to marshal event", "type", e.Type, "err", err)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *apiServer) writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Warn("failed to write response", "err", err)
+	}
+}
+
+func (s *apiServer) writeJSONError(w http.ResponseWriter, status int, err error) {
+	s.writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func openAPILogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, apiLogFileName))
+}
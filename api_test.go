@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadRunLogLines(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "execCopy.log")
+	files := map[string]string{
+		// lumberjack のバックアップ（古い順）
+		"execCopy-2024-01-01T00-00-00.000.log": "time=1 level=INFO msg=START runId=run1 op=execCopy\n" +
+			"time=2 level=INFO msg=START runId=run10 op=execCopy\n",
+		"execCopy-2024-01-02T00-00-00.000.log": `{"time":"3","level":"INFO","msg":"copied","runId":"run1","op":"execCopy"}` + "\n",
+		"execCopy.log": "time=4 level=INFO msg=END runId=run1\n" +
+			"time=5 level=INFO msg=START runId=run2 op=execCopy\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines, err := readRunLogLines(path, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"time=1 level=INFO msg=START runId=run1 op=execCopy",
+		`{"time":"3","level":"INFO","msg":"copied","runId":"run1","op":"execCopy"}`,
+		"time=4 level=INFO msg=END runId=run1",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestReadRunLogLinesNoFile(t *testing.T) {
+	lines, err := readRunLogLines(filepath.Join(t.TempDir(), "execCopy.log"), "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("lines = %q, want none", lines)
+	}
+}
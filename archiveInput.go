@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archivePathSep は書庫内のファイルを表す仮想パス（archive.zip!/Photos/x.jpg）の区切り
+const archivePathSep = "!/"
+
+// archiveEntryInfo は書庫内のファイル1件分
+type archiveEntryInfo struct {
+	name string
+	fi   fs.FileInfo
+}
+
+func isArchiveFile(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinArchivePath(archivePath string, name string) string {
+	return archivePath + archivePathSep + name
+}
+
+// splitArchivePath は仮想パスを書庫のパスと書庫内の名前に分ける。書庫内のファイルでなければ ok=false を返す。
+func splitArchivePath(p string) (archivePath string, name string, ok bool) {
+	i := strings.Index(p, archivePathSep)
+	if i < 0 {
+		return "", "", false
+	}
+	archivePath, name = p[:i], p[i+len(archivePathSep):]
+	if !isArchiveFile(archivePath) {
+		return "", "", false
+	}
+	if !isArchiveFileOnDisk(archivePath) {
+		return "", "", false
+	}
+	return archivePath, name, true
+}
+
+// archiveFilesOnDisk は通常ファイルだった書庫のパス（コピーの度に stat し直さないよう保持する）
+var archiveFilesOnDisk sync.Map
+
+// isArchiveFileOnDisk は書庫のパスがローカルの通常ファイルかどうかを返す。
+// 通常ファイルだったパスだけを保持する（後から削除された書庫は読む時のエラーになる）。
+func isArchiveFileOnDisk(archivePath string) bool {
+	if _, ok := archiveFilesOnDisk.Load(archivePath); ok {
+		return true
+	}
+	if fi, err := os.Stat(archivePath); err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+	archiveFilesOnDisk.Store(archivePath, struct{}{})
+	return true
+}
+
+// archiveIndex は書庫内の通常ファイルの一覧（書庫の順）。
+// 仮想パスを stat する度に書庫を読み直さないよう、書庫毎に1回だけ読んで archiveIndexes に保持する。
+type archiveIndex struct {
+	size    int64
+	modTime time.Time
+	entries []archiveEntryInfo
+	// 書庫内の名前（path.Clean したもの）-> entries の位置（同じ名前が複数ある場合は最初のもの）
+	positions map[string]int
+}
+
+func newArchiveIndex(fi fs.FileInfo, entries []archiveEntryInfo) *archiveIndex {
+	idx := &archiveIndex{size: fi.Size(), modTime: fi.ModTime(), entries: entries, positions: make(map[string]int, len(entries))}
+	for i, entry := range entries {
+		name := path.Clean(entry.name)
+		if _, ok := idx.positions[name]; !ok {
+			idx.positions[name] = i
+		}
+	}
+	return idx
+}
+
+func (idx *archiveIndex) position(name string) (int, bool) {
+	i, ok := idx.positions[path.Clean(name)]
+	return i, ok
+}
+
+type archiveIndexCache struct {
+	mu      sync.Mutex
+	indexes map[string]*archiveIndex
+}
+
+// archiveIndexes は書庫のパス毎の archiveIndex（書庫のサイズ・更新日時が変わったら読み直す）
+var archiveIndexes = &archiveIndexCache{indexes: make(map[string]*archiveIndex)}
+
+func getArchiveIndex(archivePath string) (*archiveIndex, error) {
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveIndexes.mu.Lock()
+	idx, ok := archiveIndexes.indexes[archivePath]
+	archiveIndexes.mu.Unlock()
+	if ok && idx.size == fi.Size() && idx.modTime.Equal(fi.ModTime()) {
+		return idx, nil
+	}
+
+	entries, err := readArchiveEntries(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	idx = newArchiveIndex(fi, entries)
+
+	archiveIndexes.mu.Lock()
+	archiveIndexes.indexes[archivePath] = idx
+	archiveIndexes.mu.Unlock()
+	return idx, nil
+}
+
+// listArchive は書庫内の通常ファイルの一覧を書庫の順に返す
+func listArchive(archivePath string) ([]archiveEntryInfo, error) {
+	idx, err := getArchiveIndex(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return idx.entries, nil
+}
+
+// sortByArchiveOrder は同じ書庫内のファイルのエントリを書庫の順に並べる（書庫を読めない場合はそのまま）
+func sortByArchiveOrder(archivePath string, entries []copyEntry) {
+	idx, err := getArchiveIndex(archivePath)
+	if err != nil {
+		return
+	}
+	// 比較の度に仮想パスを分けないよう、並べる前に位置を求める
+	positions := make(map[string]int, len(entries))
+	prefix := archivePath + archivePathSep
+	for _, entry := range entries {
+		positions[entry.fromPath] = len(idx.entries)
+		if name, ok := strings.CutPrefix(entry.fromPath, prefix); ok {
+			if i, ok := idx.position(name); ok {
+				positions[entry.fromPath] = i
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return positions[entries[i].fromPath] < positions[entries[j].fromPath]
+	})
+}
+
+// readArchiveEntries は書庫を読み、通常ファイルの一覧を返す
+func readArchiveEntries(archivePath string) ([]archiveEntryInfo, error) {
+	var entries []archiveEntryInfo
+
+	if isZipFile(archivePath) {
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		defer closeArchive(zr)
+
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			entries = append(entries, archiveEntryInfo{name: f.Name, fi: f.FileInfo()})
+		}
+		return entries, nil
+	}
+
+	tr, closer, err := openTarReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive(closer)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entries = append(entries, archiveEntryInfo{name: header.Name, fi: header.FileInfo()})
+	}
+}
+
+// openSource はコピー元を開く。書庫内のファイル（仮想パス）の場合は書庫から展開しながら読む。
+// 同じ書庫内のファイルを続けて読む場合は archiveStreamStorage を使う。
+func openSource(p string) (io.ReadCloser, error) {
+	archivePath, name, ok := splitArchivePath(p)
+	if !ok {
+		return os.Open(p)
+	}
+
+	if isZipFile(archivePath) {
+		zr, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		f, err := zr.Open(name)
+		if err != nil {
+			closeArchive(zr)
+			return nil, err
+		}
+		return &archiveEntryReader{Reader: f, closers: []io.Closer{f, zr}}, nil
+	}
+
+	// tar は先頭から順に読むしかないので、目的のファイルまで読み飛ばす
+	tr, closer, err := openTarReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := seekTarEntry(tr, name); err != nil {
+		closeArchive(closer)
+		return nil, err
+	}
+	return &archiveEntryReader{Reader: tr, closers: []io.Closer{closer}}, nil
+}
+
+// statSource はコピー元の情報を返す（書庫内のファイルは archiveIndex から返す）
+func statSource(p string) (fs.FileInfo, error) {
+	archivePath, name, ok := splitArchivePath(p)
+	if !ok {
+		return os.Stat(p)
+	}
+
+	idx, err := getArchiveIndex(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := idx.position(name)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return idx.entries[i].fi, nil
+}
+
+// isTarEntry は p が tar 内のファイル（前のファイルに戻って読むと書庫を先頭から読み直す）かどうかを返す
+func isTarEntry(p string) bool {
+	archivePath, _, ok := splitArchivePath(p)
+	return ok && !isZipFile(archivePath)
+}
+
+func isZipFile(archivePath string) bool {
+	return strings.HasSuffix(strings.ToLower(archivePath), ".zip")
+}
+
+func openTarReader(archivePath string) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lower := strings.ToLower(archivePath)
+	if strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz") {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			closeArchive(f)
+			return nil, nil, err
+		}
+		return tar.NewReader(gr), &archiveEntryReader{closers: []io.Closer{gr, f}}, nil
+	}
+	return tar.NewReader(f), f, nil
+}
+
+func seekTarEntry(tr *tar.Reader, name string) (*tar.Header, error) {
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if path.Clean(header.Name) == path.Clean(name) {
+			return header, nil
+		}
+	}
+}
+
+// archiveEntryReader は書庫内のファイルを読み、閉じる時に書庫も閉じる
+type archiveEntryReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *archiveEntryReader) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// archiveStream は1つの書庫を開いたまま、書庫内のファイルを続けて読む。
+// tar は前から順に読むしかないので、書庫の順に読む限り書庫を1回読むだけで済み、前のファイルに戻る場合だけ開き直す。
+// 返した Reader は次のファイルを開くまでの間だけ読める。
+type archiveStream struct {
+	archivePath string
+	index       *archiveIndex
+	zr          *zip.ReadCloser
+	tr          *tar.Reader
+	closer      io.Closer
+	// tr で次に読む通常ファイルの archiveIndex の位置
+	next int
+}
+
+func openArchiveStream(archivePath string) (*archiveStream, error) {
+	idx, err := getArchiveIndex(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	s := &archiveStream{archivePath: archivePath, index: idx}
+	if isZipFile(archivePath) {
+		if s.zr, err = zip.OpenReader(archivePath); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *archiveStream) open(name string) (io.ReadCloser, error) {
+	// zip は中央ディレクトリから直接開ける
+	if s.zr != nil {
+		return s.zr.Open(name)
+	}
+
+	i, ok := s.index.position(name)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	if s.tr == nil || i < s.next {
+		if err := s.rewind(); err != nil {
+			return nil, err
+		}
+	}
+	for {
+		header, err := s.tr.Next()
+		if err == io.EOF {
+			s.reset()
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		if err != nil {
+			s.reset()
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		s.next++
+		if s.next-1 == i {
+			// 書庫は次のファイルを開く時にも使うので、Close では閉じない
+			return io.NopCloser(s.tr), nil
+		}
+	}
+}
+
+// rewind は tar を先頭から読み直す
+func (s *archiveStream) rewind() error {
+	s.reset()
+	tr, closer, err := openTarReader(s.archivePath)
+	if err != nil {
+		return err
+	}
+	s.tr, s.closer, s.next = tr, closer, 0
+	return nil
+}
+
+func (s *archiveStream) reset() {
+	if s.closer != nil {
+		closeArchive(s.closer)
+	}
+	s.tr, s.closer, s.next = nil, nil, 0
+}
+
+func (s *archiveStream) close() {
+	s.reset()
+	if s.zr != nil {
+		closeArchive(s.zr)
+	}
+}
+
+// archiveStreamStorage は書庫内のファイル（仮想パス）を archiveStream で続けて読む storage（それ以外は元の storage のまま）。
+// 1つの goroutine から書庫の順に読む場合（listUp・書庫毎のコピー・書庫への書き込み）に使う。
+type archiveStreamStorage struct {
+	storage
+	stream *archiveStream
+}
+
+func newArchiveStreamStorage(st storage) *archiveStreamStorage {
+	return &archiveStreamStorage{storage: st}
+}
+
+func (s *archiveStreamStorage) open(p string) (io.ReadCloser, error) {
+	archivePath, name, ok := splitArchivePath(p)
+	if !ok || !s.storage.isLocal() {
+		return s.storage.open(p)
+	}
+
+	// 開いたままにする書庫は1つだけにする
+	if s.stream != nil && s.stream.archivePath != archivePath {
+		s.stream.close()
+		s.stream = nil
+	}
+	if s.stream == nil {
+		stream, err := openArchiveStream(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		s.stream = stream
+	}
+	return s.stream.open(name)
+}
+
+func (s *archiveStreamStorage) close() {
+	if s.stream != nil {
+		s.stream.close()
+		s.stream = nil
+	}
+}
+
+// closeArchive は読み込みだけに開いた書庫を閉じる（書き込んでいないので Close のエラーは無視する）
+func closeArchive(c io.Closer) {
+	_ = c.Close()
+}
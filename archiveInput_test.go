@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testArchiveFiles = []struct{ name, content string }{
+	{"Photos/a.jpg", "aaaa"},
+	{"Photos/b.jpg", "bb"},
+	{"Photos/c.jpg", "cccccc"},
+}
+
+func writeTestTarGz(t *testing.T, archivePath string) {
+	t.Helper()
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: "Photos/", Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range testArchiveFiles {
+		header := &tar.Header{Name: file.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(file.content)), ModTime: time.Now()}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []io.Closer{tw, gw, f} {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func writeTestZip(t *testing.T, archivePath string) {
+	t.Helper()
+	f, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, file := range testArchiveFiles {
+		w, err := zw.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, file.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range []io.Closer{zw, f} {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readStreamEntry(t *testing.T, st *archiveStreamStorage, p string) string {
+	t.Helper()
+	r, err := st.open(p)
+	if err != nil {
+		t.Fatalf("open %s: %v", p, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %v", p, err)
+	}
+	return string(b)
+}
+
+func TestArchiveStreamStorage(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		write func(*testing.T, string)
+	}{
+		{"photos.tar.gz", writeTestTarGz},
+		{"photos.zip", writeTestZip},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			archivePath := filepath.Join(t.TempDir(), tc.name)
+			tc.write(t, archivePath)
+
+			for _, file := range testArchiveFiles {
+				fi, err := statSource(joinArchivePath(archivePath, file.name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() != int64(len(file.content)) {
+					t.Errorf("%s: size = %d, want %d", file.name, fi.Size(), len(file.content))
+				}
+			}
+
+			st := newArchiveStreamStorage(localStorage{})
+			defer st.close()
+			// 書庫の順に読んだ後、前のファイルに戻って読む（tar は開き直す）
+			for _, i := range []int{0, 1, 2, 0, 2, 1} {
+				file := testArchiveFiles[i]
+				if got := readStreamEntry(t, st, joinArchivePath(archivePath, file.name)); got != file.content {
+					t.Errorf("%s = %q, want %q", file.name, got, file.content)
+				}
+			}
+			if _, err := st.open(joinArchivePath(archivePath, "Photos/none.jpg")); err == nil {
+				t.Error("opening a missing entry must fail")
+			}
+		})
+	}
+}
+
+func TestArchiveIndexRebuiltWhenArchiveChanges(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "photos.tar.gz")
+	writeTestTarGz(t, archivePath)
+	first, err := getArchiveIndex(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := getArchiveIndex(archivePath); err != nil || again != first {
+		t.Errorf("index must be reused while the archive is unchanged")
+	}
+
+	writeTestZip(t, archivePath+".zip")
+	if err := os.Rename(archivePath+".zip", archivePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(archivePath, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getArchiveIndex(archivePath); err == nil {
+		t.Error("changed archive must be read again (a zip is not a valid tar.gz)")
+	}
+}
+
+func TestGroupCopyUnitsSortsByArchiveOrder(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "photos.tar.gz")
+	writeTestTarGz(t, archivePath)
+
+	entries := []copyEntry{
+		{fromPath: joinArchivePath(archivePath, "Photos/c.jpg"), toPath: "/out/c.jpg", kind: copyKindFile},
+		{fromPath: "/in/x.jpg", toPath: "/out/x.jpg", kind: copyKindFile},
+		{fromPath: joinArchivePath(archivePath, "Photos/a.jpg"), toPath: "/out/a.jpg", kind: copyKindFile},
+	}
+	units := groupCopyUnits(localStorage{}, entries)
+	if len(units) != 2 {
+		t.Fatalf("units = %+v, want the archive and /in/x.jpg", units)
+	}
+	if units[0].archivePath != archivePath || len(units[0].entries) != 2 ||
+		units[0].entries[0].toPath != "/out/a.jpg" || units[0].entries[1].toPath != "/out/c.jpg" {
+		t.Errorf("archive unit = %+v, want a.jpg then c.jpg", units[0])
+	}
+	if units[1].archivePath != "" || units[1].entries[0].fromPath != "/in/x.jpg" {
+		t.Errorf("second unit = %+v, want /in/x.jpg", units[1])
+	}
+}
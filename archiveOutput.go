@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	archiveFormatZip    = "zip"
+	archiveFormatTar    = "tar"
+	archiveFormatTarGz  = "tar.gz"
+	archiveFormatTarZst = "tar.zst"
+)
+
+const archivePartialSuffix = ".partial"
+
+func getArchiveFormat(path string) (string, error) {
+	lower := strings.ToLower(path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveFormatZip, nil
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"):
+		return archiveFormatTarZst, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveFormatTarGz, nil
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveFormatTar, nil
+	}
+	return "", fmt.Errorf("unsupported archive format: %s", path)
+}
+
+// archiveWriter は copyList のエントリを書庫に追加する
+type archiveWriter interface {
+	addFile(name string, fi fs.FileInfo, r io.Reader) error
+	addSymlink(name string, fi fs.FileInfo, target string) error
+	Close() error
+}
+
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, error) {
+	switch format {
+	case archiveFormatZip:
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	case archiveFormatTarGz:
+		gw := gzip.NewWriter(w)
+		return &tarArchiveWriter{tw: tar.NewWriter(gw), compressor: gw}, nil
+	case archiveFormatTarZst:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tw: tar.NewWriter(zw), compressor: zw}, nil
+	default:
+		return &tarArchiveWriter{tw: tar.NewWriter(w)}, nil
+	}
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) addFile(name string, fi fs.FileInfo, r io.Reader) error {
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchiveWriter) addSymlink(name string, fi fs.FileInfo, target string) error {
+	header, err := zip.FileInfoHeader(fi)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	// zip ではシンボリックリンクのリンク先を内容として格納する
+	_, err = io.WriteString(w, target)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (a *tarArchiveWriter) addFile(name string, fi fs.FileInfo, r io.Reader) error {
+	header, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchiveWriter) addSymlink(name string, fi fs.FileInfo, target string) error {
+	header, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	return a.tw.WriteHeader(header)
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.compressor != nil {
+		return a.compressor.Close()
+	}
+	return nil
+}
+
+// execCopyToArchive は copyList のエントリを出力先に展開せず、出力先からの相対パスで書庫に直接書き込む。
+// 書庫は途中で失敗・キャンセルした場合に壊れたものが残らないよう、一時ファイルに書いてから置き換える。
+func execCopyToArchive(ctx context.Context, cfg Config, entries []copyEntry, w *copyWorker) error {
+	format, err := getArchiveFormat(cfg.Archive)
+	if err != nil {
+		return err
+	}
+	if cfg.Move {
+		w.logger.Warn("move is ignored when writing to an archive")
+	}
+	w.logger.Info("archive", "dst", cfg.Archive, "format", format)
+
+	partialPath := cfg.Archive + archivePartialSuffix
+	archiveFile, err := os.Create(partialPath)
+	if err != nil {
+		return err
+	}
+
+	aw, err := newArchiveWriter(format, archiveFile)
+	if err != nil {
+		return errors.Join(err, archiveFile.Close(), os.Remove(partialPath))
+	}
+
+	// 入力が書庫の場合は、書庫を開いたまま続けて読む
+	archiveSt := newArchiveStreamStorage(w.fromSt)
+	defer archiveSt.close()
+	aworker := *w
+	aworker.fromSt = archiveSt
+
+	err = writeArchiveEntries(ctx, cfg.ToDir, entries, aw, &aworker)
+	if closeErr := aw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := archiveFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		if removeErr := os.Remove(partialPath); removeErr != nil {
+			w.logger.Error("failed to remove partial archive", "dst", partialPath, "err", removeErr)
+		} else {
+			w.logger.Warn("rollback: removed", "dst", partialPath)
+		}
+		// キャンセルは失敗ではない（呼び出し側が ctx で判断する）
+		if isCanceled(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+
+	if err := renameFile(partialPath, cfg.Archive); err != nil {
+		return err
+	}
+	w.logger.Info("archive created", "dst", cfg.Archive)
+	return nil
+}
+
+func writeArchiveEntries(ctx context.Context, toDir string, entries []copyEntry, aw archiveWriter, w *copyWorker) error {
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		name, err := filepath.Rel(toDir, entry.toPath)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		if err := w.beforeCopy(ctx, entry); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			w.fail(entry, err)
+			w.progress.fileDone()
+			continue
+		}
+
+		ew := w.withCopyCounter()
+		if err := addArchiveEntry(ctx, aw, name, entry, ew); err != nil {
+			ew.counter.rollback()
+			// 書き込みを始める前のエラー（コピー元が開けない等）はそのファイルだけ飛ばす
+			var skipErr *archiveSkipError
+			if !errors.As(err, &skipErr) {
+				return err
+			}
+			w.fail(entry, fmt.Errorf("failed to add to archive: %w", skipErr.err))
+		} else {
+			ew.counter.commit()
+			w.done(ctx, entry)
+		}
+		w.progress.fileDone()
+	}
+	return nil
+}
+
+func addArchiveEntry(ctx context.Context, aw archiveWriter, name string, entry copyEntry, w *copyWorker) error {
+	if _, _, ok := splitArchivePath(entry.fromPath); ok || !w.fromSt.isLocal() {
+		return addArchiveEntryFromStorage(ctx, aw, name, entry, w)
+	}
+
+	fi, err := os.Lstat(entry.fromPath)
+	if err != nil {
+		return &archiveSkipError{err: err}
+	}
+
+	if entry.kind == copyKindSymlink {
+		target, err := os.Readlink(entry.fromPath)
+		if err != nil {
+			return &archiveSkipError{err: err}
+		}
+		if err := aw.addSymlink(name, fi, target); err != nil {
+			return err
+		}
+		w.logger.Info("archived", "src", entry.fromPath, "dst", name, "target", target)
+		return nil
+	}
+
+	fromFile, err := os.Open(entry.fromPath)
+	if err != nil {
+		return &archiveSkipError{err: err}
+	}
+	defer func() {
+		if err := fromFile.Close(); err != nil {
+			w.logger.Warn("failed to close", "src", entry.fromPath, "err", err)
+		}
+	}()
+	// follow したシンボリックリンクはリンク先の情報で格納する
+	if fi, err = fromFile.Stat(); err != nil {
+		return &archiveSkipError{err: err}
+	}
+
+	r := io.TeeReader(&throttledReader{ctx: ctx, r: &contextReader{ctx: ctx, r: fromFile}, bucket: w.bucket}, w.counter)
+	if err := aw.addFile(name, fi, r); err != nil {
+		return err
+	}
+	w.logger.Info("archived", "src", entry.fromPath, "dst", name)
+	return nil
+}
+
+// addArchiveEntryFromStorage は書庫内のファイル（仮想パス）やリモートのファイルを書庫に書き込む
+func addArchiveEntryFromStorage(ctx context.Context, aw archiveWriter, name string, entry copyEntry, w *copyWorker) error {
+	fi, err := w.fromSt.stat(entry.fromPath)
+	if err != nil {
+		return &archiveSkipError{err: err}
+	}
+	fromFile, err := w.fromSt.open(entry.fromPath)
+	if err != nil {
+		return &archiveSkipError{err: err}
+	}
+	defer func() {
+		if err := fromFile.Close(); err != nil {
+			w.logger.Warn("failed to close", "src", entry.fromPath, "err", err)
+		}
+	}()
+
+	r := io.TeeReader(&throttledReader{ctx: ctx, r: &contextReader{ctx: ctx, r: fromFile}, bucket: w.bucket}, w.counter)
+	if err := aw.addFile(name, fi, r); err != nil {
+		return err
+	}
+	w.logger.Info("archived", "src", entry.fromPath, "dst", name)
+	return nil
+}
+
+// archiveSkipError は書庫への書き込みを始める前のエラー（そのファイルだけ飛ばせる）
+type archiveSkipError struct {
+	err error
+}
+
+func (e *archiveSkipError) Error() string {
+	return e.err.Error()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveModeCreatesNoOutputDirectories(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fromDir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "out.zip")
+	cfg := Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll, Archive: archivePath}
+	for _, op := range []func(context.Context, Config) error{listUp, createOutputDir, execCopy} {
+		if err := op(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 書庫に書き出す場合は、出力先には（metaDir 以外の）ディレクトリを作らない
+	dirEntries, err := os.ReadDir(toDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range dirEntries {
+		if e.Name() != metaDir {
+			t.Errorf("%s must not be created in toDir", e.Name())
+		}
+	}
+	if _, err := os.Stat(archivePath); err != nil {
+		t.Errorf("archive must be created: %v", err)
+	}
+}
+
+func TestArchiveOutputRemovesPartialOnFailure(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	fromPath := filepath.Join(fromDir, "a.jpg")
+	if err := os.WriteFile(fromPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "out.tar")
+	cfg := Config{ToDir: toDir, Archive: archivePath}
+	w := &copyWorker{logger: newTestLogger(), engine: copyEngineStream, fromSt: localStorage{}, toSt: localStorage{}, progress: newProgress(1, 4)}
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		entry   copyEntry
+		wantErr bool
+	}{
+		// 出力先からの相対パスにできないエントリは書庫全体の失敗にする
+		{name: "failed", ctx: context.Background(), entry: copyEntry{fromPath: fromPath, toPath: "a.jpg", kind: copyKindFile, size: 4}, wantErr: true},
+		{name: "canceled", ctx: canceledContext(), entry: copyEntry{fromPath: fromPath, toPath: filepath.Join(toDir, "a.jpg"), kind: copyKindFile, size: 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := execCopyToArchive(tt.ctx, cfg, []copyEntry{tt.entry}, w)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			// 書きかけの書庫（.partial）は残さず、書庫も作らない
+			if _, err := os.Stat(archivePath + archivePartialSuffix); !os.IsNotExist(err) {
+				t.Errorf("partial archive must be removed: %v", err)
+			}
+			if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+				t.Errorf("archive must not be created: %v", err)
+			}
+		})
+	}
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
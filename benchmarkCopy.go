@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const benchmarkCopyLogFileName = "benchmarkCopy.log"
+const benchmarkCopyRounds = 3
+
+// benchmarkCopy は benchmarkFile を各コピー方式（stream / optimized）で出力先にコピーし、速度を比較する。
+// 2回目以降はページキャッシュに載った状態での計測になる点に注意。
+func benchmarkCopy(ctx context.Context, cfg Config) error {
+	metaRoot := getMetaRoot(cfg)
+
+	logger, closeLogFile := openBenchmarkCopyLogFile(ctx, metaRoot)
+	defer closeLogFile()
+
+	logger.Info("START")
+
+	fi, err := os.Stat(cfg.BenchmarkFile)
+	if err != nil {
+		return err
+	}
+
+	for _, engine := range []string{copyEngineStream, copyEngineOptimized} {
+		w := &copyWorker{logger: logger, engine: engine, fromSt: localStorage{}, toSt: localStorage{}}
+		toPath := filepath.Join(metaRoot, metaDir, "benchmark_"+engine+"_"+fi.Name())
+
+		var total time.Duration
+		for i := 0; i < benchmarkCopyRounds; i++ {
+			if ctx.Err() != nil {
+				logger.Warn("canceled", "err", ctx.Err())
+				return nil
+			}
+
+			start := time.Now()
+			if _, err := w.copyContent(ctx, cfg.BenchmarkFile, toPath); err != nil {
+				return err
+			}
+			elapsed := time.Since(start)
+			total += elapsed
+			logger.Info("benchmark", "engine", engine, "round", i+1, "elapsed", elapsed, "MBps", mbps(fi.Size(), elapsed))
+
+			if err := os.Remove(toPath); err != nil {
+				logger.Warn("failed to remove", "dst", toPath, "err", err)
+			}
+		}
+
+		avg := total / benchmarkCopyRounds
+		result := fmt.Sprintf("%-9s size=%s avg=%s (%.1f MB/s)", engine, formatBytes(fi.Size()), avg, mbps(fi.Size(), avg))
+		logger.Info("benchmark", "engine", engine, "size", fi.Size(), "avg", avg, "MBps", mbps(fi.Size(), avg))
+		fmt.Println(result)
+	}
+
+	logger.Info("END")
+	return nil
+}
+
+func mbps(size int64, d time.Duration) float64 {
+	return float64(size) / 1024 / 1024 / d.Seconds()
+}
+
+func openBenchmarkCopyLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, benchmarkCopyLogFileName))
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBenchmarkCopyUsesMetaRoot(t *testing.T) {
+	logConsoleOutput = io.Discard
+
+	benchmarkFile := filepath.Join(t.TempDir(), "a.jpg")
+	if err := os.WriteFile(benchmarkFile, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	metaRoot := t.TempDir()
+	if err := createDirectory(filepath.Join(metaRoot, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	// 出力先がリモート（ローカルには無いパス）でも、ログと計測用のファイルは metaRoot の下に置く
+	cfg := Config{ToDir: "/remote/out", MetaRoot: metaRoot, BenchmarkFile: benchmarkFile}
+	if err := benchmarkCopy(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(metaRoot, metaDir, benchmarkCopyLogFileName)); err != nil {
+		t.Errorf("log must be written under metaRoot: %v", err)
+	}
+}
@@ -1,35 +1,61 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"log"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 const checkDuplicationLogFileName = "checkDuplication.log"
 const dupDir = "__duplicated__"
 
-func checkDuplication(toDir string) {
-	closeLogFile := openCheckDuplicationLogFile(toDir)
+func checkDuplication(ctx context.Context, cfg Config) (err error) {
+	toDir := cfg.ToDir
+
+	logger, closeLogFile := openCheckDuplicationLogFile(ctx, getMetaRoot(cfg))
 	defer closeLogFile()
 
-	createDirectory(filepath.Join(toDir, dupDir))
+	closeMetricsSummary := startMetricsSummary(logger, getMetaRoot(cfg), checkDuplicationLogFileName)
+	defer closeMetricsSummary()
+
+	report := newRunReport(ctx, logger, &cfg, checkDuplicationLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(getMetaRoot(cfg))
+	}()
+
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	if err := toSt.mkdirAll(filepath.Join(toDir, dupDir)); err != nil {
+		return err
+	}
 
-	log.Printf("START: %s\n", time.Now().Format(time.RFC3339))
-	bytesFilePathMap := make(map[string][]oldNewPath)
-	if err := filepath.WalkDir(toDir, func(path string, d os.DirEntry, err error) error {
+	logger.Info("START")
+	// 走査中に移動すると一覧（S3 の ListObjects 等）が変わるので、対象のファイルを全て集めてから移動する
+	var files []walkedFile
+	if err := toSt.walkDir(toDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Println("failed to WalkDir", err)
+			logger.Error("failed to WalkDir", "dst", path, "err", err)
 			return err
 		}
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		fi, err := d.Info()
 		if err != nil {
-			log.Println("failed to get directory info", err)
+			logger.Warn("failed to get directory info", "dst", path, "err", err)
 			return nil
 		}
 
@@ -42,64 +68,136 @@ func checkDuplication(toDir string) {
 			return nil
 		}
 
+		// ストアの実体は出力先のファイル（リンク）と同じ内容なので対象外
+		if isStoreObjectPath(cfg, path) {
+			return nil
+		}
+
 		if strings.Contains(path, dupDir) {
 			return nil
 		}
 
-		someBytes, err := readSomeBytes(path)
-		if err != nil {
-			return err
+		files = append(files, walkedFile{path: path, size: fi.Size()})
+		return nil
+	}); err != nil {
+		if isCanceled(err) {
+			logger.Warn("canceled", "err", err)
+			return nil
 		}
-		if someBytes == nil {
-			log.Println("size 0", path)
+		return err
+	}
+
+	if err := moveDuplicates(ctx, logger, cfg, toSt, report, files); err != nil {
+		if isCanceled(err) {
+			logger.Warn("canceled", "err", err)
 			return nil
 		}
+		return err
+	}
 
-		if containsSomeBytes(someBytes, bytesFilePathMap) {
-			alreadyPaths := bytesFilePathMap[string(someBytes)]
-			onPath := alreadyPaths[0]
-			alreadyDir, _ := filepath.Split(onPath.newPath)
+	logger.Info("END")
+	return nil
+}
 
-			if len(alreadyPaths) == 1 {
-				createDirectory(alreadyDir)
-				log.Printf("onPath.newPath: %s\n", onPath.newPath)
-				if err := renameFile(onPath.oldPath, onPath.newPath); err != nil {
-					log.Fatal(err)
-				}
-			}
+// walkedFile は走査で集めたファイル
+type walkedFile struct {
+	path string
+	size int64
+}
 
-			toFileName := createWithSubDirFileName(path)
-			log.Printf("(in contains) toFileName: %s\n", toFileName)
-			toPath := filepath.Join(alreadyDir, toFileName)
-			if err := renameFile(path, toPath); err != nil {
-				log.Fatal(err)
-			}
+// moveDuplicates は先頭 1024 バイトが同じファイルを __duplicated__/<グループ>/ に移動する。
+// 重複の確認で「重複ではない」として戻せるよう、移動前のパスを duplicateOriginList に記録する。
+func moveDuplicates(ctx context.Context, logger *slog.Logger, cfg Config, toSt storage, report *runReport, files []walkedFile) error {
+	metaRoot := getMetaRoot(cfg)
+	groups, err := findDuplicateGroups(ctx, logger, toSt, loadNotDuplicateList(logger, metaRoot), files)
+	if err != nil {
+		return err
+	}
 
-			bytesFilePathMap[string(someBytes)] = append(bytesFilePathMap[string(someBytes)], oldNewPath{path, toPath})
+	originList, closeOriginList, err := openFile(logger, getDuplicateOriginListFilePath(metaRoot))
+	if err != nil {
+		return err
+	}
+	defer closeOriginList()
 
-			return nil
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		groupDir := filepath.Join(cfg.ToDir, dupDir, uuid.NewString())
+		if err := toSt.mkdirAll(groupDir); err != nil {
+			return err
 		}
 
-		toFileName := createWithSubDirFileName(path)
-		log.Printf("toFileName: %s\n", toFileName)
-		toPath := filepath.Join(toDir, dupDir, uuid.NewString(), toFileName)
-		bytesFilePathMap[string(someBytes)] = []oldNewPath{{path, toPath}}
+		firstPath := ""
+		for i, file := range group {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			toPath := filepath.Join(groupDir, createWithSubDirFileName(file.path))
+			// 別のディレクトリの同じ名前のディレクトリ・ファイル同士は、連番を付けて上書きしないようにする
+			if _, err := toSt.stat(toPath); err == nil {
+				toPath = insertBeforeExt(toPath, fmt.Sprintf("_%d", i))
+			}
+			logger.Debug("move duplicate", "src", file.path, "dst", toPath)
+			if err := toSt.rename(file.path, toPath); err != nil {
+				return err
+			}
+			if _, err := originList.WriteString(fmt.Sprintf("%s%s%s\n", toPath, seps, file.path)); err != nil {
+				logger.Error("failed to write duplicateOriginList", "src", file.path, "dst", toPath, "err", err)
+			}
 
-		return nil
-	}); err != nil {
-		log.Fatal(err)
+			if i == 0 {
+				firstPath = toPath
+				continue
+			}
+			metricDuplicatesFound.Inc()
+			report.addDuplicate(file.path, file.size, i == 1)
+			_ = runHooks(ctx, logger, hookEvent{Event: hookEventDuplicateFound, Src: file.path, Dst: toPath, Size: file.size, Original: firstPath})
+		}
 	}
+	return nil
+}
+
+// findDuplicateGroups は先頭 1024 バイトが同じファイルを走査順にグループにまとめる（checkDuplication と deDuplication で共通）。
+// 「重複ではない」とされたファイル同士は同じグループにしない。
+func findDuplicateGroups(ctx context.Context, logger *slog.Logger, toSt storage, notDuplicates notDuplicateList, files []walkedFile) ([][]walkedFile, error) {
+	var groups [][]walkedFile
+	// 先頭 1024 バイト -> groups のインデックス
+	groupsByBytes := make(map[string][]int)
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		someBytes, err := readSomeBytesFrom(toSt, file.path)
+		if err != nil {
+			return nil, err
+		}
+		if someBytes == nil {
+			logger.Info("size 0", "dst", file.path)
+			continue
+		}
 
-	//for _, oldNewPaths := range bytesFilePathMap {
-	//	for _, oldNewPath := range oldNewPaths {
-	//		log.Printf("[oldPath:%s] [newPath:%s]\n", oldNewPath.oldPath, oldNewPath.newPath)
-	//	}
-	//}
-	log.Printf("END  : %s\n", time.Now().Format(time.RFC3339))
+		key := string(someBytes)
+		added := false
+		for _, i := range groupsByBytes[key] {
+			if !notDuplicates.separates(groups[i], file.path) {
+				groups[i] = append(groups[i], file)
+				added = true
+				break
+			}
+		}
+		if !added {
+			groupsByBytes[key] = append(groupsByBytes[key], len(groups))
+			groups = append(groups, []walkedFile{file})
+		}
+	}
+	return groups, nil
 }
 
-func openCheckDuplicationLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, checkDuplicationLogFileName))
+func openCheckDuplicationLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, checkDuplicationLogFileName))
 }
 
 func createWithSubDirFileName(path string) string {
@@ -111,3 +209,93 @@ func createWithSubDirFileName(path string) string {
 	}
 	return fmt.Sprintf("%s____%s", subDir, fileName)
 }
+
+const notDuplicateListFileName = "notDuplicateList.txt"
+const duplicateOriginListFileName = "duplicateOriginList.txt"
+
+// getDuplicateGroupID は path が __duplicated__/<グループ>/ の中のファイルならグループの ID を返す
+func getDuplicateGroupID(toDir string, path string) (string, bool) {
+	rel, err := filepath.Rel(filepath.Join(toDir, dupDir), path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	groupID, _, ok := strings.Cut(rel, string(filepath.Separator))
+	return groupID, ok
+}
+
+func getNotDuplicateListFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, notDuplicateListFileName)
+}
+
+func getDuplicateOriginListFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, duplicateOriginListFileName)
+}
+
+// notDuplicateList は「重複ではない」として元の場所に戻したファイルのパス -> グループの ID
+type notDuplicateList map[string]string
+
+// separates は path が group のいずれかのファイルと「重複ではない」とされているかを返す
+func (l notDuplicateList) separates(group []walkedFile, path string) bool {
+	groupID, ok := l[path]
+	if !ok {
+		return false
+	}
+	for _, file := range group {
+		if l[file.path] == groupID {
+			return true
+		}
+	}
+	return false
+}
+
+func loadNotDuplicateList(logger *slog.Logger, rootPath string) notDuplicateList {
+	l := make(notDuplicateList)
+	for _, fields := range readSepsFile(logger, getNotDuplicateListFilePath(rootPath)) {
+		l[fields[1]] = fields[0]
+	}
+	return l
+}
+
+func appendNotDuplicateList(logger *slog.Logger, rootPath string, groupID string, paths []string) error {
+	f, closeFunc, err := openFile(logger, getNotDuplicateListFilePath(rootPath))
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	for _, path := range paths {
+		if _, err := f.WriteString(fmt.Sprintf("%s%s%s\n", groupID, seps, path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadDuplicateOriginList は __duplicated__ に移動したファイルのパス -> 移動前のパスを返す
+func loadDuplicateOriginList(logger *slog.Logger, rootPath string) map[string]string {
+	origins := make(map[string]string)
+	for _, fields := range readSepsFile(logger, getDuplicateOriginListFilePath(rootPath)) {
+		origins[fields[0]] = fields[1]
+	}
+	return origins
+}
+
+// readSepsFile は seps で区切った2列の行を読み込む（ファイルが無ければ空）
+func readSepsFile(logger *slog.Logger, path string) [][]string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Error("failed to read", "path", path, "err", err)
+		}
+		return nil
+	}
+
+	var lines [][]string
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Split(line, seps)
+		if len(fields) == 2 {
+			lines = append(lines, fields)
+		}
+	}
+	return lines
+}
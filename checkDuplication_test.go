@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setupTestDuplicates は内容が同じファイルを2つのディレクトリに置いた出力先を作る
+func setupTestDuplicates(t *testing.T) (Config, []string) {
+	t.Helper()
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	toDir := t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{filepath.Join(toDir, "images", "trip", "a.jpg"), filepath.Join(toDir, "images", "party", "a.jpg")}
+	for _, path := range paths {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("same"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return Config{ToDir: toDir}, paths
+}
+
+func getOnlyDuplicateGroup(t *testing.T, cfg Config) duplicateGroup {
+	t.Helper()
+	groups, err := listDuplicateGroups(newTestLogger(), localStorage{}, cfg.ToDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 || len(groups[0].Files) != 2 {
+		t.Fatalf("groups = %+v, want one group of 2 files", groups)
+	}
+	return groups[0]
+}
+
+func TestNotDuplicateRestoresOriginalPaths(t *testing.T) {
+	cfg, paths := setupTestDuplicates(t)
+	if err := checkDuplication(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	group := getOnlyDuplicateGroup(t, cfg)
+
+	if err := applyDuplicateDecision(newTestLogger(), localStorage{}, nil, cfg.ToDir, cfg.ToDir, group.ID, duplicateDecision{NotDuplicate: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s is not restored: %v", path, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(cfg.ToDir, dupDir, group.ID)); !os.IsNotExist(err) {
+		t.Errorf("group dir must be removed: %v", err)
+	}
+
+	// 戻したファイルは、次の checkDuplication・deDuplication で重複として扱わない
+	if err := checkDuplication(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := deDuplication(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s must stay: %v", path, err)
+		}
+	}
+}
+
+func TestKeeperRemovesOtherDuplicates(t *testing.T) {
+	cfg, _ := setupTestDuplicates(t)
+	if err := checkDuplication(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	group := getOnlyDuplicateGroup(t, cfg)
+
+	keeper := group.Files[0]
+	report := newRunReport(context.Background(), newTestLogger(), &cfg, deDuplicationLogFileName)
+	if err := applyDuplicateDecision(newTestLogger(), localStorage{}, report, cfg.ToDir, cfg.ToDir, group.ID, duplicateDecision{Keeper: keeper.Name}); err != nil {
+		t.Fatal(err)
+	}
+	// 削除したファイルは deDuplication と同じくサマリに数える
+	if removed := report.Outcomes[reportOutcomeRemoved].Files; removed != len(group.Files)-1 {
+		t.Errorf("removed = %d, want %d", removed, len(group.Files)-1)
+	}
+	if _, err := os.Stat(keeper.Path); err != nil {
+		t.Errorf("keeper %s must stay: %v", keeper.Path, err)
+	}
+	if _, err := os.Stat(group.Files[1].Path); !os.IsNotExist(err) {
+		t.Errorf("%s must be removed: %v", group.Files[1].Path, err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	collisionStrategySkip            = "skip"
+	collisionStrategyOverwrite       = "overwrite"
+	collisionStrategySuffix          = "suffix"
+	collisionStrategyKeepNewer       = "keepNewer"
+	collisionStrategySkipIfIdentical = "skipIfIdentical"
+)
+
+func getCollisionStrategy(cfg Config) string {
+	switch cfg.CollisionStrategy {
+	case collisionStrategySkip, collisionStrategyOverwrite, collisionStrategyKeepNewer, collisionStrategySkipIfIdentical:
+		return cfg.CollisionStrategy
+	}
+	return collisionStrategySuffix
+}
+
+// copyPlan は copyList に書き出す予定のエントリを出力先パスの重複を解決しながら保持する
+type copyPlan struct {
+	logger   *slog.Logger
+	strategy string
+	fromSt   storage
+	toSt     storage
+	entries  []copyEntry
+	// 出力先パス -> entries のインデックス
+	plannedPaths map[string]int
+	// 取り込み済み・同じ内容かの判定で計算したハッシュ（listUp の他の判定と共有する）
+	hashes *hashCache
+	// 後のコピー元に置き換えて計画から外したエントリ（listUp でサマリの件数を数え直す）
+	replaced []copyEntry
+}
+
+func newCopyPlan(logger *slog.Logger, strategy string, fromSt storage, toSt storage) *copyPlan {
+	return &copyPlan{
+		logger:       logger,
+		strategy:     strategy,
+		fromSt:       fromSt,
+		toSt:         toSt,
+		plannedPaths: make(map[string]int),
+		hashes:       newHashCache(),
+	}
+}
+
+// add は出力先パスの重複（今回の計画内・出力先に既存のファイル）を strategy に従って解決して追加する。
+// エントリが計画に含まれた（追加または置き換えた）場合は true を返す。
+func (p *copyPlan) add(entry copyEntry) bool {
+	if idx, ok := p.plannedPaths[entry.toPath]; ok {
+		return p.resolvePlanned(entry, idx)
+	}
+
+	if _, err := p.toSt.stat(entry.toPath); err == nil {
+		return p.resolveExisting(entry)
+	}
+
+	p.append(entry)
+	return true
+}
+
+func (p *copyPlan) append(entry copyEntry) {
+	p.plannedPaths[entry.toPath] = len(p.entries)
+	p.entries = append(p.entries, entry)
+}
+
+func (p *copyPlan) resolvePlanned(entry copyEntry, idx int) bool {
+	planned := p.entries[idx]
+	p.logger.Info("collision", "src", entry.fromPath, "dst", entry.toPath, "plannedFrom", planned.fromPath, "strategy", p.strategy)
+
+	switch p.strategy {
+	case collisionStrategySkip:
+		p.logger.Info("collision: skipped", "src", entry.fromPath, "dst", entry.toPath)
+		return false
+	case collisionStrategyOverwrite:
+		p.replacePlanned(idx, entry)
+		return true
+	case collisionStrategyKeepNewer:
+		if isNewer(p.fromSt, entry.fromPath, p.fromSt, planned.fromPath) {
+			p.replacePlanned(idx, entry)
+			return true
+		}
+		p.logger.Info("collision: skipped", "src", entry.fromPath, "dst", entry.toPath)
+		return false
+	case collisionStrategySkipIfIdentical:
+		if p.isIdentical(p.fromSt, entry.fromPath, p.fromSt, planned.fromPath) {
+			p.logger.Info("collision: identical", "src", entry.fromPath, "dst", entry.toPath)
+			return false
+		}
+	}
+
+	return p.addWithSuffix(entry, planned.label)
+}
+
+// replacePlanned は計画済みのエントリを entry に置き換え、外したエントリを replaced に残す
+func (p *copyPlan) replacePlanned(idx int, entry copyEntry) {
+	dropped := p.entries[idx]
+	p.logger.Info("collision: replaced", "src", dropped.fromPath, "dst", dropped.toPath, "replacedBy", entry.fromPath)
+	p.replaced = append(p.replaced, dropped)
+	p.entries[idx] = entry
+}
+
+// takeReplaced は前回から置き換えて計画から外したエントリを返す
+func (p *copyPlan) takeReplaced() []copyEntry {
+	replaced := p.replaced
+	p.replaced = nil
+	return replaced
+}
+
+func (p *copyPlan) resolveExisting(entry copyEntry) bool {
+	p.logger.Info("collision with existing file", "src", entry.fromPath, "dst", entry.toPath, "strategy", p.strategy)
+
+	switch p.strategy {
+	case collisionStrategySkip:
+		p.logger.Info("collision: skipped", "src", entry.fromPath, "dst", entry.toPath)
+		return false
+	case collisionStrategyOverwrite:
+		p.append(entry)
+		return true
+	case collisionStrategyKeepNewer:
+		if isNewer(p.fromSt, entry.fromPath, p.toSt, entry.toPath) {
+			p.append(entry)
+			return true
+		}
+		p.logger.Info("collision: skipped", "src", entry.fromPath, "dst", entry.toPath)
+		return false
+	case collisionStrategySkipIfIdentical:
+		if p.isIdentical(p.fromSt, entry.fromPath, p.toSt, entry.toPath) {
+			p.logger.Info("collision: identical", "src", entry.fromPath, "dst", entry.toPath)
+			return false
+		}
+	}
+
+	return p.addWithSuffix(entry, "")
+}
+
+// addWithSuffix は空いている出力先パスを探して追加する。
+// 別のコピー元と重なった場合はまずラベルを付与し、それでも重なる場合は " (1)" のような連番を付与する。
+func (p *copyPlan) addWithSuffix(entry copyEntry, conflictingLabel string) bool {
+	base := entry.toPath
+	if conflictingLabel != "" && conflictingLabel != entry.label {
+		base = insertBeforeExt(entry.toPath, "_"+entry.label)
+		if p.isFree(base) {
+			return p.appendRenamed(entry, base)
+		}
+	}
+
+	for i := 1; ; i++ {
+		candidate := insertBeforeExt(base, fmt.Sprintf(" (%d)", i))
+		if p.isFree(candidate) {
+			return p.appendRenamed(entry, candidate)
+		}
+	}
+}
+
+func (p *copyPlan) appendRenamed(entry copyEntry, toPath string) bool {
+	p.logger.Info("collision: renamed", "src", entry.fromPath, "dst", toPath, "planned", entry.toPath)
+	entry.toPath = toPath
+	p.append(entry)
+	return true
+}
+
+func (p *copyPlan) isFree(path string) bool {
+	if _, ok := p.plannedPaths[path]; ok {
+		return false
+	}
+	if _, err := p.toSt.stat(path); err == nil {
+		return false
+	}
+	return true
+}
+
+func isNewer(st1 storage, path1 string, st2 storage, path2 string) bool {
+	fi1, err := st1.stat(path1)
+	if err != nil {
+		return false
+	}
+	fi2, err := st2.stat(path2)
+	if err != nil {
+		return true
+	}
+	return fi1.ModTime().After(fi2.ModTime())
+}
+
+func (p *copyPlan) isIdentical(st1 storage, path1 string, st2 storage, path2 string) bool {
+	fi1, err := st1.stat(path1)
+	if err != nil {
+		return false
+	}
+	fi2, err := st2.stat(path2)
+	if err != nil || fi1.Size() != fi2.Size() {
+		return false
+	}
+
+	same, err := p.hashes.sameContent(st1, path1, st2, path2)
+	if err != nil {
+		p.logger.Warn("failed to compare content", "src", path1, "dst", path2, "err", err)
+		return false
+	}
+	return same
+}
+
+func insertBeforeExt(path string, s string) string {
+	dir, file := filepath.Split(path)
+	ext := filepath.Ext(file)
+	return filepath.Join(dir, strings.TrimSuffix(file, ext)+s+ext)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKeepNewerComparesWithCopiedFile(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	entry := copyEntry{fromPath: filepath.Join(fromDir, "a.jpg"), toPath: filepath.Join(toDir, "a.jpg"), kind: copyKindFile}
+	if err := os.WriteFile(entry.fromPath, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(entry.fromPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &copyWorker{logger: newTestLogger(), fromSt: localStorage{}, toSt: localStorage{}}
+	if err := w.copyFile(context.Background(), entry.fromPath, entry.toPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// コピーした時点から変わっていないコピー元は、出力先より新しくない
+	plan := newCopyPlan(newTestLogger(), collisionStrategyKeepNewer, localStorage{}, localStorage{})
+	if plan.add(entry) {
+		t.Error("unchanged source must not overwrite the copied file")
+	}
+
+	// コピーした後より前の日時でも、コピー元が更新されていれば上書きする（出力先の更新日時がコピーした日時だと上書きされない）
+	if err := os.WriteFile(entry.fromPath, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(30 * time.Minute)
+	if err := os.Chtimes(entry.fromPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	plan = newCopyPlan(newTestLogger(), collisionStrategyKeepNewer, localStorage{}, localStorage{})
+	if !plan.add(entry) || len(plan.entries) != 1 || plan.entries[0].toPath != entry.toPath {
+		t.Errorf("entries = %+v, want the updated source to overwrite %s", plan.entries, entry.toPath)
+	}
+}
+
+func TestOverwritePlannedEntryIsCountedAsReplaced(t *testing.T) {
+	plan := newCopyPlan(newTestLogger(), collisionStrategyOverwrite, localStorage{}, localStorage{})
+	report := newRunReport(context.Background(), newTestLogger(), nil, listUpLogFileName)
+	first := copyEntry{fromPath: "/in1/a.jpg", toPath: "/out/a.jpg", kind: copyKindFile, size: 1}
+	second := copyEntry{fromPath: "/in2/a.jpg", toPath: "/out/a.jpg", kind: copyKindFile, size: 2}
+	for _, entry := range []copyEntry{first, second} {
+		if !plan.add(entry) {
+			t.Fatalf("%s must be planned", entry.fromPath)
+		}
+		report.add(reportOutcomeListed, entry.fromPath, entry.size)
+		for _, dropped := range plan.takeReplaced() {
+			report.replaceListed(dropped.fromPath, dropped.size)
+		}
+	}
+
+	// 置き換えたエントリは listed から外し、replaced として数える
+	if len(plan.entries) != 1 || plan.entries[0].fromPath != second.fromPath {
+		t.Errorf("entries = %+v, want only %s", plan.entries, second.fromPath)
+	}
+	if got := report.Outcomes[reportOutcomeListed]; got != (reportCount{Files: 1, Bytes: 2}) {
+		t.Errorf("listed = %+v, want 1 file of 2 bytes", got)
+	}
+	if got := report.Outcomes[reportOutcomeReplaced]; got != (reportCount{Files: 1, Bytes: 1}) {
+		t.Errorf("replaced = %+v, want 1 file of 1 byte", got)
+	}
+}
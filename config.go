@@ -1,20 +1,123 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/spf13/viper"
 	"log"
+	"path/filepath"
+	"sort"
 )
 
 type Config struct {
-	FromDir             string   `yaml:"fromDir"`
-	ToDir               string   `yaml:"toDir"`
-	TargetExts          string   `yaml:"targetExts"`
-	TargetDocumentsExts []string `yaml:"targetDocumentsExts"`
-	TargetImagesExts    []string `yaml:"targetImagesExts"`
-	TargetMusicsExts    []string `yaml:"targetMusicsExts"`
-	TargetVideosExts    []string `yaml:"targetVideosExts"`
-	Rename              bool     `yaml:"rename"`
-	Operation           int      `yaml:"operation"`
+	FromDir                string           `yaml:"fromDir"`
+	FromDirs               []FromDirConfig  `yaml:"fromDirs"`
+	OutputDirTemplate      string           `yaml:"outputDirTemplate"`
+	ToDir                  string           `yaml:"toDir"`
+	TargetExts             string           `yaml:"targetExts"`
+	TargetDocumentsExts    []string         `yaml:"targetDocumentsExts"`
+	TargetImagesExts       []string         `yaml:"targetImagesExts"`
+	TargetMusicsExts       []string         `yaml:"targetMusicsExts"`
+	TargetVideosExts       []string         `yaml:"targetVideosExts"`
+	Rename                 bool             `yaml:"rename"`
+	NameMode               string           `yaml:"nameMode"`
+	CollisionStrategy      string           `yaml:"collisionStrategy"`
+	Incremental            bool             `yaml:"incremental"`
+	Move                   bool             `yaml:"move"`
+	Workers                int              `yaml:"workers"`
+	PerDeviceConcurrency   int              `yaml:"perDeviceConcurrency"`
+	BandwidthLimitMBps     float64          `yaml:"bandwidthLimitMBps"`
+	FreeSpaceMarginPercent float64          `yaml:"freeSpaceMarginPercent"`
+	AllowPartialCopy       bool             `yaml:"allowPartialCopy"`
+	CopyEngine             string           `yaml:"copyEngine"`
+	Archive                string           `yaml:"archive"`
+	DescendArchives        bool             `yaml:"descendArchives"`
+	BenchmarkFile          string           `yaml:"benchmarkFile"`
+	SymlinkPolicy          string           `yaml:"symlinkPolicy"`
+	FromStorage            StorageConfig    `yaml:"fromStorage"`
+	ToStorage              StorageConfig    `yaml:"toStorage"`
+	MetaRoot               string           `yaml:"metaRoot"`
+	Store                  string           `yaml:"store"`
+	StoreDir               string           `yaml:"storeDir"`
+	WatchSettleSeconds     int              `yaml:"watchSettleSeconds"`
+	Pipelines              []PipelineConfig `yaml:"pipelines"`
+	API                    APIConfig        `yaml:"api"`
+	Metrics                MetricsConfig    `yaml:"metrics"`
+	Log                    LogConfig        `yaml:"log"`
+	Hooks                  []HookConfig     `yaml:"hooks"`
+	Notify                 NotifyConfig     `yaml:"notify"`
+	Operation              int              `yaml:"operation"`
+}
+
+// StorageConfig はコピー元・出力先のストレージ（local / sftp / s3）の設定
+type StorageConfig struct {
+	Type string `yaml:"type"`
+	// sftp
+	Host                  string `yaml:"host"`
+	Port                  int    `yaml:"port"`
+	User                  string `yaml:"user"`
+	Password              string `yaml:"password"`
+	KeyFile               string `yaml:"keyFile"`
+	KnownHostsFile        string `yaml:"knownHostsFile"`
+	InsecureIgnoreHostKey bool   `yaml:"insecureIgnoreHostKey"`
+	// s3
+	Endpoint  string `yaml:"endpoint"`
+	Bucket    string `yaml:"bucket"`
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	UseSSL    bool   `yaml:"useSSL"`
+}
+
+// PipelineConfig は daemon で定期実行するパイプライン1件分の設定
+type PipelineConfig struct {
+	Name     string   `yaml:"name"`
+	Schedule string   `yaml:"schedule"`
+	Steps    []string `yaml:"steps"`
+}
+
+// APIConfig はローカルの HTTP API の設定
+type APIConfig struct {
+	Addr  string `yaml:"addr"`
+	Token string `yaml:"token"`
+}
+
+// MetricsConfig は daemon / watch で公開する Prometheus の /metrics の設定
+type MetricsConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+// LogConfig は各 operation のログの形式・レベル・ローテーションの設定
+type LogConfig struct {
+	Format       string `yaml:"format"`
+	Level        string `yaml:"level"`
+	ConsoleLevel string `yaml:"consoleLevel"`
+	MaxSizeMB    int    `yaml:"maxSizeMB"`
+	MaxBackups   int    `yaml:"maxBackups"`
+	MaxAgeDays   int    `yaml:"maxAgeDays"`
+}
+
+// HookConfig はイベント（before-copy / after-copy / duplicate-found / run-finished / error-threshold）時に実行する外部コマンド1件分の設定
+type HookConfig struct {
+	Events         []string `yaml:"events"`
+	Command        []string `yaml:"command"`
+	TimeoutSeconds int      `yaml:"timeoutSeconds"`
+}
+
+// NotifyConfig は operation の終了時・エラーが閾値に達した時の通知（Webhook・syslog）の設定
+type NotifyConfig struct {
+	WebhookURL     string `yaml:"webhookURL"`
+	Syslog         bool   `yaml:"syslog"`
+	ErrorThreshold int    `yaml:"errorThreshold"`
+	OnlyOnFailure  bool   `yaml:"onlyOnFailure"`
+}
+
+// FromDirConfig はコピー元ディレクトリ1件分の設定
+type FromDirConfig struct {
+	Path       string `yaml:"path"`
+	Label      string `yaml:"label"`
+	TargetExts string `yaml:"targetExts"`
+	Priority   int    `yaml:"priority"`
 }
 
 func getConfig() Config {
@@ -30,12 +133,77 @@ func getConfig() Config {
 	if err := viper.Unmarshal(&cfg); err != nil {
 		log.Fatal(err)
 	}
+	if err := validateConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
 	return cfg
 }
 
+// validateConfig は実行中（daemon のパイプライン等）ではなく起動時に分かる設定の誤りを確認する
+func validateConfig(cfg Config) error {
+	for _, st := range []StorageConfig{cfg.FromStorage, cfg.ToStorage} {
+		switch st.Type {
+		case "", storageTypeLocal, storageTypeSFTP, storageTypeS3:
+		default:
+			return fmt.Errorf("unknown storage type: %s", st.Type)
+		}
+	}
+	if cfg.MetaRoot == "" && cfg.ToStorage.Type != "" && cfg.ToStorage.Type != storageTypeLocal {
+		return errors.New("metaRoot is required when toStorage is not local")
+	}
+	switch cfg.Store {
+	case "", storeModeHardlink, storeModeSymlink:
+	default:
+		return fmt.Errorf("unknown store mode: %s", cfg.Store)
+	}
+	if cfg.Store != "" && cfg.ToStorage.Type != "" && cfg.ToStorage.Type != storageTypeLocal {
+		return errors.New("store is only supported for local toStorage")
+	}
+	return nil
+}
+
 const TargetExtsAll = "all"
 const TargetExtsDocuments = "documents"
 const TargetExtsImages = "images"
 const TargetExtsMusics = "musics"
 const TargetExtsVideos = "videos"
 const TargetExtsOthers = "others"
+
+const (
+	nameModeUUID    = "uuid"
+	nameModeHash    = "hash"
+	nameModeCounter = "counter"
+)
+
+const defaultOutputDirTemplate = "{exts}/{dir}"
+
+// getFromDirs は fromDirs（未指定なら fromDir）を priority の高い順に返す
+func getFromDirs(cfg Config) []FromDirConfig {
+	var fromDirs []FromDirConfig
+	if len(cfg.FromDirs) == 0 {
+		fromDirs = []FromDirConfig{{Path: cfg.FromDir}}
+	} else {
+		fromDirs = append(fromDirs, cfg.FromDirs...)
+	}
+
+	for i := range fromDirs {
+		if fromDirs[i].Label == "" {
+			fromDirs[i].Label = filepath.Base(fromDirs[i].Path)
+		}
+		if fromDirs[i].TargetExts == "" {
+			fromDirs[i].TargetExts = cfg.TargetExts
+		}
+	}
+
+	sort.SliceStable(fromDirs, func(i, j int) bool {
+		return fromDirs[i].Priority > fromDirs[j].Priority
+	})
+	return fromDirs
+}
+
+func getOutputDirTemplate(cfg Config) string {
+	if cfg.OutputDirTemplate == "" {
+		return defaultOutputDirTemplate
+	}
+	return cfg.OutputDirTemplate
+}
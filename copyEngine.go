@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	copyEngineStream    = "stream"
+	copyEngineOptimized = "optimized"
+)
+
+const (
+	// 通常のファイルのバッファサイズ
+	smallCopyBufferSize = 256 * 1024
+	// 大きいファイル（動画等）のバッファサイズ
+	largeCopyBufferSize = 4 * 1024 * 1024
+	largeFileThreshold  = 1024 * 1024 * 1024
+	// カーネル内コピー（copy_file_range / sendfile）1回あたりの長さ（キャンセル・進捗・帯域制限の単位）
+	kernelCopyChunkSize = 8 * 1024 * 1024
+)
+
+// errKernelCopyUnsupported はカーネル内コピーが使えない（OS やファイルシステムが未対応）ことを表す
+var errKernelCopyUnsupported = errors.New("kernel copy is not supported")
+
+// fileRegion はファイル中のデータ（穴ではない）部分
+type fileRegion struct {
+	offset int64
+	length int64
+}
+
+func getCopyEngine(cfg Config) string {
+	if cfg.CopyEngine == copyEngineOptimized {
+		return copyEngineOptimized
+	}
+	return copyEngineStream
+}
+
+// copyStream は io.Copy でコピーする（従来の方法）
+func copyStream(ctx context.Context, fromFile io.Reader, toFile io.Writer, prog *copyCounter, bucket *tokenBucket) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(toFile, h, prog), &throttledReader{ctx: ctx, r: &contextReader{ctx: ctx, r: fromFile}, bucket: bucket}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copyOptimized は穴（sparse 領域）を保ったままデータ部分だけをコピーする。
+// データ部分は可能ならカーネル内コピー（copy_file_range / sendfile）、できなければファイルサイズに応じたバッファでコピーする。
+func copyOptimized(ctx context.Context, fromFile *os.File, toFile *os.File, prog *copyCounter, bucket *tokenBucket) (string, error) {
+	fi, err := fromFile.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := fi.Size()
+
+	regions, err := getDataRegions(fromFile, size)
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, getCopyBufferSize(fi))
+	h := sha256.New()
+	useKernelCopy := true
+	kernelCopied := false
+
+	pos := int64(0)
+	for _, r := range regions {
+		// 穴の部分は読み書きしないが、進捗上はコピー済みとして数える
+		prog.addBytes(r.offset - pos)
+		if !kernelCopied {
+			// 穴の部分はハッシュ上は 0 として扱う
+			if err := writeZeros(h, r.offset-pos, buf); err != nil {
+				return "", err
+			}
+		}
+
+		done := int64(0)
+		if useKernelCopy {
+			n, err := copyRegionInKernel(ctx, fromFile, toFile, r, prog, bucket)
+			done = n
+			if n > 0 {
+				kernelCopied = true
+			}
+			if errors.Is(err, errKernelCopyUnsupported) {
+				useKernelCopy = false
+			} else if err != nil {
+				return "", err
+			}
+		}
+
+		if done < r.length {
+			rest := fileRegion{offset: r.offset + done, length: r.length - done}
+			var w io.Writer = prog
+			if !kernelCopied {
+				w = io.MultiWriter(h, prog)
+			}
+			if err := copyRegionInUserspace(ctx, fromFile, toFile, rest, w, bucket, buf); err != nil {
+				return "", err
+			}
+		}
+		pos = r.offset + r.length
+	}
+
+	// 末尾の穴はサイズを合わせることで保つ
+	if err := toFile.Truncate(size); err != nil {
+		return "", err
+	}
+	prog.addBytes(size - pos)
+
+	if kernelCopied {
+		// カーネル内コピーしたデータはユーザー空間を通らないので、コピー元を読み直してハッシュを計算する
+		return hashReader(io.NewSectionReader(fromFile, 0, size), buf)
+	}
+	if err := writeZeros(h, size-pos, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getDataRegions は SEEK_DATA / SEEK_HOLE でデータ部分の一覧を返す。未対応の場合はファイル全体を1つのデータ部分とする。
+func getDataRegions(f *os.File, size int64) ([]fileRegion, error) {
+	var regions []fileRegion
+	offset := int64(0)
+	for offset < size {
+		dataStart, err := f.Seek(offset, unix.SEEK_DATA)
+		if err != nil {
+			if errors.Is(err, syscall.ENXIO) {
+				// offset 以降はすべて穴
+				break
+			}
+			return []fileRegion{{offset: 0, length: size}}, nil
+		}
+		holeStart, err := f.Seek(dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return []fileRegion{{offset: 0, length: size}}, nil
+		}
+		regions = append(regions, fileRegion{offset: dataStart, length: holeStart - dataStart})
+		offset = holeStart
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// getCopyBufferSize はファイルサイズに応じたバッファサイズを、ファイルシステムのブロックサイズの倍数で返す
+func getCopyBufferSize(fi os.FileInfo) int {
+	size := smallCopyBufferSize
+	if fi.Size() >= largeFileThreshold {
+		size = largeCopyBufferSize
+	}
+
+	if statT, ok := fi.Sys().(*syscall.Stat_t); ok && statT.Blksize > 0 {
+		blockSize := int(statT.Blksize)
+		size = (size + blockSize - 1) / blockSize * blockSize
+	}
+	return size
+}
+
+func copyRegionInUserspace(ctx context.Context, fromFile *os.File, toFile *os.File, r fileRegion, w io.Writer, bucket *tokenBucket, buf []byte) error {
+	reader := &throttledReader{ctx: ctx, r: &contextReader{ctx: ctx, r: io.NewSectionReader(fromFile, r.offset, r.length)}, bucket: bucket}
+	// io.CopyBuffer が ReaderFrom / WriterTo を使わずに buf を使うよう、Writer は MultiWriter で包む
+	_, err := io.CopyBuffer(io.MultiWriter(io.NewOffsetWriter(toFile, r.offset), w), reader, buf)
+	return err
+}
+
+func writeZeros(h hash.Hash, n int64, buf []byte) error {
+	clear(buf)
+	for n > 0 {
+		chunk := min(n, int64(len(buf)))
+		if _, err := h.Write(buf[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func hashReader(r io.Reader, buf []byte) (string, error) {
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, r, buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
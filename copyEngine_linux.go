@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRegionInKernel は copy_file_range（使えなければ sendfile）でデータ部分をコピーし、コピーできたバイト数を返す
+func copyRegionInKernel(ctx context.Context, fromFile *os.File, toFile *os.File, r fileRegion, prog *copyCounter, bucket *tokenBucket) (int64, error) {
+	copied := int64(0)
+	useSendfile := false
+
+	for copied < r.length {
+		if ctx.Err() != nil {
+			return copied, ctx.Err()
+		}
+
+		chunk := int(min(r.length-copied, kernelCopyChunkSize))
+		roff := r.offset + copied
+		woff := roff
+
+		var n int
+		var err error
+		if !useSendfile {
+			n, err = unix.CopyFileRange(int(fromFile.Fd()), &roff, int(toFile.Fd()), &woff, chunk, 0)
+			if isKernelCopyUnsupported(err) && copied == 0 {
+				useSendfile = true
+				continue
+			}
+		} else {
+			// sendfile は出力先のオフセットを指定できないので、出力先を先に移動しておく
+			if _, err := toFile.Seek(woff, io.SeekStart); err != nil {
+				return copied, err
+			}
+			n, err = unix.Sendfile(int(toFile.Fd()), int(fromFile.Fd()), &roff, chunk)
+			if isKernelCopyUnsupported(err) && copied == 0 {
+				return 0, errKernelCopyUnsupported
+			}
+		}
+		if err != nil {
+			return copied, err
+		}
+		if n == 0 {
+			return copied, io.ErrUnexpectedEOF
+		}
+
+		copied += int64(n)
+		prog.addBytes(int64(n))
+		if bucket != nil {
+			if err := bucket.wait(ctx, n); err != nil {
+				return copied, err
+			}
+		}
+	}
+	return copied, nil
+}
+
+func isKernelCopyUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.EOPNOTSUPP)
+}
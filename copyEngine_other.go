@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"os"
+)
+
+// copyRegionInKernel は Linux 以外ではカーネル内コピーを使わない
+func copyRegionInKernel(_ context.Context, _ *os.File, _ *os.File, _ fileRegion, _ *copyCounter, _ *tokenBucket) (int64, error) {
+	return 0, errKernelCopyUnsupported
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRandomFile(tb testing.TB, path string, size int64) []byte {
+	tb.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func copyWithEngine(tb testing.TB, engine string, fromPath string, toPath string) string {
+	tb.Helper()
+	fromFile, err := os.Open(fromPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer fromFile.Close()
+	toFile, err := os.Create(toPath)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer toFile.Close()
+
+	var hash string
+	if engine == copyEngineOptimized {
+		hash, err = copyOptimized(context.Background(), fromFile, toFile, nil, nil)
+	} else {
+		hash, err = copyStream(context.Background(), fromFile, toFile, nil, nil)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return hash
+}
+
+func TestCopyEngines(t *testing.T) {
+	dir := t.TempDir()
+	fromPath := filepath.Join(dir, "from")
+	data := writeRandomFile(t, fromPath, 3*1024*1024+123)
+	sum := sha256.Sum256(data)
+
+	for _, engine := range []string{copyEngineStream, copyEngineOptimized} {
+		t.Run(engine, func(t *testing.T) {
+			toPath := filepath.Join(dir, engine)
+			hash := copyWithEngine(t, engine, fromPath, toPath)
+			if hash != hex.EncodeToString(sum[:]) {
+				t.Errorf("hash = %s, want %s", hash, hex.EncodeToString(sum[:]))
+			}
+			got, err := os.ReadFile(toPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("copied content differs")
+			}
+		})
+	}
+}
+
+func TestCopyOptimizedKeepsHoles(t *testing.T) {
+	dir := t.TempDir()
+	fromPath := filepath.Join(dir, "sparse")
+	f, err := os.Create(fromPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 先頭と末尾にだけデータがあり、間が穴のファイル
+	if _, err := f.Write([]byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("tail"), 64*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	toPath := filepath.Join(dir, "copied")
+	copyWithEngine(t, copyEngineOptimized, fromPath, toPath)
+
+	fromFi, err := os.Stat(fromPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toFi, err := os.Stat(toPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if toFi.Size() != fromFi.Size() {
+		t.Errorf("size = %d, want %d", toFi.Size(), fromFi.Size())
+	}
+	got, err := os.ReadFile(toPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(got, []byte("head")) || !bytes.HasSuffix(got, []byte("tail")) {
+		t.Error("copied content differs")
+	}
+}
+
+func benchmarkCopyEngine(b *testing.B, engine string, size int64) {
+	dir := b.TempDir()
+	fromPath := filepath.Join(dir, "from")
+	writeRandomFile(b, fromPath, size)
+	toPath := filepath.Join(dir, "to")
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyWithEngine(b, engine, fromPath, toPath)
+	}
+}
+
+func BenchmarkCopyStreamSmall(b *testing.B) {
+	benchmarkCopyEngine(b, copyEngineStream, 256*1024)
+}
+
+func BenchmarkCopyOptimizedSmall(b *testing.B) {
+	benchmarkCopyEngine(b, copyEngineOptimized, 256*1024)
+}
+
+func BenchmarkCopyStreamLarge(b *testing.B) {
+	benchmarkCopyEngine(b, copyEngineStream, 64*1024*1024)
+}
+
+func BenchmarkCopyOptimizedLarge(b *testing.B) {
+	benchmarkCopyEngine(b, copyEngineOptimized, 64*1024*1024)
+}
@@ -2,32 +2,62 @@ package main
 
 import (
 	"bufio"
-	"io/fs"
-	"log"
-	"os"
+	"context"
+	"log/slog"
 	"path/filepath"
 )
 
 const createOutputDirLogFileName = "createOutputDir.log"
 
-func createOutputDir(cfg Config) {
-	closeLogFile := openCreateOutputDirLogFile(cfg.ToDir)
+func createOutputDir(ctx context.Context, cfg Config) (err error) {
+	metaRoot := getMetaRoot(cfg)
+
+	logger, closeLogFile := openCreateOutputDirLogFile(ctx, metaRoot)
 	defer closeLogFile()
 
-	outputDirSetFile, closeOutputDirSetFile := open(getOutputDirSetFilePath(cfg.ToDir))
+	report := newRunReport(ctx, logger, &cfg, createOutputDirLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(metaRoot)
+	}()
+
+	// 書庫に書き出す場合は、ディレクトリは書庫の中のパスにだけ現れる
+	if cfg.Archive != "" {
+		logger.Info("archive, output directories are not created", "dst", cfg.Archive)
+		return nil
+	}
+
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	outputDirSetFile, closeOutputDirSetFile, err := open(logger, getOutputDirSetFilePath(metaRoot))
+	if err != nil {
+		return err
+	}
 	defer closeOutputDirSetFile()
 
 	outputDirSetFileScanner := bufio.NewScanner(outputDirSetFile)
 	for outputDirSetFileScanner.Scan() {
+		if ctx.Err() != nil {
+			logger.Warn("canceled", "err", ctx.Err())
+			return nil
+		}
+
 		dirPath := outputDirSetFileScanner.Text()
-		if err := os.Mkdir(dirPath, fs.ModePerm); err != nil {
-			log.Printf("failed to mkdir %s: %s\n", dirPath, err.Error())
+		if err := toSt.mkdirAll(dirPath); err != nil {
+			logger.Error("failed to mkdir", "dst", dirPath, "err", err)
+			report.addError(dirPath, 0, err)
 			continue
 		}
-		log.Printf("created: %s\n", dirPath)
+		logger.Info("created", "dst", dirPath)
+		report.add(reportOutcomeCreated, dirPath, 0)
 	}
+	return outputDirSetFileScanner.Err()
 }
 
-func openCreateOutputDirLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, createOutputDirLogFileName))
+func openCreateOutputDirLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, createOutputDirLogFileName))
 }
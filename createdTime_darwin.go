@@ -0,0 +1,17 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// getCreatedTime はファイルの作成日時（birthtime）を返す
+func getCreatedTime(_ string, fi fs.FileInfo) time.Time {
+	statT, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		// 書庫内のファイル等は作成日時が無いので更新日時を使う
+		return fi.ModTime()
+	}
+	return time.Unix(statT.Birthtimespec.Sec, statT.Birthtimespec.Nsec)
+}
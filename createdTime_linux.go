@@ -0,0 +1,23 @@
+package main
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// getCreatedTime はファイルの作成日時を statx の btime で返す（ファイルシステムが対応していなければ更新日時を使う）
+func getCreatedTime(path string, fi fs.FileInfo) time.Time {
+	// 書庫内・SFTP 等のファイルはローカルのパスではないので更新日時を使う
+	if _, ok := fi.Sys().(*syscall.Stat_t); !ok {
+		return fi.ModTime()
+	}
+
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil || stx.Mask&unix.STATX_BTIME == 0 {
+		return fi.ModTime()
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !linux
+
+package main
+
+import (
+	"io/fs"
+	"time"
+)
+
+// getCreatedTime は作成日時を取れない OS では更新日時を返す
+func getCreatedTime(_ string, fi fs.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+	"log"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+const daemonLogFileName = "daemon.log"
+
+// パイプラインの各ステップ名
+const (
+	stepList      = "list"
+	stepMkdirs    = "mkdirs"
+	stepCopy      = "copy"
+	stepCheckDup  = "checkDup"
+	stepDeDup     = "deDup"
+	stepRenameDir = "renameDir"
+	stepMoveDir   = "moveDir"
+)
+
+// pipelineSteps はステップ名と operation の処理の対応
+var pipelineSteps = map[string]func(context.Context, Config) error{
+	stepList:      listUp,
+	stepMkdirs:    createOutputDir,
+	stepCopy:      execCopy,
+	stepCheckDup:  checkDuplication,
+	stepDeDup:     deDuplication,
+	stepRenameDir: renameDir,
+	stepMoveDir:   moveDir,
+}
+
+// stepLogFileNames はステップ名と、そのステップのログファイル名の対応
+var stepLogFileNames = map[string]string{
+	stepList:      listUpLogFileName,
+	stepMkdirs:    createOutputDirLogFileName,
+	stepCopy:      execCopyLogFileName,
+	stepCheckDup:  checkDuplicationLogFileName,
+	stepDeDup:     deDuplicationLogFileName,
+	stepRenameDir: renameDirLogFileName,
+	stepMoveDir:   moveDirLogFileName,
+}
+
+// daemon は pipelines の schedule（cron 形式）に従ってパイプラインを繰り返し実行する
+func daemon(ctx context.Context, cfg Config) {
+	metaRoot := getMetaRoot(cfg)
+
+	logger, closeLogFile := openDaemonLogFile(ctx, metaRoot)
+	defer closeLogFile()
+
+	logger.Info("START")
+
+	if len(cfg.Pipelines) == 0 && cfg.API.Addr == "" {
+		log.Fatal("no pipelines are configured")
+	}
+
+	c := cron.New()
+	for _, p := range cfg.Pipelines {
+		if err := validatePipeline(p); err != nil {
+			log.Fatal(err)
+		}
+
+		p := p
+		if _, err := c.AddFunc(p.Schedule, func() {
+			runPipeline(ctx, logger, cfg, uuid.NewString(), p)
+		}); err != nil {
+			log.Fatal(fmt.Errorf("invalid schedule of pipeline %s: %w", p.Name, err))
+		}
+		logger.Info("pipeline", "pipeline", p.Name, "schedule", p.Schedule, "steps", p.Steps)
+	}
+
+	// api.addr を指定した場合は HTTP API も起動する
+	waitAPI := func() {}
+	if cfg.API.Addr != "" {
+		waitAPI = startAPIServer(ctx, logger, cfg)
+	}
+
+	// metrics.addr を指定した場合は /metrics も公開する
+	waitMetrics := func() {}
+	if cfg.Metrics.Addr != "" {
+		var err error
+		if waitMetrics, err = startMetricsServer(ctx, logger, cfg.Metrics.Addr); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	c.Start()
+	<-ctx.Done()
+	logger.Info("canceled, waiting for running pipelines", "err", ctx.Err())
+	// 実行中のパイプラインはキャンセルを受けて終了するので、その終了を待つ
+	<-c.Stop().Done()
+	waitAPI()
+	waitMetrics()
+	logger.Info("END")
+}
+
+func validatePipeline(p PipelineConfig) error {
+	if p.Name == "" {
+		return errors.New("pipeline name is required")
+	}
+	if len(p.Steps) == 0 {
+		return fmt.Errorf("pipeline %s has no steps", p.Name)
+	}
+	for _, step := range p.Steps {
+		if _, ok := pipelineSteps[step]; !ok {
+			return fmt.Errorf("unknown step in pipeline %s: %s", p.Name, step)
+		}
+	}
+	return nil
+}
+
+// runPipeline はロックを取得してパイプラインのステップを順に実行し、結果を実行履歴に追記する。
+// 別の実行が動いている場合は実行せず skipped として記録する。
+func runPipeline(ctx context.Context, logger *slog.Logger, cfg Config, runID string, p PipelineConfig) runRecord {
+	metaRoot := getMetaRoot(cfg)
+	errorListPath := filepath.Join(metaRoot, metaDir, errorListName)
+
+	// HTTP API から個別に停止できるよう、パイプライン毎にキャンセルできるようにする
+	ctx, cancel := context.WithCancel(withPipeline(withRunID(ctx, runID), p.Name))
+	defer cancel()
+
+	r := runRecord{RunID: runID, Pipeline: p.Name, Steps: p.Steps, StartedAt: time.Now()}
+	defer func() {
+		r.EndedAt = time.Now()
+		appendRunHistory(logger, metaRoot, r)
+		logger.Info("run finished", "pipeline", p.Name, "pipelineRunId", r.RunID, "outcome", r.Outcome, "errors", r.ErrorCount, "duration", r.EndedAt.Sub(r.StartedAt).Round(time.Second))
+		runEvents.publish(runEvent{Type: runEventRunFinished, RunID: r.RunID, Pipeline: p.Name, Run: &r})
+		// 通知はステップ毎ではなくパイプラインの実行毎に1回（中断した場合も呼び出すよう、新しい ctx で呼び出す）
+		_ = runHooks(withRunID(context.Background(), r.RunID), logger, hookEvent{Event: hookEventPipelineFinished, Pipeline: p.Name, Run: &r})
+	}()
+
+	unlock, err := acquireRunLock(logger, metaRoot)
+	if err != nil {
+		r.Outcome = runOutcomeSkipped
+		r.Message = err.Error()
+		return r
+	}
+	defer unlock()
+
+	activeRuns.add(r, cancel)
+	defer activeRuns.remove(r.RunID)
+
+	logger.Info("run start", "pipeline", p.Name, "pipelineRunId", r.RunID)
+	runEvents.publish(runEvent{Type: runEventRunStarted, RunID: r.RunID, Pipeline: p.Name})
+	r.ErrorListStart = countLines(errorListPath)
+	for _, step := range p.Steps {
+		if ctx.Err() != nil {
+			break
+		}
+		logger.Info("step", "pipeline", p.Name, "pipelineRunId", r.RunID, "step", step)
+		activeRuns.setStep(r.RunID, step)
+		runEvents.publish(runEvent{Type: runEventStepStarted, RunID: r.RunID, Pipeline: p.Name, Step: step})
+		if err := runStep(ctx, step, cfg); err != nil {
+			// 失敗したステップの後のステップは実行しない（daemon は次の実行を続ける）
+			logger.Error("step failed", "pipeline", p.Name, "pipelineRunId", r.RunID, "step", step, "err", err)
+			r.Outcome = runOutcomeFailed
+			r.Message = fmt.Sprintf("%s: %s", step, err)
+			break
+		}
+	}
+	r.ErrorCount = countLines(errorListPath) - r.ErrorListStart
+
+	switch {
+	case r.Outcome == runOutcomeFailed:
+	case ctx.Err() != nil:
+		r.Outcome = runOutcomeCanceled
+	case r.ErrorCount > 0:
+		r.Outcome = runOutcomeErrors
+	default:
+		r.Outcome = runOutcomeSuccess
+	}
+	return r
+}
+
+// runStep はステップを実行する。想定外の panic でも daemon ごと終了しないよう、ステップの失敗として返す。
+func runStep(ctx context.Context, step string, cfg Config) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return pipelineSteps[step](ctx, cfg)
+}
+
+func openDaemonLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, daemonLogFileName))
+}
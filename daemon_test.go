@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestRunPipelineRecordsFailedStep(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	toDir := t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ToDir: toDir}
+	// copyList.txt が無いので copy のステップは失敗し、後続の checkDup は実行しない
+	p := PipelineConfig{Name: "nightly", Steps: []string{stepCopy, stepCheckDup}}
+
+	r := runPipeline(context.Background(), newTestLogger(), cfg, "run1", p)
+	if r.Outcome != runOutcomeFailed {
+		t.Errorf("outcome = %s, want %s", r.Outcome, runOutcomeFailed)
+	}
+	if !strings.HasPrefix(r.Message, stepCopy+": ") {
+		t.Errorf("message = %q, want the failed step", r.Message)
+	}
+
+	records, err := loadRunHistory(newTestLogger(), toDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].RunID != "run1" || records[0].Outcome != runOutcomeFailed {
+		t.Errorf("history = %+v, want one failed run", records)
+	}
+}
@@ -1,30 +1,51 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"io/fs"
+	"log/slog"
 	"path/filepath"
-	"strings"
-	"time"
 )
 
 const deDuplicationLogFileName = "deDuplication.log"
 
-func deDuplication(toDir string) {
-	closeLogFile := openDeDuplicationLogFile(toDir)
+func deDuplication(ctx context.Context, cfg Config) (err error) {
+	toDir := cfg.ToDir
+
+	logger, closeLogFile := openDeDuplicationLogFile(ctx, getMetaRoot(cfg))
 	defer closeLogFile()
 
-	log.Printf("START: %s\n", time.Now().Format(time.RFC3339))
-	bytesFilePathMap := make(map[string][]oldNewPath)
-	if err := filepath.WalkDir(toDir, func(path string, d os.DirEntry, err error) error {
+	closeMetricsSummary := startMetricsSummary(logger, getMetaRoot(cfg), deDuplicationLogFileName)
+	defer closeMetricsSummary()
+
+	report := newRunReport(ctx, logger, &cfg, deDuplicationLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(getMetaRoot(cfg))
+	}()
+
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	logger.Info("START")
+	// 走査中に削除すると一覧（S3 の ListObjects 等）が変わるので、対象のファイルを全て集めてから削除する
+	var files []walkedFile
+	if err := toSt.walkDir(toDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Println("failed to WalkDir", err)
+			logger.Error("failed to WalkDir", "dst", path, "err", err)
 			return err
 		}
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		fi, err := d.Info()
 		if err != nil {
-			log.Println("failed to get directory info", err)
+			logger.Warn("failed to get directory info", "dst", path, "err", err)
 			return nil
 		}
 
@@ -37,39 +58,56 @@ func deDuplication(toDir string) {
 			return nil
 		}
 
-		someBytes, err := readSomeBytes(path)
-		if err != nil {
-			return err
-		}
-		if someBytes == nil {
-			log.Println("size 0", path)
+		// ストアの実体は出力先のファイル（リンク）と同じ内容なので対象外
+		if isStoreObjectPath(cfg, path) {
 			return nil
 		}
 
-		if containsSomeBytes(someBytes, bytesFilePathMap) {
-			if err := os.Remove(path); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			dir, fileName := filepath.Split(path)
-			subDir := filepath.Join(dir, strings.ReplaceAll(fileName, ".", "_"))
-			toPath := filepath.Join(subDir, fileName)
-			bytesFilePathMap[string(someBytes)] = []oldNewPath{{path, toPath}}
-		}
-
+		files = append(files, walkedFile{path: path, size: fi.Size()})
 		return nil
 	}); err != nil {
-		log.Fatal(err)
+		if isCanceled(err) {
+			logger.Warn("canceled", "err", err)
+			return nil
+		}
+		return err
+	}
+
+	// 重複の確認で「重複ではない」とされたファイル同士は削除しない
+	groups, err := findDuplicateGroups(ctx, logger, toSt, loadNotDuplicateList(logger, getMetaRoot(cfg)), files)
+	if err != nil {
+		if isCanceled(err) {
+			logger.Warn("canceled", "err", err)
+			return nil
+		}
+		return err
+	}
+	for _, group := range groups {
+		if ctx.Err() != nil {
+			logger.Warn("canceled", "err", ctx.Err())
+			return nil
+		}
+		logger.Debug("kept", "dst", group[0].path)
+		if err := removeDuplicates(logger, toSt, report, group[0].path, group[1:]); err != nil {
+			return err
+		}
 	}
+	logger.Info("END")
+	return nil
+}
 
-	for _, oldNewPaths := range bytesFilePathMap {
-		for _, oldNewPath := range oldNewPaths {
-			log.Printf("[oldPath:%s] [newPath:%s]\n", oldNewPath.oldPath, oldNewPath.newPath)
+// removeDuplicates は keeperPath と重複する files を削除する（重複の確認の画面で残すファイルを選んだ時も使う）
+func removeDuplicates(logger *slog.Logger, toSt storage, report *runReport, keeperPath string, files []walkedFile) error {
+	for _, file := range files {
+		if err := toSt.remove(file.path); err != nil {
+			return err
 		}
+		logger.Info("removed", "dst", file.path, "keeper", keeperPath)
+		report.addRemovedDuplicate(file.path, file.size)
 	}
-	log.Printf("END  : %s\n", time.Now().Format(time.RFC3339))
+	return nil
 }
 
-func openDeDuplicationLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, deDuplicationLogFileName))
+func openDeDuplicationLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, deDuplicationLogFileName))
 }
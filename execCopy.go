@@ -2,110 +2,559 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
 const errorListName = "errorList.txt"
 const execCopyLogFileName = "execCopy.log"
 
-func execCopy(toDir string) {
-	closeLogFile := openExecCopyLogFile(toDir)
+func execCopy(ctx context.Context, cfg Config) (err error) {
+	metaRoot := getMetaRoot(cfg)
+
+	logger, closeLogFile := openExecCopyLogFile(ctx, metaRoot)
 	defer closeLogFile()
 
-	log.Printf("START: %s\n", time.Now().Format(time.RFC3339))
+	closeMetricsSummary := startMetricsSummary(logger, metaRoot, execCopyLogFileName)
+	defer closeMetricsSummary()
+
+	report := newRunReport(ctx, logger, &cfg, execCopyLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(metaRoot)
+	}()
+
+	logger.Info("START")
 
-	copyListFile, closeCopyListFile := open(getCopyListFilePath(toDir))
+	copyListFile, closeCopyListFile, err := open(logger, getCopyListFilePath(metaRoot))
+	if err != nil {
+		return err
+	}
 	defer closeCopyListFile()
 
-	errorList, closeErrorListFile := openErrorListFile(toDir)
+	errorList, closeErrorListFile, err := openErrorListFile(logger, metaRoot)
+	if err != nil {
+		return err
+	}
 	defer closeErrorListFile()
 
-	cpuNum := runtime.NumCPU()
-	log.Printf("NumCPU: %d\n", cpuNum)
+	db, closeImportDB, err := openImportDBWriter(logger, metaRoot)
+	if err != nil {
+		return err
+	}
+	defer closeImportDB()
+
+	journal, closeJournal, err := openUndoJournal(logger, metaRoot)
+	if err != nil {
+		return err
+	}
+	defer closeJournal()
+
+	fromSt, closeFromSt, err := openStorage(logger, cfg.FromStorage)
+	if err != nil {
+		return err
+	}
+	defer closeFromSt()
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	entries, err := readCopyList(copyListFile)
+	if err != nil {
+		return err
+	}
+
+	// サイズはコピー元の storage で取得する（事前チェックもこのサイズで行う）
+	totalBytes := sumCopySize(fromSt, entries)
+	// リモートの出力先は statfs で空き容量を確認できないため事前チェックしない
+	if toSt.isLocal() || cfg.Archive != "" {
+		var ok bool
+		entries, ok = preflight(logger, cfg, fromSt, entries)
+		if !ok {
+			return errors.New("not enough free space, copy is not started")
+		}
+		totalBytes = sumEntrySizes(entries)
+	}
+
+	prog := newProgress(int64(len(entries)), totalBytes)
+	stopProgress := prog.start(ctx)
+	defer stopProgress()
+	activeProgress.Store(prog)
+	defer activeProgress.Store(nil)
+
+	bucket := newTokenBucket(mbpsToBytes(cfg.BandwidthLimitMBps))
+	if mbps, err := readBandwidthControlFile(getBandwidthControlFilePath(metaRoot)); err == nil {
+		bucket.setRate(mbpsToBytes(mbps))
+	}
+	logger.Info("bandwidth limit", "MBps", bucket.getRate()/1024/1024)
+	go watchBandwidthControlFile(ctx, logger, getBandwidthControlFilePath(metaRoot), bucket)
+
+	w := &copyWorker{logger: logger, errorList: errorList, db: db, journal: journal, progress: prog, bucket: bucket, engine: getCopyEngine(cfg), fromSt: fromSt, toSt: toSt, store: newContentStore(cfg), report: report}
+
+	if cfg.Archive != "" {
+		if err := execCopyToArchive(ctx, cfg, entries, w); err != nil {
+			return err
+		}
+		logger.Info("END")
+		return nil
+	}
+
+	if w.store != nil {
+		if cfg.Move {
+			logger.Warn("move is ignored when writing to the store")
+		}
+		logger.Info("store", "dst", w.store.objectsDir, "mode", w.store.mode)
+	}
+
+	workers := getWorkers(cfg)
+	logger.Info("workers", "numCPU", runtime.NumCPU(), "workers", workers, "perDeviceConcurrency", cfg.PerDeviceConcurrency)
 
 	// ★ 同時実行 goroutine 数の制御のためにチャネル用意
-	semaphore := make(chan struct{}, cpuNum*6)
+	semaphore := make(chan struct{}, workers)
 
 	wg := &sync.WaitGroup{}
 
+	// デバイスの枠（デバイス毎の列を処理する goroutine）を先に取り、作業を取り出してから全体の枠を取る。
+	// 混んでいるデバイスの作業が全体の枠を持ったまま待つことはない。
+	for _, queue := range queueByDevice(groupCopyUnits(fromSt, entries), cfg.PerDeviceConcurrency, workers) {
+		for i := 0; i < queue.workers; i++ {
+			wg.Add(1)
+			go func(units <-chan copyUnit) {
+				defer wg.Done()
+				for unit := range units {
+					// キャンセルされたら新しいコピーは開始せず、実行中のコピーの終了（ロールバック）を待つ
+					select {
+					case <-ctx.Done():
+					case semaphore <- struct{}{}:
+					}
+					if ctx.Err() != nil {
+						return
+					}
+					w.execUnit(ctx, cfg, unit)
+					<-semaphore // 処理後にチャネルから値を抜き出さないと、次の作業を開始できない
+				}
+			}(queue.units)
+		}
+	}
+
+	wg.Wait()
+	if ctx.Err() != nil {
+		logger.Warn("canceled, stop scheduling", "err", ctx.Err())
+	}
+	logger.Info("END")
+	return nil
+}
+
+func readCopyList(copyListFile *os.File) ([]copyEntry, error) {
+	var entries []copyEntry
+
 	copyListFileScanner := bufio.NewScanner(copyListFile)
 	for copyListFileScanner.Scan() {
-		semaphore <- struct{}{}
-		wg.Add(1)
-
-		line := copyListFileScanner.Text()
-		fromTo := strings.Split(line, seps)
-		go func() {
-			err := copyFile(fromTo[0], fromTo[1], errorList, semaphore, wg)
-			if err != nil {
-				log.Println(err)
-			}
-		}()
+		entries = append(entries, parseCopyListLine(copyListFileScanner.Text()))
+	}
+	if err := copyListFileScanner.Err(); err != nil {
+		return nil, err
 	}
+	return entries, nil
+}
 
-	wg.Wait()
-	log.Printf("END  : %s\n", time.Now().Format(time.RFC3339))
+// sumCopySize は各エントリにコピー元のサイズを設定し、進捗表示用に合計を返す
+func sumCopySize(fromSt storage, entries []copyEntry) int64 {
+	var totalBytes int64
+	for i, entry := range entries {
+		if entry.kind != copyKindFile {
+			continue
+		}
+		if fi, err := fromSt.stat(entry.fromPath); err == nil {
+			entries[i].size = fi.Size()
+			totalBytes += fi.Size()
+		}
+	}
+	return totalBytes
 }
 
-func copyFile(fromPath string, toPath string, errorList *os.File, semaphore chan struct{}, wg *sync.WaitGroup) error {
-	defer func() {
-		<-semaphore // 処理後にチャネルから値を抜き出さないと、次の goroutine が起動できない
-	}()
-	defer wg.Done()
+// sumEntrySizes は sumCopySize で設定したサイズの合計を返す
+func sumEntrySizes(entries []copyEntry) int64 {
+	var totalBytes int64
+	for _, entry := range entries {
+		totalBytes += entry.size
+	}
+	return totalBytes
+}
+
+// copyWorker は execCopy の各 goroutine が共有する出力先（ログ・エラー一覧・importDB・undoJournal・進捗）とストレージをまとめる
+type copyWorker struct {
+	logger    *slog.Logger
+	errorList *os.File
+	db        *importDBWriter
+	journal   *undoJournal
+	progress  *progress
+	// 1件分のバイト数（execEntry がエントリ毎に withCopyCounter で設定する）
+	counter *copyCounter
+	bucket  *tokenBucket
+	engine  string
+	fromSt  storage
+	toSt    storage
+	store   *contentStore
+	report  *runReport
+}
+
+// copyUnit は1つの goroutine で順にコピーするエントリ（書庫内のファイルは書庫毎にまとめる）
+type copyUnit struct {
+	archivePath string
+	entries     []copyEntry
+}
+
+// groupCopyUnits は同じ書庫内のファイルを書庫の順に並べて1つにまとめ、それ以外は1件ずつにする（copyList の順を保つ）
+func groupCopyUnits(fromSt storage, entries []copyEntry) []copyUnit {
+	var units []copyUnit
+	archiveUnits := make(map[string]int)
+	for _, entry := range entries {
+		archivePath, _, ok := splitArchivePath(entry.fromPath)
+		if !ok || !fromSt.isLocal() {
+			units = append(units, copyUnit{entries: []copyEntry{entry}})
+			continue
+		}
+		i, exists := archiveUnits[archivePath]
+		if !exists {
+			i = len(units)
+			archiveUnits[archivePath] = i
+			units = append(units, copyUnit{archivePath: archivePath})
+		}
+		units[i].entries = append(units[i].entries, entry)
+	}
+	for _, unit := range units {
+		if unit.archivePath != "" {
+			sortByArchiveOrder(unit.archivePath, unit.entries)
+		}
+	}
+	return units
+}
+
+// execUnit は copyUnit のエントリを順にコピーする
+func (w *copyWorker) execUnit(ctx context.Context, cfg Config, unit copyUnit) {
+	if unit.archivePath != "" {
+		// 書庫を1回だけ読むよう、この作業の中では書庫を開いたまま書庫の順に読む
+		archiveSt := newArchiveStreamStorage(w.fromSt)
+		defer archiveSt.close()
+		unitWorker := *w
+		unitWorker.fromSt = archiveSt
+		w = &unitWorker
+	}
+
+	for _, entry := range unit.entries {
+		if ctx.Err() != nil {
+			w.logger.Warn("canceled", "src", entry.fromPath, "dst", entry.toPath, "err", ctx.Err())
+			return
+		}
+		w.execEntry(ctx, cfg, entry)
+		w.progress.fileDone()
+	}
+}
 
-	fromFile, err := os.Open(fromPath)
+// getWorkers は同時実行数を返す（未指定なら CPU 数の 6 倍）
+func getWorkers(cfg Config) int {
+	if cfg.Workers > 0 {
+		return cfg.Workers
+	}
+	return runtime.NumCPU() * 6
+}
+
+// execEntry は1件をコピーし、結果をエラー一覧・統計・サマリに記録する
+func (w *copyWorker) execEntry(ctx context.Context, cfg Config, entry copyEntry) {
+	if err := w.beforeCopy(ctx, entry); err != nil {
+		if ctx.Err() != nil {
+			w.logger.Warn("canceled", "src", entry.fromPath, "dst", entry.toPath, "err", err)
+			return
+		}
+		w.fail(entry, err)
+		return
+	}
+
+	start := time.Now()
+	ew := w.withCopyCounter()
+	err := ew.copyOne(ctx, cfg, entry)
+	metricCopyDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		log.Println("[[[ failed to open fromFile ]]]", err)
-		writeErrorList(errorList, fromPath, toPath)
-		return nil
+		ew.counter.rollback()
+		w.fail(entry, err)
+		return
+	}
+	ew.counter.commit()
+	w.done(ctx, entry)
+}
+
+// withCopyCounter はエントリ1件分のバイト数を数える copyWorker を返す（goroutine 間で共有する w は変更しない）
+func (w *copyWorker) withCopyCounter() *copyWorker {
+	ew := *w
+	ew.counter = w.progress.newCopyCounter()
+	return &ew
+}
+
+// beforeCopy は before-copy のフックを呼び出す（失敗した場合はコピーしない）。
+// 中断した後はフックを呼び出さず ctx のエラーを返す（中断をフックが拒否したとして記録しない）。
+func (w *copyWorker) beforeCopy(ctx context.Context, entry copyEntry) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := runHooks(ctx, w.logger, hookEvent{Event: hookEventBeforeCopy, Src: entry.fromPath, Dst: entry.toPath, Size: entry.size}); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("rejected by hook: %w", err)
+	}
+	return nil
+}
+
+// fail はコピーできなかったエントリを記録する
+func (w *copyWorker) fail(entry copyEntry, err error) {
+	w.logger.Error("failed", "src", entry.fromPath, "dst", entry.toPath, "err", err)
+	writeErrorList(w.logger, w.errorList, entry.fromPath, entry.toPath)
+	w.report.addError(entry.fromPath, entry.size, err)
+}
+
+// done はコピーしたエントリを記録する
+func (w *copyWorker) done(ctx context.Context, entry copyEntry) {
+	metricFilesCopied.Inc()
+	w.report.add(reportOutcomeCopied, entry.fromPath, entry.size)
+	_ = runHooks(ctx, w.logger, hookEvent{Event: hookEventAfterCopy, Src: entry.fromPath, Dst: entry.toPath, Size: entry.size})
+}
+
+// copyOne は設定（ストア・移動）とエントリの種類に応じて1件をコピーする
+func (w *copyWorker) copyOne(ctx context.Context, cfg Config, entry copyEntry) error {
+	switch {
+	case w.store != nil && entry.kind == copyKindFile:
+		return w.storeFile(ctx, entry)
+	case w.store != nil:
+		return w.copySymlink(entry.fromPath, entry.toPath)
+	case cfg.Move:
+		return w.moveFile(ctx, entry)
+	case entry.kind == copyKindSymlink:
+		return w.copySymlink(entry.fromPath, entry.toPath)
+	default:
+		return w.copyFile(ctx, entry.fromPath, entry.toPath)
+	}
+}
+
+func (w *copyWorker) copyFile(ctx context.Context, fromPath string, toPath string) error {
+	hash, err := w.copyContent(ctx, fromPath, toPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy: %w", err)
+	}
+	w.preserveModTime(fromPath, toPath)
+	w.logger.Info("copied", "src", fromPath, "dst", toPath)
+	w.db.record(w.fromSt, fromPath, toPath, hash)
+
+	return nil
+}
+
+// copyContent はファイルの内容をコピーし、コピー元の内容のハッシュを返す。
+// 途中で失敗・キャンセルした場合は中途半端な出力先ファイルを削除する。
+func (w *copyWorker) copyContent(ctx context.Context, fromPath string, toPath string) (hash string, err error) {
+	fromFile, err := w.fromSt.open(fromPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open fromFile: %w", err)
 	}
 	defer func() {
 		if err := fromFile.Close(); err != nil {
-			log.Println(err)
+			w.logger.Warn("failed to close", "src", fromPath, "err", err)
 		}
 	}()
 
-	toFile, err := os.Create(toPath)
+	toFile, err := w.toSt.create(toPath)
 	if err != nil {
-		log.Println("[[[ failed to create toFile ]]]", err)
-		writeErrorList(errorList, fromPath, toPath)
-		return nil
+		return "", fmt.Errorf("failed to create toFile: %w", err)
 	}
 	defer func() {
-		if err := toFile.Close(); err != nil {
-			log.Println(err)
+		if closeErr := toFile.Close(); closeErr != nil {
+			w.logger.Error("failed to close", "dst", toPath, "err", closeErr)
+			if err == nil {
+				err = closeErr
+			}
+		}
+		if err != nil {
+			if removeErr := w.toSt.remove(toPath); removeErr != nil {
+				w.logger.Error("failed to remove", "dst", toPath, "err", removeErr)
+			}
+			w.logger.Warn("rollback: removed", "src", fromPath, "dst", toPath)
 		}
 	}()
 
-	if _, err := io.Copy(toFile, fromFile); err != nil {
-		log.Println("[[[ failed to copy ]]]", err)
-		writeErrorList(errorList, fromPath, toPath)
+	// 取り込み済みファイルの記録用にコピーしながらハッシュを計算し、進捗用にバイト数を数える
+	from, fromOK := fromFile.(*os.File)
+	to, toOK := toFile.(*os.File)
+	if fromOK && toOK && w.engine == copyEngineOptimized {
+		return copyOptimized(ctx, from, to, w.counter, w.bucket)
+	}
+	return copyStream(ctx, fromFile, toFile, w.counter, w.bucket)
+}
+
+// copySymlink はシンボリックリンクをリンクのまま（同じリンク先で）作成する
+func (w *copyWorker) copySymlink(fromPath string, toPath string) error {
+	target, err := os.Readlink(fromPath)
+	if err != nil {
+		return fmt.Errorf("failed to readlink: %w", err)
+	}
+
+	if err := os.Symlink(target, toPath); err != nil {
+		return fmt.Errorf("failed to symlink: %w", err)
+	}
+	w.logger.Info("linked", "src", fromPath, "dst", toPath, "target", target)
+
+	return nil
+}
+
+// moveFile は同じファイルシステム上なら rename し、異なる場合はコピー・検証の後にコピー元を削除する
+func (w *copyWorker) moveFile(ctx context.Context, entry copyEntry) error {
+	fromPath, toPath := entry.fromPath, entry.toPath
+
+	// 書庫内のファイルは書庫を変更しないよう、移動せずに展開（コピー）する
+	if _, _, ok := splitArchivePath(fromPath); ok {
+		return w.copyFile(ctx, fromPath, toPath)
+	}
+
+	// コピー元・出力先のどちらかがリモートの場合は rename できないので、コピー・検証の後にコピー元を削除する
+	if !w.fromSt.isLocal() || !w.toSt.isLocal() {
+		return w.moveFileAcrossStorage(ctx, fromPath, toPath)
+	}
+
+	var size int64
+	if fi, err := os.Lstat(fromPath); err == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+
+	err := renameFile(fromPath, toPath)
+	if err == nil {
+		w.logger.Info("moved", "src", fromPath, "dst", toPath)
+		// rename は移動済みなので、記録に失敗してもエラーにはしない
+		if err := w.journal.recordMove(journalOpMove, fromPath, toPath); err != nil {
+			w.logger.Error("failed to record move", "src", fromPath, "dst", toPath, "err", err)
+		}
+		w.counter.addBytes(size)
 		return nil
 	}
-	log.Printf("copied:[from:%s] [to:%s]\n", fromPath, toPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+
+	if entry.kind == copyKindSymlink {
+		target, err := os.Readlink(fromPath)
+		if err != nil {
+			return fmt.Errorf("failed to readlink: %w", err)
+		}
+		if err := os.Symlink(target, toPath); err != nil {
+			return fmt.Errorf("failed to symlink: %w", err)
+		}
+	} else {
+		if err := w.copyAndVerify(ctx, fromPath, toPath); err != nil {
+			return fmt.Errorf("failed to copy: %w", err)
+		}
+	}
+
+	// 検証に成功し、出力先と undoJournal をディスクに書き出した場合のみコピー元を削除する
+	if err := w.toSt.sync(toPath); err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+	if err := w.journal.recordMove(journalOpMove, fromPath, toPath); err != nil {
+		return err
+	}
+	if err := os.Remove(fromPath); err != nil {
+		return fmt.Errorf("failed to remove fromFile: %w", err)
+	}
+	w.logger.Info("moved (copy)", "src", fromPath, "dst", toPath)
+
+	return nil
+}
+
+// copyAndVerify はコピー後に出力先のハッシュを計算し、コピー元と一致することを確認する
+func (w *copyWorker) copyAndVerify(ctx context.Context, fromPath string, toPath string) error {
+	hash, err := w.copyContent(ctx, fromPath, toPath)
+	if err != nil {
+		return err
+	}
+
+	toHash, err := hashStorageFile(w.toSt, toPath)
+	if err != nil {
+		return err
+	}
+	if hash != toHash {
+		return fmt.Errorf("verification failed: %s (%s) != %s (%s)", fromPath, hash, toPath, toHash)
+	}
 
+	w.preserveModTime(fromPath, toPath)
+	w.db.record(w.fromSt, fromPath, toPath, hash)
 	return nil
 }
 
-func openExecCopyLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, execCopyLogFileName))
+// preserveModTime は出力先の更新日時をコピー元に合わせる（keepNewer で出力先のファイルと比べられるように）。
+// 失敗してもコピーは成功しているので、警告だけ出す。
+func (w *copyWorker) preserveModTime(fromPath string, toPath string) {
+	fi, err := w.fromSt.stat(fromPath)
+	if err == nil {
+		err = w.toSt.chtimes(toPath, fi.ModTime())
+	}
+	if err != nil {
+		w.logger.Warn("failed to preserve mtime", "src", fromPath, "dst", toPath, "err", err)
+	}
+}
+
+// moveFileAcrossStorage は異なるストレージ間でコピー・検証の後にコピー元を削除する
+func (w *copyWorker) moveFileAcrossStorage(ctx context.Context, fromPath string, toPath string) error {
+	if err := w.copyAndVerify(ctx, fromPath, toPath); err != nil {
+		return fmt.Errorf("failed to copy: %w", err)
+	}
+
+	// 出力先と undoJournal をディスクに書き出してからコピー元を削除する
+	if err := w.toSt.sync(toPath); err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+	if err := w.journal.recordMove(journalOpMoveAcrossStorage, fromPath, toPath); err != nil {
+		return err
+	}
+	if err := w.fromSt.remove(fromPath); err != nil {
+		return fmt.Errorf("failed to remove fromFile: %w", err)
+	}
+	w.logger.Info("moved (copy)", "src", fromPath, "dst", toPath)
+
+	return nil
+}
+
+// contextReader はキャンセルされたら読み込みを中断する
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if r.ctx.Err() != nil {
+		return 0, r.ctx.Err()
+	}
+	return r.r.Read(p)
+}
+
+func openExecCopyLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, execCopyLogFileName))
 }
 
-func openErrorListFile(rootPath string) (*os.File, CloseFunc) {
-	return openFile(filepath.Join(rootPath, metaDir, errorListName))
+func openErrorListFile(logger *slog.Logger, rootPath string) (*os.File, CloseFunc, error) {
+	return openFile(logger, filepath.Join(rootPath, metaDir, errorListName))
 }
 
-func writeErrorList(errorList *os.File, fromPath string, toPath string) {
+func writeErrorList(logger *slog.Logger, errorList *os.File, fromPath string, toPath string) {
+	metricFilesFailed.Inc()
 	_, err := errorList.WriteString(fmt.Sprintf("%s%s%s\n", fromPath, seps, toPath))
 	if err != nil {
-		log.Println(err)
+		logger.Error("failed to write errorList", "src", fromPath, "dst", toPath, "err", err)
 	}
 }
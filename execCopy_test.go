@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOperationsStopWhenCanceled(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fromDir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll}
+	for _, op := range []func(context.Context, Config) error{listUp, createOutputDir} {
+		if err := op(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 中断はエラーではなく、新しいコピーは開始しない
+	ctx, cancel := context.WithCancel(withRunID(context.Background(), "run1"))
+	cancel()
+	if err := execCopy(ctx, cfg); err != nil {
+		t.Fatalf("canceled copy must not be an error: %v", err)
+	}
+	if copied := findCopied(t, toDir, "a.jpg"); copied != "" {
+		t.Errorf("%s must not be copied after cancel", copied)
+	}
+
+	// 中断した operation のサマリは canceled になる
+	b, err := os.ReadFile(filepath.Join(toDir, metaDir, reportDir, "run1", getOperationName(execCopyLogFileName)+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report runReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Outcome != runOutcomeCanceled {
+		t.Errorf("outcome = %q, want %q", report.Outcome, runOutcomeCanceled)
+	}
+
+	// 走査を中断した場合は copyList を書き出さない
+	entries, err := listUpEntries(ctx, cfg)
+	if err != nil || entries != nil {
+		t.Errorf("entries = %+v, err = %v, want nothing after cancel", entries, err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// フックを呼び出すイベント
+const (
+	hookEventBeforeCopy       = "before-copy"
+	hookEventAfterCopy        = "after-copy"
+	hookEventDuplicateFound   = "duplicate-found"
+	hookEventRunFinished      = "run-finished"
+	hookEventErrorThreshold   = "error-threshold"
+	hookEventPipelineFinished = "pipeline-finished"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// hookSettings は設定ファイルで指定した外部コマンドのフック（main で設定する）
+var hookSettings []HookConfig
+
+// hook はイベントを受け取る処理。
+// 外部コマンドの代わりにプログラムに組み込む場合は、別ファイルの init で registerHook する。
+// before-copy でエラーを返すとそのファイルはコピーせず、エラー一覧に記録する。
+type hook interface {
+	handle(ctx context.Context, event hookEvent) error
+}
+
+// hookFunc は関数を hook として登録するためのもの
+type hookFunc func(ctx context.Context, event hookEvent) error
+
+func (f hookFunc) handle(ctx context.Context, event hookEvent) error {
+	return f(ctx, event)
+}
+
+// hookEvent はフックに渡す内容（外部コマンドには JSON で標準入力に渡す）
+type hookEvent struct {
+	Event     string `json:"event"`
+	RunID     string `json:"runId"`
+	Operation string `json:"operation,omitempty"`
+	// daemon のパイプラインの中で実行した場合のパイプライン名
+	Pipeline string    `json:"pipeline,omitempty"`
+	Time     time.Time `json:"time"`
+	// before-copy / after-copy はコピー元・先、duplicate-found は重複のファイルと移動先
+	Src  string `json:"src,omitempty"`
+	Dst  string `json:"dst,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	// duplicate-found で同じ内容の（最初に見つかった）ファイル
+	Original string `json:"original,omitempty"`
+	// error-threshold で失敗したファイル数と、閾値に達したファイル（src）のエラー
+	Failed int    `json:"failed,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// run-finished でその operation のサマリ
+	Report *runReport `json:"report,omitempty"`
+	// pipeline-finished でそのパイプラインの実行結果（ロックを取得できずに実行しなかった場合も含む）
+	Run *runRecord `json:"run,omitempty"`
+}
+
+type registeredHook struct {
+	events []string
+	h      hook
+}
+
+var registeredHooks []registeredHook
+
+// registerHook は組み込みのフックを events に登録する
+func registerHook(h hook, events ...string) {
+	registeredHooks = append(registeredHooks, registeredHook{events: events, h: h})
+}
+
+// getHooks は event に登録されたフック（組み込み・外部コマンド）を返す
+func getHooks(logger *slog.Logger, event string) []hook {
+	var hooks []hook
+	for _, r := range registeredHooks {
+		if contains(r.events, event) {
+			hooks = append(hooks, r.h)
+		}
+	}
+	for _, c := range hookSettings {
+		if contains(c.Events, event) && len(c.Command) > 0 {
+			hooks = append(hooks, commandHook{cfg: c, logger: logger})
+		}
+	}
+	return hooks
+}
+
+// runHooks は event のフックを順に呼び出し、失敗したものはログに出してまとめて返す
+func runHooks(ctx context.Context, logger *slog.Logger, event hookEvent) error {
+	hooks := getHooks(logger, event.Event)
+	if len(hooks) == 0 {
+		return nil
+	}
+	if event.RunID == "" {
+		event.RunID = getRunID(ctx)
+	}
+	event.Time = time.Now()
+
+	var errs []error
+	for _, h := range hooks {
+		if err := h.handle(ctx, event); err != nil {
+			logger.Warn("hook failed", "event", event.Event, "src", event.Src, "err", err)
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// commandHook は外部コマンドを実行するフック。終了コードが 0 以外なら失敗とする
+type commandHook struct {
+	cfg    HookConfig
+	logger *slog.Logger
+}
+
+func (c commandHook) handle(ctx context.Context, event hookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, getHookTimeout(c.cfg))
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.cfg.Command[0], c.cfg.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), "ORGANISER_HOOK_EVENT="+event.Event)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", c.cfg.Command[0], err, strings.TrimSpace(string(out)))
+	}
+	if len(out) > 0 {
+		c.logger.Debug("hook output", "event", event.Event, "command", c.cfg.Command[0], "output", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func getHookTimeout(cfg HookConfig) time.Duration {
+	if cfg.TimeoutSeconds > 0 {
+		return time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+	return defaultHookTimeout
+}
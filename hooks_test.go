@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// setupTestHook は hook を events に登録する（テストの終了時に元に戻す）
+func setupTestHook(t *testing.T, h hookFunc, events ...string) {
+	t.Helper()
+	saved := registeredHooks
+	t.Cleanup(func() {
+		registeredHooks = saved
+	})
+	registerHook(h, events...)
+}
+
+func TestRunFinishedHookRunsWithoutReportLock(t *testing.T) {
+	reportOutput = io.Discard
+	// サマリのロックを持ったまま呼び出すと、フックから report を使った時に止まる
+	setupTestHook(t, func(ctx context.Context, event hookEvent) error {
+		event.Report.add(reportOutcomeSkipped, "/in/a.jpg", 1)
+		return nil
+	}, hookEventRunFinished)
+
+	report := newRunReport(withRunID(context.Background(), "run1"), newTestLogger(), nil, execCopyLogFileName)
+	done := make(chan struct{})
+	go func() {
+		report.finish(t.TempDir())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("finish did not return while the hook used the report")
+	}
+}
+
+func TestBeforeCopyHookSkippedAfterCancel(t *testing.T) {
+	calls := 0
+	setupTestHook(t, func(ctx context.Context, event hookEvent) error {
+		calls++
+		return ctx.Err()
+	}, hookEventBeforeCopy)
+
+	report := newRunReport(withRunID(context.Background(), "run1"), newTestLogger(), nil, execCopyLogFileName)
+	w := &copyWorker{logger: newTestLogger(), fromSt: localStorage{}, toSt: localStorage{}, report: report}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	entry := copyEntry{fromPath: "/in/a.jpg", toPath: "/out/a.jpg", kind: copyKindFile, size: 1}
+	w.execEntry(ctx, Config{}, entry)
+	if calls != 0 {
+		t.Errorf("hook was called %d times after cancel", calls)
+	}
+	if failed := report.Outcomes[reportOutcomeFailed].Files; failed != 0 {
+		t.Errorf("failed = %d, want a canceled entry not to be recorded as rejected", failed)
+	}
+}
+
+func TestErrorThresholdHookDoesNotBlockCopy(t *testing.T) {
+	reportOutput = io.Discard
+	saved := reportErrorThreshold
+	defer func() {
+		reportErrorThreshold = saved
+	}()
+	reportErrorThreshold = 1
+
+	// フックが終わらなくても、失敗を数えたコピーのワーカーは止まらない
+	release := make(chan struct{})
+	setupTestHook(t, func(ctx context.Context, event hookEvent) error {
+		<-release
+		return nil
+	}, hookEventErrorThreshold)
+
+	report := newRunReport(withRunID(context.Background(), "run1"), newTestLogger(), nil, execCopyLogFileName)
+	done := make(chan struct{})
+	go func() {
+		report.addError("/in/a.jpg", 1, errors.New("permission denied"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("addError waited for the error-threshold hook")
+	}
+	close(release)
+	report.finish(t.TempDir())
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const importDBFileName = "importDB.txt"
+const skippedListFileName = "skippedList.txt"
+
+// importRecord は取り込み済みファイル1件分（コピー元パス・サイズ・更新日時・内容のハッシュ -> 出力先パス）
+type importRecord struct {
+	fromPath string
+	size     int64
+	modTime  int64
+	hash     string
+	toPath   string
+}
+
+func formatImportRecord(r importRecord) string {
+	return strings.Join([]string{r.fromPath, strconv.FormatInt(r.size, 10), strconv.FormatInt(r.modTime, 10), r.hash, r.toPath}, seps) + "\n"
+}
+
+func parseImportRecord(line string) (importRecord, error) {
+	fields := strings.Split(line, seps)
+	if len(fields) != 5 {
+		return importRecord{}, fmt.Errorf("invalid import record: %s", line)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return importRecord{}, err
+	}
+	modTime, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return importRecord{}, err
+	}
+	return importRecord{fromPath: fields[0], size: size, modTime: modTime, hash: fields[3], toPath: fields[4]}, nil
+}
+
+func getImportDBFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, importDBFileName)
+}
+
+// importDB は取り込み済みファイルの一覧（追記のみで、同じコピー元は後の行が優先）
+type importDB struct {
+	byFromPath map[string]importRecord
+	// サイズ -> ハッシュの集合（ハッシュ計算はサイズが一致したものだけに絞る）
+	hashesBySize map[int64]map[string]string
+}
+
+func loadImportDB(logger *slog.Logger, rootPath string) (*importDB, error) {
+	db := &importDB{
+		byFromPath:   make(map[string]importRecord),
+		hashesBySize: make(map[int64]map[string]string),
+	}
+
+	f, err := os.Open(getImportDBFilePath(rootPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return db, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logger.Warn("failed to close importDB", "err", err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r, err := parseImportRecord(scanner.Text())
+		if err != nil {
+			logger.Warn("invalid importDB record", "err", err)
+			continue
+		}
+		db.byFromPath[r.fromPath] = r
+		if db.hashesBySize[r.size] == nil {
+			db.hashesBySize[r.size] = make(map[string]string)
+		}
+		db.hashesBySize[r.size][r.hash] = r.toPath
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// findImported は取り込み済みなら出力先パスを返す。
+// コピー元パス・サイズ・更新日時が一致するか、内容のハッシュが一致するものを取り込み済みとみなす。
+// 記録した出力先のファイルが削除されている場合は、取り込み済みとみなさずにコピーし直す。
+func (db *importDB) findImported(logger *slog.Logger, cache *hashCache, fromSt storage, toSt storage, fromPath string, fi fs.FileInfo) (string, bool) {
+	if r, ok := db.byFromPath[fromPath]; ok && r.size == fi.Size() && r.modTime == fi.ModTime().UnixNano() {
+		if existsImported(logger, toSt, fromPath, r.toPath) {
+			return r.toPath, true
+		}
+	}
+
+	hashes, ok := db.hashesBySize[fi.Size()]
+	if !ok {
+		return "", false
+	}
+	hash, err := cache.hash(fromSt, fromPath)
+	if err != nil {
+		logger.Warn("failed to hash", "src", fromPath, "err", err)
+		return "", false
+	}
+	toPath, ok := hashes[hash]
+	if !ok || !existsImported(logger, toSt, fromPath, toPath) {
+		return "", false
+	}
+	return toPath, true
+}
+
+// existsImported は取り込み済みとして記録した出力先のファイルがあるかどうかを返す
+func existsImported(logger *slog.Logger, toSt storage, fromPath string, toPath string) bool {
+	if _, err := toSt.stat(toPath); err != nil {
+		logger.Info("imported file is missing, copy again", "src", fromPath, "dst", toPath, "err", err)
+		return false
+	}
+	return true
+}
+
+// importDBWriter は execCopy の goroutine から取り込み済みファイルを追記する
+type importDBWriter struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	f      *os.File
+}
+
+func openImportDBWriter(logger *slog.Logger, rootPath string) (*importDBWriter, CloseFunc, error) {
+	f, closeFunc, err := openFile(logger, getImportDBFilePath(rootPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &importDBWriter{logger: logger, f: f}, closeFunc, nil
+}
+
+func (w *importDBWriter) record(fromSt storage, fromPath string, toPath string, hash string) {
+	if w == nil {
+		return
+	}
+
+	fi, err := fromSt.stat(fromPath)
+	if err != nil {
+		w.logger.Warn("failed to stat for importDB", "src", fromPath, "err", err)
+		return
+	}
+
+	r := importRecord{fromPath: fromPath, size: fi.Size(), modTime: fi.ModTime().UnixNano(), hash: hash, toPath: toPath}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.f.WriteString(formatImportRecord(r)); err != nil {
+		w.logger.Error("failed to write importDB", "src", fromPath, "dst", toPath, "err", err)
+	}
+}
+
+func openSkippedListFile(logger *slog.Logger, rootPath string) (*os.File, CloseFunc, error) {
+	return createFile(logger, filepath.Join(rootPath, metaDir, skippedListFileName))
+}
+
+func writeSkippedList(logger *slog.Logger, skippedList *os.File, fromPath string, toPath string) {
+	_, err := skippedList.WriteString(fmt.Sprintf("%s%s%s\n", fromPath, seps, toPath))
+	if err != nil {
+		logger.Error("failed to write skippedList", "src", fromPath, "dst", toPath, "err", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncrementalListUpSkipsImportedFiles(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fromDir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll, Incremental: true}
+	ctx := context.Background()
+	for _, op := range []func(context.Context, Config) error{listUp, createOutputDir, execCopy} {
+		if err := op(ctx, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	copied := findCopied(t, toDir, "a.jpg")
+	if copied == "" {
+		t.Fatal("a.jpg was not copied")
+	}
+
+	// 取り込み済みのファイルと、同じ内容のファイル（ハッシュが一致）はコピーしない
+	if err := os.WriteFile(filepath.Join(fromDir, "b.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := listUpEntries(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("entries = %+v, want none for imported files", entries)
+	}
+
+	// 取り込んだファイルが出力先から削除されていれば、コピーし直す
+	if err := os.Remove(copied); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = listUpEntries(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("entries = %+v, want a.jpg and b.jpg to be copied again", entries)
+	}
+}
@@ -1,130 +1,336 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	mapset "github.com/deckarep/golang-set/v2"
 	"github.com/google/uuid"
 	"io/fs"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
-	"syscall"
 	"time"
 )
 
 const copyListFileName = "copyList.txt"
 const listUpLogFileName = "listUp.log"
 
-func listUp(cfg Config) {
+const (
+	copyKindFile    = "file"
+	copyKindSymlink = "symlink"
+)
+
+// copyEntry は copyList の1行分
+type copyEntry struct {
+	fromPath string
+	toPath   string
+	label    string
+	kind     string
+	// コピー元のサイズ（copyList には書かず、listUp では走査した時の、execCopy では stat したサイズを設定する）
+	size int64
+}
+
+func formatCopyListLine(entry copyEntry) string {
+	if entry.kind == "" || entry.kind == copyKindFile {
+		return fmt.Sprintf("%s%s%s\n", entry.fromPath, seps, entry.toPath)
+	}
+	return fmt.Sprintf("%s%s%s%s%s\n", entry.fromPath, seps, entry.toPath, seps, entry.kind)
+}
+
+func parseCopyListLine(line string) copyEntry {
+	fromTo := strings.Split(line, seps)
+	entry := copyEntry{fromPath: fromTo[0], toPath: fromTo[1], kind: copyKindFile}
+	if len(fromTo) > 2 {
+		entry.kind = fromTo[2]
+	}
+	return entry
+}
+
+func listUp(ctx context.Context, cfg Config) error {
+	_, err := listUpEntries(ctx, cfg)
+	return err
+}
+
+// listUpEntries は copyList を書き出し、そのエントリ（サイズ付き）を返す（TUI は返したエントリで計画を表示する）
+func listUpEntries(ctx context.Context, cfg Config) (_ []copyEntry, err error) {
 	outputDirSet := mapset.NewSet[string]()
 
-	closeLogFile := openListUpLogFile(cfg.ToDir)
+	metaRoot := getMetaRoot(cfg)
+
+	logger, closeLogFile := openListUpLogFile(ctx, metaRoot)
 	defer closeLogFile()
 
-	copyListFile, closeCopyListFile := openCopyListFile(cfg.ToDir)
+	closeMetricsSummary := startMetricsSummary(logger, metaRoot, listUpLogFileName)
+	defer closeMetricsSummary()
+
+	report := newRunReport(ctx, logger, &cfg, listUpLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(metaRoot)
+	}()
+
+	copyListFile, closeCopyListFile, err := openCopyListFile(logger, metaRoot)
+	if err != nil {
+		return nil, err
+	}
 	defer closeCopyListFile()
 
-	createOutputExtsDirectory(cfg)
+	fromSt, closeFromSt, err := openStorage(logger, cfg.FromStorage)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFromSt()
+	// 書庫内のファイルは書庫の順に走査するので、ハッシュ等で読む時は書庫を開いたまま続けて読む
+	archiveSt := newArchiveStreamStorage(fromSt)
+	defer archiveSt.close()
+	fromSt = archiveSt
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return nil, err
+	}
+	defer closeToSt()
 
 	allTargetExts := getAllTargetExts(cfg)
 
-	if err := filepath.WalkDir(cfg.FromDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil {
-			log.Println("failed to WalkDir", err)
-			return err
-		}
+	plan := newCopyPlan(logger, getCollisionStrategy(cfg), fromSt, toSt)
 
-		fi, err := d.Info()
-		if err != nil {
-			log.Println("failed to get directory info", err)
-			return nil
+	var db *importDB
+	if cfg.Incremental {
+		if db, err = loadImportDB(logger, metaRoot); err != nil {
+			return nil, err
 		}
-
-		if fi.IsDir() {
-			return nil
+	}
+	skippedList, closeSkippedList, err := openSkippedListFile(logger, metaRoot)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSkippedList()
+	skippedCount := 0
+	counter := newNameCounter(toSt, cfg.ToDir)
+	walker := newSourceWalker(ctx, logger, getSymlinkPolicy(cfg))
+
+	for _, fromDir := range getFromDirs(cfg) {
+		logger.Info("from dir", "src", fromDir.Path, "label", fromDir.Label, "targetExts", fromDir.TargetExts, "priority", fromDir.Priority)
+
+		// 書庫に書き出す場合は出力先にディレクトリを作らない
+		if cfg.Archive == "" {
+			if err := createOutputExtsDirectory(toSt, cfg.ToDir, fromDir.TargetExts); err != nil {
+				return nil, err
+			}
 		}
 
-		if cfg.TargetExts == TargetExtsAll {
-			log.Println(path)
-			return prepare(path, fi, cfg, copyListFile, outputDirSet)
+		handleFile := func(path string, fi fs.FileInfo) {
+			if !isTargetFile(cfg, fromDir, allTargetExts, fi.Name()) {
+				logger.Debug("not target", "src", path)
+				return
+			}
+
+			if db != nil {
+				if toPath, ok := db.findImported(logger, plan.hashes, fromSt, toSt, path, fi); ok {
+					logger.Info("already imported", "src", path, "dst", toPath)
+					writeSkippedList(logger, skippedList, path, toPath)
+					skippedCount++
+					report.add(reportOutcomeSkipped, path, fi.Size())
+					return
+				}
+			}
+
+			logger.Info("listed", "src", path)
+			entry, outputDir, err := prepare(path, fi, cfg, fromDir, counter, fromSt, plan.hashes)
+			if err != nil {
+				logger.Error("failed to prepare", "src", path, "err", err)
+				report.addError(path, fi.Size(), err)
+				return
+			}
+			if isAlreadyImported(logger, entry, cfg, plan.hashes, fromSt, toSt) {
+				logger.Info("already imported", "src", path, "dst", entry.toPath)
+				report.add(reportOutcomeSkipped, path, fi.Size())
+				return
+			}
+			if plan.add(entry) {
+				outputDirSet.Add(outputDir)
+				report.add(reportOutcomeListed, path, fi.Size())
+				for _, dropped := range plan.takeReplaced() {
+					report.replaceListed(dropped.fromPath, dropped.size)
+				}
+			} else {
+				report.add(reportOutcomeSkipped, path, fi.Size())
+			}
 		}
 
-		if cfg.TargetExts == TargetExtsOthers {
-			if contains(allTargetExts, getExt(fi.Name())) {
-				log.Println("[NOT_TARGET]", fi.Name())
-				return nil
+		walkFn := func(path string, fi fs.FileInfo) error {
+			if cfg.DescendArchives && fromSt.isLocal() && fi.Mode().IsRegular() && isArchiveFile(fi.Name()) {
+				archiveEntries, err := listArchive(path)
+				if err == nil {
+					for _, archiveEntry := range archiveEntries {
+						if ctx.Err() != nil {
+							return ctx.Err()
+						}
+						handleFile(joinArchivePath(path, archiveEntry.name), archiveEntry.fi)
+					}
+					return nil
+				}
+				// 壊れた書庫等は通常のファイルとして扱う
+				logger.Warn("failed to read archive", "src", path, "err", err)
 			}
+
+			handleFile(path, fi)
+			return nil
+		}
+
+		if fromSt.isLocal() {
+			err = walker.walk(fromDir.Path, walkFn)
 		} else {
-			if !contains(getTargetExts(cfg), getExt(fi.Name())) {
-				log.Println("[NOT_TARGET]", fi.Name())
-				return nil
+			err = walkStorage(ctx, logger, fromSt, fromDir.Path, walkFn)
+		}
+		if err != nil {
+			if isCanceled(err) {
+				logger.Warn("canceled, copyList is not written", "err", err)
+				return nil, nil
 			}
+			return nil, err
 		}
+	}
+
+	if db != nil {
+		logger.Info("incremental", "toCopy", len(plan.entries), "skipped", skippedCount)
+	}
 
-		log.Println(path)
-		return prepare(path, fi, cfg, copyListFile, outputDirSet)
-	}); err != nil {
-		log.Fatal(err)
+	for _, entry := range plan.entries {
+		if _, err := copyListFile.WriteString(formatCopyListLine(entry)); err != nil {
+			return nil, fmt.Errorf("failed to write copyList: %w", err)
+		}
 	}
+	metricFilesListed.Add(float64(len(plan.entries)))
 
-	outputDirSetFile, closeOutputDirSetFile := openFile(getOutputDirSetFilePath(cfg.ToDir))
+	outputDirSetFile, closeOutputDirSetFile, err := openFile(logger, getOutputDirSetFilePath(metaRoot))
+	if err != nil {
+		return nil, err
+	}
 	defer closeOutputDirSetFile()
 
 	for _, outputDir := range outputDirSet.ToSlice() {
-		log.Println(outputDir)
+		logger.Info("output dir", "dst", outputDir)
 		_, err := outputDirSetFile.WriteString(fmt.Sprintf("%s\n", filepath.Join(cfg.ToDir, outputDir)))
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 	}
+	return plan.entries, nil
 }
 
-func prepare(fromPath string, fi fs.FileInfo, cfg Config, copyList *os.File, outputDirSet mapset.Set[string]) error {
+// isTargetFile はファイルがコピー元ディレクトリの targetExts の対象かどうかを返す
+func isTargetFile(cfg Config, fromDir FromDirConfig, allTargetExts []string, fileName string) bool {
+	switch fromDir.TargetExts {
+	case TargetExtsAll:
+		return true
+	case TargetExtsOthers:
+		return !contains(allTargetExts, getExt(fileName))
+	}
+	return contains(getTargetExts(cfg, fromDir.TargetExts), getExt(fileName))
+}
+
+func prepare(fromPath string, fi fs.FileInfo, cfg Config, fromDir FromDirConfig, counter *nameCounter, fromSt storage, hashes *hashCache) (copyEntry, string, error) {
 	outDirName := getOutputDirName(fromPath)
 	extsDir := getOutputExtsDirectoryName(getExt(fi.Name()), cfg)
-	outputDirSet.Add(filepath.Join(extsDir, outDirName))
+	outputDir := expandOutputDirTemplate(getOutputDirTemplate(cfg), extsDir, outDirName, fromDir.Label)
 
 	outFileName := ""
 	if cfg.Rename {
-		outFileName = createOutFileName(getCreatedTime(fi), uuid.NewString(), fi.Name())
+		createdTime := getCreatedTime(fromPath, fi)
+		disambiguator, err := createDisambiguator(fromPath, fi, createdTime, cfg, outputDir, counter, fromSt, hashes)
+		if err != nil {
+			return copyEntry{}, "", err
+		}
+		outFileName = createOutFileName(createdTime, disambiguator, fi.Name())
 	} else {
 		outFileName = fi.Name()
 	}
 
-	toPath := filepath.Join(cfg.ToDir, extsDir, outDirName, outFileName)
+	kind := copyKindFile
+	if fi.Mode()&fs.ModeSymlink != 0 {
+		kind = copyKindSymlink
+	}
 
-	_, err := copyList.WriteString(fmt.Sprintf("%s%s%s\n", fromPath, seps, toPath))
-	if err != nil {
-		log.Println("[[[ failed to copyList.WriteString ]]]", err)
-		return err
+	entry := copyEntry{
+		fromPath: fromPath,
+		toPath:   filepath.Join(cfg.ToDir, outputDir, outFileName),
+		label:    fromDir.Label,
+		kind:     kind,
 	}
+	if kind == copyKindFile {
+		entry.size = fi.Size()
+	}
+	return entry, outputDir, nil
+}
 
-	return nil
+// createDisambiguator は nameMode に応じてファイル名の重複回避用文字列を作る
+func createDisambiguator(fromPath string, fi fs.FileInfo, createdTime time.Time, cfg Config, outputDir string, counter *nameCounter, fromSt storage, hashes *hashCache) (string, error) {
+	switch cfg.NameMode {
+	case nameModeHash:
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(fromPath)
+			if err != nil {
+				return "", err
+			}
+			return shortHash(hashString(target)), nil
+		}
+		hash, err := hashes.hash(fromSt, fromPath)
+		if err != nil {
+			return "", err
+		}
+		return shortHash(hash), nil
+	case nameModeCounter:
+		return counter.next(hashes, fromSt, fromPath, fi, createdTime, outputDir)
+	default:
+		return uuid.NewString(), nil
+	}
 }
 
-func createOutputExtsDirectory(cfg Config) {
-	if cfg.TargetExts == TargetExtsAll {
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsDocuments))
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsImages))
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsMusics))
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsVideos))
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsOthers))
-		return
+// isAlreadyImported は出力先に同じ内容のファイルが既にあるかを判定する（nameMode=uuid では出力先が毎回変わるので判定しない）
+func isAlreadyImported(logger *slog.Logger, entry copyEntry, cfg Config, hashes *hashCache, fromSt storage, toSt storage) bool {
+	if !cfg.Rename || cfg.NameMode == "" || cfg.NameMode == nameModeUUID || entry.kind != copyKindFile {
+		return false
 	}
 
-	switch cfg.TargetExts {
-	case TargetExtsDocuments:
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsDocuments))
-	case TargetExtsImages:
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsImages))
-	case TargetExtsMusics:
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsMusics))
-	case TargetExtsVideos:
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsVideos))
+	// entry.size は走査した時のコピー元のサイズ
+	toFi, err := toSt.stat(entry.toPath)
+	if err != nil || toFi.Size() != entry.size {
+		return false
+	}
+
+	same, err := hashes.sameContent(fromSt, entry.fromPath, toSt, entry.toPath)
+	if err != nil {
+		logger.Warn("failed to compare content", "src", entry.fromPath, "dst", entry.toPath, "err", err)
+		return false
+	}
+	return same
+}
+
+// expandOutputDirTemplate は {exts} {dir} {label} を置換して出力先ディレクトリ名を作る
+func expandOutputDirTemplate(template string, extsDir string, outDirName string, label string) string {
+	r := strings.NewReplacer("{exts}", extsDir, "{dir}", outDirName, "{label}", label)
+	return filepath.Clean(r.Replace(template))
+}
+
+func createOutputExtsDirectory(toSt storage, toDir string, targetExts string) error {
+	var extsDirs []string
+	switch targetExts {
+	case TargetExtsAll:
+		extsDirs = []string{TargetExtsDocuments, TargetExtsImages, TargetExtsMusics, TargetExtsVideos, TargetExtsOthers}
+	case TargetExtsDocuments, TargetExtsImages, TargetExtsMusics, TargetExtsVideos:
+		extsDirs = []string{targetExts}
 	default:
-		createDirectory(filepath.Join(cfg.ToDir, TargetExtsOthers))
+		extsDirs = []string{TargetExtsOthers}
+	}
+
+	for _, extsDir := range extsDirs {
+		if err := toSt.mkdirAll(filepath.Join(toDir, extsDir)); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func getOutputExtsDirectoryName(ext string, cfg Config) string {
@@ -143,8 +349,8 @@ func getOutputExtsDirectoryName(ext string, cfg Config) string {
 	return TargetExtsOthers
 }
 
-func getTargetExts(cfg Config) []string {
-	switch cfg.TargetExts {
+func getTargetExts(cfg Config, targetExts string) []string {
+	switch targetExts {
 	case TargetExtsDocuments:
 		return cfg.TargetDocumentsExts
 	case TargetExtsImages:
@@ -164,19 +370,19 @@ func getAllTargetExts(cfg Config) []string {
 	return s3
 }
 
-func openListUpLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, listUpLogFileName))
+func openListUpLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, listUpLogFileName))
 }
 
-func openCopyListFile(rootPath string) (*os.File, CloseFunc) {
+func openCopyListFile(logger *slog.Logger, rootPath string) (*os.File, CloseFunc, error) {
 	copyListFilePath := getCopyListFilePath(rootPath)
 	copyListFileBackupPath := getCopyListBackupFilePath(rootPath)
 	if err := renameFile(copyListFilePath, copyListFileBackupPath); err != nil {
 		if !strings.Contains(err.Error(), "no such file or directory") {
-			log.Fatal(err)
+			return nil, nil, err
 		}
 	}
-	return openFile(copyListFilePath)
+	return openFile(logger, copyListFilePath)
 }
 
 func getOutputDirName(path string) string {
@@ -193,19 +399,13 @@ func getOutputDirName(path string) string {
 	return ret
 }
 
-func toTime(ts syscall.Timespec) time.Time {
-	return time.Unix(ts.Sec, ts.Nsec)
-}
-
-func getCreatedTime(fi fs.FileInfo) time.Time {
-	statT := fi.Sys().(*syscall.Stat_t)
-	return toTime(statT.Birthtimespec)
-}
+// outFileTimeLayout は rename したファイル名の先頭に付ける作成日時の書式
+const outFileTimeLayout = "2006-01-02T15h04m05s"
 
 func formatTime(t time.Time) string {
-	return t.Format("2006-01-02T15h04m05s")
+	return t.Format(outFileTimeLayout)
 }
 
-func createOutFileName(createdTime time.Time, uuid string, fileName string) string {
-	return fmt.Sprintf("%s_%s_%s", formatTime(createdTime), uuid, fileName)
+func createOutFileName(createdTime time.Time, disambiguator string, fileName string) string {
+	return fmt.Sprintf("%s_%s_%s", formatTime(createdTime), disambiguator, fileName)
 }
@@ -1,11 +1,177 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-func setupLog(path string) CloseFunc {
-	logFile, closeFunc := openFile(path)
-	log.SetOutput(logFile)
-	return closeFunc
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// コンソールに出すログのレベルを off にするとコンソールには出さない
+const logLevelOff = "off"
+
+const (
+	defaultLogMaxSizeMB    = 100
+	defaultLogConsoleLevel = "warn"
+)
+
+// logSettings はログの形式・レベル・ローテーションの設定（main で設定する）
+var logSettings LogConfig
+
+// logConsoleOutput はコンソールへのログの出力先（TUI のように画面を使う場合は io.Discard にする）
+var logConsoleOutput io.Writer = os.Stderr
+
+type runIDKey struct{}
+
+// withRunID はログ等に付ける実行 ID を ctx に持たせる
+func withRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+func getRunID(ctx context.Context) string {
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	return runID
+}
+
+type pipelineKey struct{}
+
+// withPipeline は daemon で実行中のパイプライン名を ctx に持たせる
+func withPipeline(ctx context.Context, pipeline string) context.Context {
+	return context.WithValue(ctx, pipelineKey{}, pipeline)
+}
+
+// getPipeline はパイプライン名を返す（パイプラインの外で実行した operation なら空）
+func getPipeline(ctx context.Context) string {
+	pipeline, _ := ctx.Value(pipelineKey{}).(string)
+	return pipeline
+}
+
+// setupLog はログファイル（ローテーションあり）とコンソールに出力する logger を返す。
+// daemon・HTTP API では複数の処理が同時に動くので、既定の logger は変えず、各処理には返した logger を渡す。
+func setupLog(ctx context.Context, path string) (*slog.Logger, CloseFunc) {
+	file := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    getLogMaxSizeMB(logSettings),
+		MaxBackups: logSettings.MaxBackups,
+		MaxAge:     logSettings.MaxAgeDays,
+	}
+
+	level, levelErr := parseLogLevel(logSettings.Level, slog.LevelInfo)
+	handlers := []slog.Handler{newLogHandler(file, logSettings.Format, level)}
+	var consoleLevelErr error
+	if consoleLevel := getLogConsoleLevel(logSettings); consoleLevel != logLevelOff && logConsoleOutput != io.Discard {
+		var level slog.Level
+		level, consoleLevelErr = parseLogLevel(consoleLevel, slog.LevelWarn)
+		handlers = append(handlers, newLogHandler(logConsoleOutput, logFormatText, level))
+	}
+
+	logger := slog.New(&multiHandler{handlers: handlers}).With("runId", getRunID(ctx), "op", getOperationName(path))
+	if err := errors.Join(levelErr, consoleLevelErr); err != nil {
+		logger.Warn("invalid log level", "err", err)
+	}
+
+	return logger, func() {
+		if err := file.Close(); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to close log file:", err)
+		}
+	}
+}
+
+// newConsoleLogger はログファイルを開く前（ロックの取得等）に使う、コンソールだけに出力する logger を返す
+func newConsoleLogger(ctx context.Context) *slog.Logger {
+	consoleLevel := getLogConsoleLevel(logSettings)
+	if consoleLevel == logLevelOff {
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	level, _ := parseLogLevel(consoleLevel, slog.LevelWarn)
+	return slog.New(newLogHandler(logConsoleOutput, logFormatText, level)).With("runId", getRunID(ctx))
+}
+
+// getOperationName はログファイル名（execCopy.log 等）から operation の名前を返す
+func getOperationName(logFileName string) string {
+	return strings.TrimSuffix(filepath.Base(logFileName), filepath.Ext(logFileName))
+}
+
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// parseLogLevel は debug / info / warn / error を slog.Level にする（未指定・不正な場合は def）
+func parseLogLevel(s string, def slog.Level) (slog.Level, error) {
+	if s == "" {
+		return def, nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return def, err
+	}
+	return level, nil
+}
+
+func getLogMaxSizeMB(cfg LogConfig) int {
+	if cfg.MaxSizeMB > 0 {
+		return cfg.MaxSizeMB
+	}
+	return defaultLogMaxSizeMB
+}
+
+func getLogConsoleLevel(cfg LogConfig) string {
+	if cfg.ConsoleLevel == "" {
+		return defaultLogConsoleLevel
+	}
+	return cfg.ConsoleLevel
+}
+
+// multiHandler はログファイルとコンソールのように複数の出力先（それぞれのレベル）に出力する
+type multiHandler struct {
+	handlers []slog.Handler
+}
+
+func (h *multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *multiHandler) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, handler := range h.handlers {
+		if handler.Enabled(ctx, r.Level) {
+			errs = append(errs, handler.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (h *multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make([]slog.Handler, 0, len(h.handlers))
+	for _, handler := range h.handlers {
+		handlers = append(handlers, handler.WithAttrs(attrs))
+	}
+	return &multiHandler{handlers: handlers}
+}
+
+func (h *multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make([]slog.Handler, 0, len(h.handlers))
+	for _, handler := range h.handlers {
+		handlers = append(handlers, handler.WithGroup(name))
+	}
+	return &multiHandler{handlers: handlers}
 }
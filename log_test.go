@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogWritesLevelsToFileAndConsole(t *testing.T) {
+	savedSettings, savedConsole := logSettings, logConsoleOutput
+	defer func() {
+		logSettings, logConsoleOutput = savedSettings, savedConsole
+	}()
+	var console bytes.Buffer
+	logSettings = LogConfig{Format: logFormatJSON, Level: "info", ConsoleLevel: "warn"}
+	logConsoleOutput = &console
+
+	path := filepath.Join(t.TempDir(), execCopyLogFileName)
+	logger, closeLogFile := setupLog(withRunID(context.Background(), "run1"), path)
+	logger.Debug("debug message")
+	logger.Info("info message", "src", "/in/a.jpg")
+	logger.Warn("warn message")
+	closeLogFile()
+
+	// ログファイルには level 以上を JSON で、実行 ID と operation 付きで書き出す
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var messages []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("log line is not JSON: %s", scanner.Text())
+		}
+		if record["runId"] != "run1" || record["op"] != getOperationName(execCopyLogFileName) {
+			t.Errorf("record = %v, want runId and op", record)
+		}
+		messages = append(messages, record["msg"].(string))
+	}
+	if strings.Join(messages, ",") != "info message,warn message" {
+		t.Errorf("file messages = %v, want info and warn", messages)
+	}
+
+	// コンソールには consoleLevel 以上だけを出す
+	if out := console.String(); !strings.Contains(out, "warn message") || strings.Contains(out, "info message") {
+		t.Errorf("console = %q, want only the warning", out)
+	}
+}
+
+func TestSetupLogConsoleOff(t *testing.T) {
+	savedSettings, savedConsole := logSettings, logConsoleOutput
+	defer func() {
+		logSettings, logConsoleOutput = savedSettings, savedConsole
+	}()
+	var console bytes.Buffer
+	logSettings = LogConfig{ConsoleLevel: logLevelOff}
+	logConsoleOutput = &console
+
+	logger, closeLogFile := setupLog(context.Background(), filepath.Join(t.TempDir(), execCopyLogFileName))
+	logger.Error("error message")
+	closeLogFile()
+	if console.Len() != 0 {
+		t.Errorf("console = %q, want nothing when consoleLevel is off", console.String())
+	}
+	newConsoleLogger(context.Background()).Error("error message")
+	if console.Len() != 0 {
+		t.Errorf("console = %q, want nothing when consoleLevel is off", console.String())
+	}
+}
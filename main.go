@@ -1,7 +1,14 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 )
 
 const (
@@ -13,59 +20,150 @@ const (
 	operationDeDuplication    = 5
 	operationRenameDir        = 6
 	operationMoveDir          = 7
+	operationUndoMove         = 8
+	operationBenchmarkCopy    = 10
+	operationWatch            = 11
+	operationDaemon           = 12
+	operationServeAPI         = 13
+	operationInteractive      = 14
 )
 
+// キャンセル（SIGINT / SIGTERM）で中断した場合の終了コード
+const exitCodeCanceled = 130
+
 func main() {
 	cfg := getConfig()
+	logSettings = cfg.Log
+	hookSettings = cfg.Hooks
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// daemon・HTTP API はパイプライン毎に実行 ID を付ける
+	ctx = withRunID(ctx, uuid.NewString())
 
-	createDirectory(filepath.Join(cfg.ToDir, metaDir))
+	// daemon・HTTP API はパイプライン毎に、TUI は operation 毎に通知し、それ以外は CLI の実行毎に1回だけ通知する
+	notifyFinished := setupNotifier(ctx, cfg.Notify, cfg.Operation != operationDaemon && cfg.Operation != operationServeAPI && cfg.Operation != operationInteractive)
+
+	if err := createDirectory(filepath.Join(getMetaRoot(cfg), metaDir)); err != nil {
+		log.Fatal(err)
+	}
+
+	// daemon・HTTP API はパイプライン毎に、watch は常駐するためロックしない
+	unlock := CloseFunc(func() {})
+	if cfg.Operation != operationDaemon && cfg.Operation != operationWatch && cfg.Operation != operationServeAPI {
+		var err error
+		if unlock, err = acquireRunLock(newConsoleLogger(ctx), getMetaRoot(cfg)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer unlock()
+
+	// operation が失敗した場合は後続の operation（operation: 9）を実行せず、ロックを解放して終了する
+	exitOnError := func(err error) {
+		if err != nil {
+			notifyFinished(err)
+			unlock()
+			log.Fatal(err)
+		}
+	}
 
 	/****************************************************************
 	 * create copy list
 	 */
 	if cfg.Operation == operationPrepare || cfg.Operation == operationAll {
-		listUp(cfg)
+		exitOnError(listUp(ctx, cfg))
 	}
 
 	/****************************************************************
 	 * create output directory
 	 */
 	if cfg.Operation == operationCreateOutDir || cfg.Operation == operationAll {
-		createOutputDir(cfg)
+		exitOnError(createOutputDir(ctx, cfg))
 	}
 
 	/****************************************************************
 	 * copy
 	 */
 	if cfg.Operation == operationCopy || cfg.Operation == operationAll {
-		execCopy(cfg.ToDir)
+		exitOnError(execCopy(ctx, cfg))
 	}
 
 	/****************************************************************
 	 * check-duplication
 	 */
 	if cfg.Operation == operationCheckDuplication {
-		checkDuplication(cfg.ToDir)
+		exitOnError(checkDuplication(ctx, cfg))
 	}
 
 	/****************************************************************
 	 * de-duplication
 	 */
 	if cfg.Operation == operationDeDuplication {
-		deDuplication(cfg.ToDir)
+		exitOnError(deDuplication(ctx, cfg))
 	}
 
 	/****************************************************************
 	 * rename-dir
 	 */
 	if cfg.Operation == operationRenameDir {
-		renameDir(cfg.ToDir)
+		exitOnError(renameDir(ctx, cfg))
 	}
 
 	/****************************************************************
 	 * move-dir
 	 */
 	if cfg.Operation == operationMoveDir {
-		moveDir(cfg.ToDir)
+		exitOnError(moveDir(ctx, cfg))
+	}
+
+	/****************************************************************
+	 * undo-move
+	 */
+	if cfg.Operation == operationUndoMove {
+		exitOnError(undoMove(ctx, cfg))
+	}
+
+	/****************************************************************
+	 * benchmark-copy
+	 */
+	if cfg.Operation == operationBenchmarkCopy {
+		exitOnError(benchmarkCopy(ctx, cfg))
+	}
+
+	/****************************************************************
+	 * watch
+	 */
+	if cfg.Operation == operationWatch {
+		exitOnError(watch(ctx, cfg))
+	}
+
+	/****************************************************************
+	 * daemon
+	 */
+	if cfg.Operation == operationDaemon {
+		daemon(ctx, cfg)
+	}
+
+	/****************************************************************
+	 * serve-api
+	 */
+	if cfg.Operation == operationServeAPI {
+		serveAPI(ctx, cfg)
+	}
+
+	/****************************************************************
+	 * interactive (TUI)
+	 */
+	if cfg.Operation == operationInteractive {
+		interactive(ctx, cfg)
+	}
+
+	notifyFinished(nil)
+
+	if ctx.Err() != nil {
+		stop()
+		unlock()
+		fmt.Fprintln(os.Stderr, "canceled:", ctx.Err())
+		os.Exit(exitCodeCanceled)
 	}
 }
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const metricsNamespace = "organiser_filene_dine"
+const metricsShutdownTimeout = 5 * time.Second
+
+// 各 operation の統計（daemon / watch では /metrics で公開し、各 operation の終了時には JSON で書き出す）
+var (
+	metricFilesListed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_listed_total",
+		Help:      "Number of files listed to copy.",
+	})
+	metricFilesCopied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_copied_total",
+		Help:      "Number of files copied (moved, linked, stored or archived).",
+	})
+	metricFilesFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_failed_total",
+		Help:      "Number of files written to errorList.txt.",
+	})
+	metricBytesCopied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_copied_total",
+		Help:      "Number of bytes of successfully copied files.",
+	})
+	metricCopyDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "copy_duration_seconds",
+		Help:      "Time taken to copy a file.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+	})
+	metricBytesHashed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_hashed_total",
+		Help:      "Number of bytes hashed for verification, incremental import and comparison.",
+	})
+	metricHashThroughput = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "hash_throughput_bytes_per_second",
+		Help:      "Hash throughput of a file.",
+		Buckets:   prometheus.ExponentialBuckets(1024*1024, 2, 12),
+	})
+	metricDuplicatesFound = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "duplicates_found_total",
+		Help:      "Number of files moved to __duplicated__ as duplicates.",
+	})
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		metricFilesListed,
+		metricFilesCopied,
+		metricFilesFailed,
+		metricBytesCopied,
+		metricCopyDuration,
+		metricBytesHashed,
+		metricHashThroughput,
+		metricDuplicatesFound,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// observeHash はハッシュを計算したバイト数と速度を記録する
+func observeHash(n int64, elapsed time.Duration) {
+	metricBytesHashed.Add(float64(n))
+	if elapsed > 0 {
+		metricHashThroughput.Observe(float64(n) / elapsed.Seconds())
+	}
+}
+
+// startMetricsServer は /metrics を公開し、ctx がキャンセルされたらサーバを止めて終了を待つ関数を返す（listen できない場合はエラーを返す）
+func startMetricsServer(ctx context.Context, logger *slog.Logger, addr string) (func(), error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("metrics listening", "url", fmt.Sprintf("http://%s/metrics", ln.Addr()))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("metrics server error", "err", err)
+		}
+	}()
+
+	return func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to shutdown metrics server", "err", err)
+		}
+		<-served
+	}, nil
+}
+
+// metricsSummary は1回の operation の間に増えた統計
+type metricsSummary struct {
+	Operation  string                      `json:"operation"`
+	StartedAt  time.Time                   `json:"startedAt"`
+	EndedAt    time.Time                   `json:"endedAt"`
+	Counters   map[string]float64          `json:"counters"`
+	Histograms map[string]histogramSummary `json:"histograms"`
+}
+
+// histogramSummary はヒストグラムの件数・合計と、上限（le）毎の累積件数
+type histogramSummary struct {
+	Count   uint64          `json:"count"`
+	Sum     float64         `json:"sum"`
+	Buckets []bucketSummary `json:"buckets"`
+}
+
+type bucketSummary struct {
+	LE    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+// startMetricsSummary は開始時点の統計を控え、終了時に増えた分をログファイルと同じ名前の .metrics.json に書き出す関数を返す
+func startMetricsSummary(logger *slog.Logger, rootPath string, logFileName string) CloseFunc {
+	name := getOperationName(logFileName)
+	startedAt := time.Now()
+	before, err := gatherMetricsSummary()
+	if err != nil {
+		logger.Warn("failed to gather metrics", "err", err)
+	}
+
+	return func() {
+		after, err := gatherMetricsSummary()
+		if err != nil {
+			logger.Warn("failed to gather metrics", "err", err)
+		}
+		summary := metricsSummary{
+			Operation:  name,
+			StartedAt:  startedAt,
+			EndedAt:    time.Now(),
+			Counters:   make(map[string]float64),
+			Histograms: make(map[string]histogramSummary),
+		}
+		for key, value := range after.Counters {
+			summary.Counters[key] = value - before.Counters[key]
+		}
+		for key, h := range after.Histograms {
+			prev := before.Histograms[key]
+			diff := histogramSummary{Count: h.Count - prev.Count, Sum: h.Sum - prev.Sum}
+			for i, b := range h.Buckets {
+				if i < len(prev.Buckets) {
+					b.Count -= prev.Buckets[i].Count
+				}
+				diff.Buckets = append(diff.Buckets, b)
+			}
+			summary.Histograms[key] = diff
+		}
+		if err := writeMetricsSummary(filepath.Join(rootPath, metaDir, name+".metrics.json"), summary); err != nil {
+			logger.Error("failed to write metrics summary", "err", err)
+		}
+	}
+}
+
+// gatherMetricsSummary は現時点の統計（この処理のものだけ）を返す
+func gatherMetricsSummary() (metricsSummary, error) {
+	summary := metricsSummary{Counters: make(map[string]float64), Histograms: make(map[string]histogramSummary)}
+
+	families, err := metricsRegistry.Gather()
+	if err != nil {
+		return summary, err
+	}
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, metricsNamespace+"_") || len(family.GetMetric()) == 0 {
+			continue
+		}
+		name = strings.TrimPrefix(name, metricsNamespace+"_")
+
+		m := family.GetMetric()[0]
+		switch {
+		case m.GetCounter() != nil:
+			summary.Counters[name] = m.GetCounter().GetValue()
+		case m.GetHistogram() != nil:
+			h := histogramSummary{Count: m.GetHistogram().GetSampleCount(), Sum: m.GetHistogram().GetSampleSum()}
+			for _, b := range m.GetHistogram().GetBucket() {
+				h.Buckets = append(h.Buckets, bucketSummary{LE: b.GetUpperBound(), Count: b.GetCumulativeCount()})
+			}
+			summary.Histograms[name] = h
+		}
+	}
+	return summary, nil
+}
+
+func writeMetricsSummary(path string, summary metricsSummary) error {
+	b, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMetricsSummaryCountsOnlyThisOperation(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := os.WriteFile(filepath.Join(fromDir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 前の operation で増えた分は、この operation の統計に含めない
+	metricFilesListed.Add(10)
+	if err := listUp(context.Background(), Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(toDir, metaDir, getOperationName(listUpLogFileName)+".metrics.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var summary metricsSummary
+	if err := json.Unmarshal(b, &summary); err != nil {
+		t.Fatal(err)
+	}
+	if got := summary.Counters["files_listed_total"]; got != 2 {
+		t.Errorf("files_listed_total = %v, want 2", got)
+	}
+}
+
+func TestMetricsServerServesMetrics(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waitMetrics, err := startMetricsServer(ctx, newTestLogger(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cancel()
+		waitMetrics()
+	}()
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), metricsNamespace+"_files_copied_total") {
+		t.Errorf("GET /metrics = %s:\n%s", resp.Status, body)
+	}
+}
@@ -1,30 +1,49 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"io/fs"
+	"log/slog"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 const moveDirLogFileName = "moveDir.log"
 
-func moveDir(toDir string) {
-	closeLogFile := openMoveDirLogFile(toDir)
+func moveDir(ctx context.Context, cfg Config) (err error) {
+	toDir := cfg.ToDir
+
+	logger, closeLogFile := openMoveDirLogFile(ctx, getMetaRoot(cfg))
 	defer closeLogFile()
 
-	log.Printf("START: %s\n", time.Now().Format(time.RFC3339))
-	bytesFilePathMap := make(map[string][]oldNewPath)
-	if err := filepath.WalkDir(toDir, func(path string, d os.DirEntry, err error) error {
+	report := newRunReport(ctx, logger, nil, moveDirLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(getMetaRoot(cfg))
+	}()
+
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	logger.Info("START")
+	// 走査中に移動すると一覧が変わるので、対象のファイルを全て集めてから移動する
+	var files []walkedFile
+	if err := toSt.walkDir(toDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Println("failed to WalkDir", err)
+			logger.Warn("failed to walk", "path", path, "err", err)
 			return nil
 		}
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		fi, err := d.Info()
 		if err != nil {
-			log.Println("failed to get directory info", err)
+			logger.Warn("failed to get file info", "path", path, "err", err)
 			return nil
 		}
 
@@ -37,37 +56,45 @@ func moveDir(toDir string) {
 		}
 
 		dir, file := filepath.Split(path)
-		log.Println(dir)
-		log.Println(file)
 
 		if file == ".DS_Store" {
 			return nil
 		}
 
-		if strings.Contains(dir, ".organiser-filene-dine") {
+		if strings.Contains(dir, metaDir) {
 			return nil
 		}
 
-		from := path
-		to := filepath.Join(toDir, file)
-
-		if err := renameFile(from, to); err != nil {
-			log.Fatal(err)
-		}
-
+		files = append(files, walkedFile{path: path, size: fi.Size()})
 		return nil
 	}); err != nil {
-		log.Fatal(err)
+		if isCanceled(err) {
+			logger.Warn("canceled", "err", err)
+			return nil
+		}
+		return err
 	}
 
-	for _, oldNewPaths := range bytesFilePathMap {
-		for _, oldNewPath := range oldNewPaths {
-			log.Printf("[oldPath:%s] [newPath:%s]\n", oldNewPath.oldPath, oldNewPath.newPath)
+	for _, file := range files {
+		if ctx.Err() != nil {
+			logger.Warn("canceled", "err", ctx.Err())
+			return nil
+		}
+
+		from := file.path
+		to := filepath.Join(toDir, filepath.Base(file.path))
+
+		if err := toSt.rename(from, to); err != nil {
+			return err
 		}
+		logger.Info("moved", "src", from, "dst", to)
+		report.add(reportOutcomeMoved, from, file.size)
 	}
-	log.Printf("END  : %s\n", time.Now().Format(time.RFC3339))
+
+	logger.Info("END")
+	return nil
 }
 
-func openMoveDirLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, moveDirLogFileName))
+func openMoveDirLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, moveDirLogFileName))
 }
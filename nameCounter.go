@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nameCounter は nameMode=counter の連番を出力先ディレクトリ毎に振る。
+// 連番は出力先に既にあるファイルの続きから振るので、実行の度に 1 から振り直して既存のファイルとぶつかることはない。
+// 作成日時・ファイル名・内容が同じファイルが既にあれば、その連番を使う（isAlreadyImported で取り込み済みになる）。
+type nameCounter struct {
+	toSt  storage
+	toDir string
+	// 出力先ディレクトリ -> 連番
+	dirs map[string]*counterDir
+}
+
+// counterDir は出力先ディレクトリ1つ分の連番
+type counterDir struct {
+	last int
+	// 作成日時_ファイル名 -> 出力先に既にある連番付きのファイル名
+	existing map[string][]string
+}
+
+func newNameCounter(toSt storage, toDir string) *nameCounter {
+	return &nameCounter{toSt: toSt, toDir: toDir, dirs: make(map[string]*counterDir)}
+}
+
+// next はコピー元のファイルに振る連番を返す
+func (c *nameCounter) next(hashes *hashCache, fromSt storage, fromPath string, fi fs.FileInfo, createdTime time.Time, outputDir string) (string, error) {
+	dir, err := c.loadDir(outputDir)
+	if err != nil {
+		return "", err
+	}
+
+	if fi.Mode().IsRegular() {
+		for _, name := range dir.existing[formatTime(createdTime)+"_"+fi.Name()] {
+			toPath := filepath.Join(c.toDir, outputDir, name)
+			if toFi, err := c.toSt.stat(toPath); err != nil || toFi.Size() != fi.Size() {
+				continue
+			}
+			if same, err := hashes.sameContent(fromSt, fromPath, c.toSt, toPath); err == nil && same {
+				counter, _, _ := parseCounterFileName(name)
+				return counter, nil
+			}
+		}
+	}
+
+	dir.last++
+	return fmt.Sprintf("%06d", dir.last), nil
+}
+
+// loadDir は出力先ディレクトリにある連番付きのファイルを読み込む（ディレクトリ毎に1回だけ）
+func (c *nameCounter) loadDir(outputDir string) (*counterDir, error) {
+	if dir, ok := c.dirs[outputDir]; ok {
+		return dir, nil
+	}
+
+	dir := &counterDir{existing: make(map[string][]string)}
+	root := filepath.Join(c.toDir, outputDir)
+	if _, err := c.toSt.stat(root); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		c.dirs[outputDir] = dir
+		return dir, nil
+	}
+
+	if err := c.toSt.walkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != root {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		counter, key, ok := parseCounterFileName(d.Name())
+		if !ok {
+			return nil
+		}
+		n, err := strconv.Atoi(counter)
+		if err != nil {
+			return nil
+		}
+		dir.last = max(dir.last, n)
+		dir.existing[key] = append(dir.existing[key], d.Name())
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read counters in %s: %w", root, err)
+	}
+
+	c.dirs[outputDir] = dir
+	return dir, nil
+}
+
+// parseCounterFileName は createOutFileName で作った名前から連番と「作成日時_ファイル名」を取り出す
+func parseCounterFileName(name string) (counter string, key string, ok bool) {
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) != 3 || len(parts[1]) < 6 {
+		return "", "", false
+	}
+	if _, err := time.Parse(outFileTimeLayout, parts[0]); err != nil {
+		return "", "", false
+	}
+	for _, r := range parts[1] {
+		if r < '0' || r > '9' {
+			return "", "", false
+		}
+	}
+	return parts[1], parts[0] + "_" + parts[2], true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openCountingStorage は open した回数をパス毎に数える
+type openCountingStorage struct {
+	localStorage
+	opens map[string]int
+}
+
+func (s *openCountingStorage) open(path string) (io.ReadCloser, error) {
+	s.opens[path]++
+	return s.localStorage.open(path)
+}
+
+func TestNameCounterContinuesFromExistingFiles(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	fromPath := filepath.Join(fromDir, "a.jpg")
+	if err := os.WriteFile(fromPath, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fromPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createdTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.Local)
+
+	// 前回の実行で振った連番（同じ作成日時・ファイル名だが内容が違う）
+	if err := os.MkdirAll(filepath.Join(toDir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	existing := createOutFileName(createdTime, "000007", "a.jpg")
+	if err := os.WriteFile(filepath.Join(toDir, "images", existing), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := newNameCounter(localStorage{}, toDir)
+	for _, want := range []string{"000008", "000009"} {
+		got, err := counter.next(newHashCache(), localStorage{}, fromPath, fi, createdTime, "images")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("counter = %s, want %s", got, want)
+		}
+	}
+	if got, err := counter.next(newHashCache(), localStorage{}, fromPath, fi, createdTime, "videos"); err != nil || got != "000001" {
+		t.Errorf("counter in a new dir = %s, %v, want 000001", got, err)
+	}
+
+	// 同じ内容のファイルが既にあれば、その連番を使う
+	if err := os.WriteFile(filepath.Join(toDir, "images", existing), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	counter = newNameCounter(localStorage{}, toDir)
+	if got, err := counter.next(newHashCache(), localStorage{}, fromPath, fi, createdTime, "images"); err != nil || got != "000007" {
+		t.Errorf("counter = %s, %v, want the imported 000007", got, err)
+	}
+}
+
+func TestHashModeHashesSourceOnce(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	fromPath := filepath.Join(fromDir, "a.jpg")
+	if err := os.WriteFile(fromPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(fromPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ToDir: toDir, Rename: true, NameMode: nameModeHash}
+
+	entry, _, err := prepare(fromPath, fi, cfg, FromDirConfig{}, newNameCounter(localStorage{}, toDir), localStorage{}, newHashCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(entry.toPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(entry.toPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fromSt := &openCountingStorage{opens: make(map[string]int)}
+	hashes := newHashCache()
+	entry, _, err = prepare(fromPath, fi, cfg, FromDirConfig{}, newNameCounter(localStorage{}, toDir), fromSt, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isAlreadyImported(newTestLogger(), entry, cfg, hashes, fromSt, localStorage{}) {
+		t.Errorf("%s must be already imported", entry.toPath)
+	}
+	if n := fromSt.opens[fromPath]; n != 1 {
+		t.Errorf("source was read %d times, want once", n)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const notifyTimeout = 10 * time.Second
+const notifySyslogTag = "organiser-filene-dine"
+
+// notifier は実行の終了時とエラーが閾値に達した時に、JSON のサマリを Webhook に POST し、syslog（journald）に書き出す。
+// daemon のパイプラインはパイプラインの実行毎（pipeline-finished）に、CLI は実行毎（operation: 9 は3つの operation をまとめて）に、
+// それ以外（TUI 等）は operation 毎（run-finished）に通知する。
+type notifier struct {
+	cfg    NotifyConfig
+	client *http.Client
+	// batch の場合は operation の run-finished を通知せずに溜め、notifyBatch でまとめて通知する
+	batch   bool
+	mu      sync.Mutex
+	reports []*runReport
+}
+
+// setupNotifier は通知先が設定されていれば run-finished / pipeline-finished / error-threshold のフックとして登録する。
+// batch なら CLI の実行の終了時に、返した関数を operation が返したエラー（無ければ nil）で呼び出して1回だけ通知する。
+func setupNotifier(ctx context.Context, cfg NotifyConfig, batch bool) func(err error) {
+	reportErrorThreshold = cfg.ErrorThreshold
+	if cfg.WebhookURL == "" && !cfg.Syslog {
+		return func(error) {}
+	}
+	n := &notifier{cfg: cfg, client: &http.Client{Timeout: notifyTimeout}, batch: batch}
+	registerHook(n, hookEventRunFinished, hookEventPipelineFinished, hookEventErrorThreshold)
+	if !batch {
+		return func(error) {}
+	}
+	runID := getRunID(ctx)
+	return func(err error) {
+		n.notifyBatch(runID, err)
+	}
+}
+
+func (n *notifier) handle(ctx context.Context, event hookEvent) error {
+	// パイプラインの中の operation は pipeline-finished でまとめて通知する
+	if event.Event == hookEventRunFinished && event.Pipeline != "" {
+		return nil
+	}
+	if event.Event == hookEventRunFinished && event.Report != nil && n.batch {
+		n.mu.Lock()
+		n.reports = append(n.reports, event.Report)
+		n.mu.Unlock()
+		return nil
+	}
+	failed := isNotifyFailure(event)
+	if event.Event != hookEventErrorThreshold && n.cfg.OnlyOnFailure && !failed {
+		return nil
+	}
+
+	var errs []error
+	if n.cfg.WebhookURL != "" {
+		errs = append(errs, n.postWebhook(ctx, event))
+	}
+	if n.cfg.Syslog {
+		errs = append(errs, writeSyslog(formatNotifyMessage(event), failed))
+	}
+	return errors.Join(errs...)
+}
+
+// notifyBatch は溜めた operation のサマリと、operation が返したエラーをまとめた実行結果を1回だけ通知する
+func (n *notifier) notifyBatch(runID string, err error) {
+	n.mu.Lock()
+	reports := n.reports
+	n.reports = nil
+	n.mu.Unlock()
+	if len(reports) == 0 && err == nil {
+		return
+	}
+
+	r := runRecord{RunID: runID, StartedAt: time.Now(), EndedAt: time.Now(), Outcome: runOutcomeSuccess}
+	for i, report := range reports {
+		if i == 0 {
+			r.StartedAt = report.StartedAt
+		}
+		r.EndedAt = report.EndedAt
+		r.Steps = append(r.Steps, report.Operation)
+		r.ErrorCount += report.Outcomes[reportOutcomeFailed].Files
+		if runOutcomeSeverity[report.Outcome] > runOutcomeSeverity[r.Outcome] {
+			r.Outcome = report.Outcome
+		}
+		if report.Error != "" {
+			r.Message = fmt.Sprintf("%s: %s", report.Operation, report.Error)
+		}
+	}
+	// サマリを作る前に失敗した場合も失敗として通知する
+	if err != nil {
+		r.Outcome = runOutcomeFailed
+		if r.Message == "" {
+			r.Message = err.Error()
+		}
+	}
+
+	// 中断した場合も通知するよう、新しい ctx で通知する
+	ctx := withRunID(context.Background(), runID)
+	if err := n.handle(ctx, hookEvent{Event: hookEventRunFinished, RunID: runID, Time: time.Now(), Run: &r}); err != nil {
+		newConsoleLogger(ctx).Warn("hook failed", "event", hookEventRunFinished, "err", err)
+	}
+}
+
+// runOutcomeSeverity は複数の operation の結果をまとめる時の順位（大きい方を実行の結果にする）
+var runOutcomeSeverity = map[string]int{
+	runOutcomeSuccess:  0,
+	runOutcomeErrors:   1,
+	runOutcomeCanceled: 2,
+	runOutcomeFailed:   3,
+}
+
+func (n *notifier) postWebhook(ctx context.Context, event hookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.cfg.WebhookURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to post webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// writeSyslog はローカルの syslog（systemd の環境では journald が受け取る）に書き出す
+func writeSyslog(message string, failed bool) error {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, notifySyslogTag)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	defer w.Close()
+	if failed {
+		return w.Err(message)
+	}
+	return w.Info(message)
+}
+
+// isNotifyFailure は失敗として通知するイベントか（パイプライン・CLI の実行・operation の結果が成功以外の場合）を返す
+func isNotifyFailure(event hookEvent) bool {
+	switch {
+	case event.Run != nil:
+		return event.Run.Outcome != runOutcomeSuccess
+	case event.Report != nil:
+		return event.Report.Outcome != runOutcomeSuccess
+	}
+	return event.Failed > 0
+}
+
+func formatNotifyMessage(event hookEvent) string {
+	switch event.Event {
+	case hookEventErrorThreshold:
+		return fmt.Sprintf("%s: %d files failed (run %s), last: %s: %s", event.Operation, event.Failed, event.RunID, event.Src, event.Error)
+	case hookEventPipelineFinished, hookEventRunFinished:
+		r := event.Run
+		if r == nil {
+			break
+		}
+		name := "pipeline " + r.Pipeline
+		if r.Pipeline == "" {
+			name = strings.Join(r.Steps, ", ")
+		}
+		message := fmt.Sprintf("%s %s in %s (run %s): %d errors", name, r.Outcome, r.EndedAt.Sub(r.StartedAt).Round(time.Millisecond), r.RunID, r.ErrorCount)
+		if r.Message != "" {
+			message += ": " + r.Message
+		}
+		return message
+	}
+	r := event.Report
+	message := fmt.Sprintf("%s %s in %s (run %s): %d files, %d failed", r.Operation, r.Outcome, time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond), r.RunID, countReportFiles(r), r.Outcomes[reportOutcomeFailed].Files)
+	if r.Error != "" {
+		message += ": " + r.Error
+	}
+	return message
+}
+
+// countReportFiles は失敗以外の結果のファイル数を返す
+func countReportFiles(r *runReport) int {
+	files := 0
+	for outcome, c := range r.Outcomes {
+		if outcome != reportOutcomeFailed {
+			files += c.Files
+		}
+	}
+	return files
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// webhookRecorder は Webhook に POST されたイベントを記録する
+type webhookRecorder struct {
+	mu     sync.Mutex
+	events []hookEvent
+	status int
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var event hookEvent
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.events = append(rec.events, event)
+	if rec.status != 0 {
+		w.WriteHeader(rec.status)
+	}
+}
+
+func (rec *webhookRecorder) getEvents() []hookEvent {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]hookEvent(nil), rec.events...)
+}
+
+// setupTestNotifier は Webhook を受け取るサーバーを起動して通知先に登録する（テストの終了時に元に戻す）
+func setupTestNotifier(t *testing.T, cfg NotifyConfig) *webhookRecorder {
+	rec, _ := setupTestBatchNotifier(t, cfg, false)
+	return rec
+}
+
+// setupTestBatchNotifier は batch なら CLI の実行毎に通知する関数も返す
+func setupTestBatchNotifier(t *testing.T, cfg NotifyConfig, batch bool) (*webhookRecorder, func(error)) {
+	t.Helper()
+	rec := &webhookRecorder{}
+	server := httptest.NewServer(rec)
+
+	savedHooks, savedThreshold := registeredHooks, reportErrorThreshold
+	t.Cleanup(func() {
+		server.Close()
+		registeredHooks, reportErrorThreshold = savedHooks, savedThreshold
+	})
+
+	cfg.WebhookURL = server.URL
+	notifyFinished := setupNotifier(withRunID(context.Background(), "run1"), cfg, batch)
+	return rec, notifyFinished
+}
+
+func TestPostWebhook(t *testing.T) {
+	rec := &webhookRecorder{}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	n := &notifier{cfg: NotifyConfig{WebhookURL: server.URL}, client: server.Client()}
+
+	event := hookEvent{Event: hookEventPipelineFinished, RunID: "run1", Pipeline: "nightly", Run: &runRecord{RunID: "run1", Pipeline: "nightly", Outcome: runOutcomeErrors, ErrorCount: 3}}
+	if err := n.postWebhook(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	events := rec.getEvents()
+	if len(events) != 1 || events[0].Run == nil || events[0].Run.Outcome != runOutcomeErrors || events[0].Run.ErrorCount != 3 {
+		t.Errorf("posted = %+v, want the pipeline run", events)
+	}
+
+	rec.status = http.StatusInternalServerError
+	if err := n.postWebhook(context.Background(), event); err == nil {
+		t.Error("non-2xx response must be an error")
+	}
+}
+
+func TestNotifyOncePerPipelineRun(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+	rec := setupTestNotifier(t, NotifyConfig{})
+
+	toDir := t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ToDir: toDir}
+	// どちらのステップも run-finished を出すが、通知はパイプラインの実行毎に1回
+	p := PipelineConfig{Name: "nightly", Steps: []string{stepCheckDup, stepMoveDir}}
+
+	runPipeline(context.Background(), newTestLogger(), cfg, "run1", p)
+	events := rec.getEvents()
+	if len(events) != 1 || events[0].Event != hookEventPipelineFinished || events[0].Run.Outcome != runOutcomeSuccess {
+		t.Fatalf("posted = %+v, want one pipeline-finished", events)
+	}
+
+	// 別の実行がロックを持っている場合も、skipped として通知する
+	unlock, err := acquireRunLock(newTestLogger(), toDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	runPipeline(context.Background(), newTestLogger(), cfg, "run2", p)
+	events = rec.getEvents()
+	if len(events) != 2 || events[1].RunID != "run2" || events[1].Run.Outcome != runOutcomeSkipped {
+		t.Errorf("posted = %+v, want a skipped run2", events)
+	}
+}
+
+func TestNotifyOnlyOnFailureSkipsSuccessfulPipeline(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+	rec := setupTestNotifier(t, NotifyConfig{OnlyOnFailure: true})
+
+	toDir := t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ToDir: toDir}
+
+	runPipeline(context.Background(), newTestLogger(), cfg, "run1", PipelineConfig{Name: "nightly", Steps: []string{stepCheckDup}})
+	if events := rec.getEvents(); len(events) != 0 {
+		t.Errorf("posted = %+v, want nothing for a successful run", events)
+	}
+
+	// copyList.txt が無いので copy のステップは失敗する
+	runPipeline(context.Background(), newTestLogger(), cfg, "run2", PipelineConfig{Name: "nightly", Steps: []string{stepCopy}})
+	if events := rec.getEvents(); len(events) != 1 || events[0].Run.Outcome != runOutcomeFailed {
+		t.Errorf("posted = %+v, want the failed run", events)
+	}
+}
+
+func TestNotifyErrorThreshold(t *testing.T) {
+	rec := setupTestNotifier(t, NotifyConfig{ErrorThreshold: 2})
+
+	report := newRunReport(withRunID(context.Background(), "run1"), newTestLogger(), nil, execCopyLogFileName)
+	for _, path := range []string{"/in/a.jpg", "/in/b.jpg", "/in/c.jpg"} {
+		report.addError(path, 10, errors.New("permission denied"))
+	}
+	// 閾値のフックはコピーを止めないよう別の goroutine で呼び出し、finish で終わるのを待つ
+	reportOutput = io.Discard
+	report.finish(t.TempDir())
+
+	var events []hookEvent
+	for _, e := range rec.getEvents() {
+		if e.Event == hookEventErrorThreshold {
+			events = append(events, e)
+		}
+	}
+	if len(events) != 1 {
+		t.Fatalf("posted = %+v, want one error-threshold", events)
+	}
+	if e := events[0]; e.Event != hookEventErrorThreshold || e.Failed != 2 || e.Src != "/in/b.jpg" || e.RunID != "run1" {
+		t.Errorf("event = %+v, want the 2nd failure of run1", e)
+	}
+}
+
+func TestNotifyOncePerCLIRun(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+	rec, notifyFinished := setupTestBatchNotifier(t, NotifyConfig{}, true)
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fromDir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll}
+	ctx := withRunID(context.Background(), "run1")
+
+	// operation: 9 の3つの operation は、まとめて1回だけ通知する
+	for _, op := range []func(context.Context, Config) error{listUp, createOutputDir, execCopy} {
+		if err := op(ctx, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifyFinished(nil)
+	events := rec.getEvents()
+	if len(events) != 1 || events[0].Run == nil || events[0].Run.Outcome != runOutcomeSuccess || len(events[0].Run.Steps) != 3 {
+		t.Fatalf("posted = %+v, want one run-finished for the 3 operations", events)
+	}
+}
+
+func TestNotifyOnlyOnFailureReportsAbortedOperation(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+	rec, notifyFinished := setupTestBatchNotifier(t, NotifyConfig{OnlyOnFailure: true}, true)
+
+	toDir := t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	// copyList.txt が無いので、失敗したファイルは無いまま copy がエラーを返す
+	err := execCopy(withRunID(context.Background(), "run1"), Config{ToDir: toDir})
+	if err == nil {
+		t.Fatal("copy without copyList must fail")
+	}
+	notifyFinished(err)
+	events := rec.getEvents()
+	if len(events) != 1 || events[0].Run == nil || events[0].Run.Outcome != runOutcomeFailed || events[0].Run.Message == "" {
+		t.Errorf("posted = %+v, want the failed run with its error", events)
+	}
+}
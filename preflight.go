@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const notFitListFileName = "notFitList.txt"
+
+// destinationFS は出力先ファイルシステム1つ分の必要容量と空き容量
+type destinationFS struct {
+	// statfs に渡すパス（そのファイルシステム上に存在するディレクトリ）
+	path     string
+	required int64
+	free     int64
+	margin   int64
+}
+
+// preflight は copyList の合計サイズを出力先のファイルシステム毎に集計し、空き容量（安全マージン込み）に収まるかを確認する。
+// サイズは sumCopySize が fromSt から設定した entry.size を使う（リモートのコピー元も含めて確認する）。
+// 収まらないエントリは notFitList.txt に書き出し、allowPartialCopy が true なら収まるエントリだけを返す。
+// 収まらない場合で allowPartialCopy が false なら ok=false を返し、コピーは開始しない。
+func preflight(logger *slog.Logger, cfg Config, fromSt storage, entries []copyEntry) ([]copyEntry, bool) {
+	filesystems := make(map[uint64]*destinationFS)
+	var fits []copyEntry
+	var notFits []copyEntry
+
+	for _, entry := range entries {
+		if entry.kind != copyKindFile {
+			fits = append(fits, entry)
+			continue
+		}
+		toPath := entry.toPath
+		if cfg.Archive != "" {
+			// 書庫に書き込む場合は書庫のファイルシステムに（圧縮前のサイズで）収まるかを確認する
+			toPath = cfg.Archive
+		}
+		toDev := getDeviceID(toPath)
+		// 同じファイルシステム上の移動は rename なので容量を使わない
+		if cfg.Move && fromSt.isLocal() && getDeviceID(entry.fromPath) == toDev {
+			fits = append(fits, entry)
+			continue
+		}
+
+		dfs, ok := filesystems[toDev]
+		if !ok {
+			var err error
+			dfs, err = newDestinationFS(existingDir(toPath), cfg.FreeSpaceMarginPercent)
+			if err != nil {
+				logger.Warn("failed to statfs", "dst", toPath, "err", err)
+				fits = append(fits, entry)
+				continue
+			}
+			filesystems[toDev] = dfs
+		}
+
+		if dfs.required+entry.size > dfs.free-dfs.margin {
+			notFits = append(notFits, entry)
+			continue
+		}
+		dfs.required += entry.size
+		fits = append(fits, entry)
+	}
+
+	for _, dfs := range filesystems {
+		logger.Info("preflight", "dst", dfs.path, "required", formatBytes(dfs.required), "free", formatBytes(dfs.free), "margin", formatBytes(dfs.margin))
+	}
+
+	if len(notFits) == 0 {
+		return entries, true
+	}
+
+	metaRoot := getMetaRoot(cfg)
+	writeNotFitList(logger, metaRoot, notFits)
+	logger.Warn("files would not fit", "files", len(notFits), "notFitList", notFitListFileName)
+	fmt.Fprintf(os.Stderr, "insufficient free space: %d files would not fit (see %s)\n", len(notFits), filepath.Join(metaRoot, metaDir, notFitListFileName))
+
+	if !cfg.AllowPartialCopy {
+		return nil, false
+	}
+	return fits, true
+}
+
+func newDestinationFS(path string, marginPercent float64) (*destinationFS, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	total := int64(uint64(st.Blocks) * uint64(st.Bsize))
+	return &destinationFS{
+		path:   path,
+		free:   int64(uint64(st.Bavail) * uint64(st.Bsize)),
+		margin: int64(float64(total) * marginPercent / 100),
+	}, nil
+}
+
+// existingDir は path の親ディレクトリのうち存在するものを返す
+func existingDir(path string) string {
+	dir := filepath.Dir(path)
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+func writeNotFitList(logger *slog.Logger, rootPath string, entries []copyEntry) {
+	notFitList, closeNotFitList, err := createFile(logger, filepath.Join(rootPath, metaDir, notFitListFileName))
+	if err != nil {
+		logger.Error("failed to create notFitList", "err", err)
+		return
+	}
+	defer closeNotFitList()
+
+	for _, entry := range entries {
+		if _, err := notFitList.WriteString(formatCopyListLine(entry)); err != nil {
+			logger.Error("failed to write notFitList", "src", entry.fromPath, "err", err)
+		}
+	}
+}
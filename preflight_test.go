@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// remoteTestStorage は SFTP・S3 の代わりに、ローカルには無いパスのサイズを返すコピー元
+type remoteTestStorage struct {
+	localStorage
+	sizes map[string]int64
+}
+
+func (s remoteTestStorage) stat(path string) (fs.FileInfo, error) {
+	size, ok := s.sizes[path]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return testFileInfo{name: filepath.Base(path), size: size}, nil
+}
+
+func (remoteTestStorage) isLocal() bool {
+	return false
+}
+
+type testFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi testFileInfo) Name() string       { return fi.name }
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) Mode() fs.FileMode  { return 0644 }
+func (fi testFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi testFileInfo) IsDir() bool        { return false }
+func (fi testFileInfo) Sys() any           { return nil }
+
+// setupTestPreflight は metaRoot を出力先とは別にした設定を返す
+func setupTestPreflight(t *testing.T) Config {
+	t.Helper()
+	metaRoot := t.TempDir()
+	if err := createDirectory(filepath.Join(metaRoot, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	return Config{ToDir: t.TempDir(), MetaRoot: metaRoot}
+}
+
+func TestPreflightUsesSourceStorageSize(t *testing.T) {
+	cfg := setupTestPreflight(t)
+	fromSt := remoteTestStorage{sizes: map[string]int64{"/remote/huge.mov": 1 << 62}}
+	entries := []copyEntry{{fromPath: "/remote/huge.mov", toPath: filepath.Join(cfg.ToDir, "huge.mov"), kind: copyKindFile}}
+
+	sumCopySize(fromSt, entries)
+	if _, ok := preflight(newTestLogger(), cfg, fromSt, entries); ok {
+		t.Fatal("a remote file larger than the free space must not fit")
+	}
+	b, err := os.ReadFile(filepath.Join(cfg.MetaRoot, metaDir, notFitListFileName))
+	if err != nil {
+		t.Fatalf("notFitList must be written under metaRoot: %v", err)
+	}
+	if string(b) != formatCopyListLine(entries[0]) {
+		t.Errorf("notFitList = %q", b)
+	}
+}
+
+func TestPreflightSplitsEntriesThatDoNotFit(t *testing.T) {
+	cfg := setupTestPreflight(t)
+	small := copyEntry{fromPath: "/in/a.jpg", toPath: filepath.Join(cfg.ToDir, "a.jpg"), kind: copyKindFile, size: 1}
+	huge := copyEntry{fromPath: "/in/huge.mov", toPath: filepath.Join(cfg.ToDir, "huge.mov"), kind: copyKindFile, size: 1 << 62}
+	small2 := copyEntry{fromPath: "/in/b.jpg", toPath: filepath.Join(cfg.ToDir, "b.jpg"), kind: copyKindFile, size: 1}
+	entries := []copyEntry{small, huge, small2}
+
+	// 収まらないエントリがあれば、コピーを開始しない
+	if fits, ok := preflight(newTestLogger(), cfg, localStorage{}, entries); ok || fits != nil {
+		t.Errorf("fits = %+v, ok = %v, want no copy", fits, ok)
+	}
+
+	// allowPartialCopy なら収まるエントリだけをコピーし、収まらないエントリは notFitList に書き出す
+	cfg.AllowPartialCopy = true
+	fits, ok := preflight(newTestLogger(), cfg, localStorage{}, entries)
+	if !ok || len(fits) != 2 || fits[0] != small || fits[1] != small2 {
+		t.Errorf("fits = %+v, ok = %v, want a.jpg and b.jpg", fits, ok)
+	}
+	b, err := os.ReadFile(filepath.Join(cfg.MetaRoot, metaDir, notFitListFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != formatCopyListLine(huge) {
+		t.Errorf("notFitList = %q, want only huge.mov", b)
+	}
+}
+
+func TestPreflightMoveOnSameFilesystemNeedsNoSpace(t *testing.T) {
+	cfg := setupTestPreflight(t)
+	cfg.Move = true
+	fromPath := filepath.Join(t.TempDir(), "huge.mov")
+	if err := os.WriteFile(fromPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if getDeviceID(fromPath) != getDeviceID(cfg.ToDir) {
+		t.Skip("the temp dirs are on different filesystems")
+	}
+
+	// 同じファイルシステム上の移動は rename なので、空き容量より大きくても収まる
+	entries := []copyEntry{{fromPath: fromPath, toPath: filepath.Join(cfg.ToDir, "huge.mov"), kind: copyKindFile, size: 1 << 62}}
+	if fits, ok := preflight(newTestLogger(), cfg, localStorage{}, entries); !ok || len(fits) != 1 {
+		t.Errorf("fits = %+v, ok = %v, want the move to fit", fits, ok)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const progressBarWidth = 30
+const progressTTYInterval = 200 * time.Millisecond
+const progressLineInterval = 10 * time.Second
+
+// progress は execCopy の進捗（ファイル数・バイト数）を数えて表示する
+type progress struct {
+	totalFiles int64
+	totalBytes int64
+	doneFiles  atomic.Int64
+	doneBytes  atomic.Int64
+	startedAt  time.Time
+	out        io.Writer
+	tty        bool
+}
+
+// activeProgress は実行中の execCopy の進捗（実行中でなければ nil、HTTP API から参照する）
+var activeProgress atomic.Pointer[progress]
+
+// progressSnapshot はある時点の進捗
+type progressSnapshot struct {
+	DoneFiles      int64   `json:"doneFiles"`
+	TotalFiles     int64   `json:"totalFiles"`
+	DoneBytes      int64   `json:"doneBytes"`
+	TotalBytes     int64   `json:"totalBytes"`
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+}
+
+func (p *progress) snapshot() progressSnapshot {
+	return progressSnapshot{
+		DoneFiles:      p.doneFiles.Load(),
+		TotalFiles:     p.totalFiles,
+		DoneBytes:      p.doneBytes.Load(),
+		TotalBytes:     p.totalBytes,
+		ElapsedSeconds: time.Since(p.startedAt).Seconds(),
+	}
+}
+
+// progressOutput は進捗の表示先（TUI のように自前で表示する場合は io.Discard にする）
+var progressOutput io.Writer = os.Stdout
+
+func newProgress(totalFiles int64, totalBytes int64) *progress {
+	f, ok := progressOutput.(*os.File)
+	return &progress{
+		totalFiles: totalFiles,
+		totalBytes: totalBytes,
+		out:        progressOutput,
+		tty:        ok && isTerminal(f),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *progress) addDoneBytes(n int64) {
+	if p == nil {
+		return
+	}
+	p.doneBytes.Add(n)
+}
+
+// newCopyCounter は1件分のバイト数を数える copyCounter を返す
+func (p *progress) newCopyCounter() *copyCounter {
+	return &copyCounter{p: p}
+}
+
+// copyCounter は1件のコピーで処理したバイト数を数える。
+// 進捗にはその場で足し、bytes_copied_total にはコピーが成功した時（commit）だけ足す。
+// 失敗・ロールバックした場合（rollback）は進捗から引く。
+type copyCounter struct {
+	p       *progress
+	copied  atomic.Int64
+	skipped atomic.Int64
+}
+
+// Write はコピーしたバイト数を数える（io.MultiWriter に渡す用）
+func (c *copyCounter) Write(b []byte) (int, error) {
+	c.addBytes(int64(len(b)))
+	return len(b), nil
+}
+
+func (c *copyCounter) addBytes(n int64) {
+	if c == nil {
+		return
+	}
+	c.copied.Add(n)
+	c.p.addDoneBytes(n)
+}
+
+// skipBytes はコピーせずに済んだバイト数を、進捗上は処理済みとして数える（bytes_copied_total には数えない）
+func (c *copyCounter) skipBytes(n int64) {
+	if c == nil {
+		return
+	}
+	c.skipped.Add(n)
+	c.p.addDoneBytes(n)
+}
+
+func (c *copyCounter) commit() {
+	if c == nil {
+		return
+	}
+	metricBytesCopied.Add(float64(c.copied.Swap(0)))
+	c.skipped.Store(0)
+}
+
+func (c *copyCounter) rollback() {
+	if c == nil {
+		return
+	}
+	c.p.addDoneBytes(-(c.copied.Swap(0) + c.skipped.Swap(0)))
+}
+
+func (p *progress) fileDone() {
+	if p == nil {
+		return
+	}
+	p.doneFiles.Add(1)
+}
+
+// start は定期的な進捗表示を開始し、表示を止めて最終結果を表示する関数を返す
+func (p *progress) start(ctx context.Context) func() {
+	p.startedAt = time.Now()
+
+	interval := progressLineInterval
+	if p.tty {
+		interval = progressTTYInterval
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lastBytes := int64(0)
+		lastAt := p.startedAt
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				doneBytes := p.doneBytes.Load()
+				rate := float64(doneBytes-lastBytes) / now.Sub(lastAt).Seconds()
+				lastBytes, lastAt = doneBytes, now
+				p.print(rate)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+		elapsed := time.Since(p.startedAt).Seconds()
+		p.print(float64(p.doneBytes.Load()) / elapsed)
+		if p.tty {
+			fmt.Fprintln(p.out)
+		}
+	}
+}
+
+func (p *progress) print(rate float64) {
+	doneFiles := p.doneFiles.Load()
+	doneBytes := p.doneBytes.Load()
+
+	// 直近の速度が出ない（大きいファイルの open 待ち等）場合は全体の平均速度で ETA を出す
+	etaRate := rate
+	if etaRate <= 0 {
+		etaRate = float64(doneBytes) / time.Since(p.startedAt).Seconds()
+	}
+	eta := "--:--:--"
+	if etaRate > 0 && p.totalBytes >= doneBytes {
+		eta = formatDuration(time.Duration(float64(p.totalBytes-doneBytes) / etaRate * float64(time.Second)))
+	}
+
+	if p.tty {
+		fmt.Fprintf(p.out, "\r%s %d/%d files  %s/%s  %.1f MB/s  ETA %s ",
+			progressBar(doneBytes, p.totalBytes), doneFiles, p.totalFiles,
+			formatBytes(doneBytes), formatBytes(p.totalBytes), rate/1024/1024, eta)
+		return
+	}
+	fmt.Fprintf(p.out, "progress time=%s files=%d/%d bytes=%d/%d mbps=%.1f eta=%s\n",
+		time.Now().Format(time.RFC3339), doneFiles, p.totalFiles, doneBytes, p.totalBytes, rate/1024/1024, eta)
+}
+
+func progressBar(done int64, total int64) string {
+	filled := progressBarWidth
+	if total > 0 {
+		filled = int(float64(done) / float64(total) * progressBarWidth)
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", progressBarWidth-filled) + "]"
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	d -= h * time.Hour
+	m := d / time.Minute
+	d -= m * time.Minute
+	return fmt.Sprintf("%02d:%02d:%02d", h, m, d/time.Second)
+}
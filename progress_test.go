@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// closeFailStorage は書き込んだ内容を閉じる時に失敗する出力先
+type closeFailStorage struct {
+	localStorage
+}
+
+type closeFailWriter struct {
+	io.WriteCloser
+}
+
+func (w closeFailWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return errors.New("disk full")
+}
+
+func (s closeFailStorage) create(path string) (io.WriteCloser, error) {
+	f, err := s.localStorage.create(path)
+	if err != nil {
+		return nil, err
+	}
+	return closeFailWriter{f}, nil
+}
+
+func TestProgressCountsOnlySuccessfulCopies(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	fromPath := filepath.Join(fromDir, "a.jpg")
+	if err := os.WriteFile(fromPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry := copyEntry{fromPath: fromPath, toPath: filepath.Join(toDir, "a.jpg"), kind: copyKindFile, size: 4}
+
+	// 全て書き込んだ後に失敗してロールバックしたコピーは、進捗から引く
+	prog := newProgress(1, 4)
+	w := &copyWorker{logger: newTestLogger(), progress: prog, engine: copyEngineStream, fromSt: localStorage{}, toSt: closeFailStorage{}}
+	w.execEntry(context.Background(), Config{}, entry)
+	if _, err := os.Stat(entry.toPath); !os.IsNotExist(err) {
+		t.Fatalf("failed copy must be rolled back: %v", err)
+	}
+	if got := prog.snapshot().DoneBytes; got != 0 {
+		t.Errorf("done bytes = %d, want 0 for a failed copy", got)
+	}
+
+	w.toSt = localStorage{}
+	w.execEntry(context.Background(), Config{}, entry)
+	if got := prog.snapshot().DoneBytes; got != 4 {
+		t.Errorf("done bytes = %d, want 4", got)
+	}
+}
@@ -1,31 +1,50 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"io/fs"
+	"log/slog"
 	"path/filepath"
 	"strings"
-	"time"
 )
 
 const renameDirLogFileName = "renameDir.log"
 const replaceFromStr = "xxxx"
 
-func renameDir(toDir string) {
-	closeLogFile := openRenameDirLogFile(toDir)
+func renameDir(ctx context.Context, cfg Config) (err error) {
+	toDir := cfg.ToDir
+
+	logger, closeLogFile := openRenameDirLogFile(ctx, getMetaRoot(cfg))
 	defer closeLogFile()
 
-	log.Printf("START: %s\n", time.Now().Format(time.RFC3339))
-	bytesFilePathMap := make(map[string][]oldNewPath)
-	if err := filepath.WalkDir(toDir, func(path string, d os.DirEntry, err error) error {
+	report := newRunReport(ctx, logger, nil, renameDirLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(getMetaRoot(cfg))
+	}()
+
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	logger.Info("START")
+	// 走査中にリネームすると一覧が変わるので、対象のディレクトリを全て集めてからリネームする
+	var dirs []string
+	if err := toSt.walkDir(toDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
-			log.Println("failed to WalkDir", err)
+			logger.Warn("failed to walk", "path", path, "err", err)
 			return nil
 		}
 
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
 		fi, err := d.Info()
 		if err != nil {
-			log.Println("failed to get directory info", err)
+			logger.Warn("failed to get file info", "path", path, "err", err)
 			return nil
 		}
 
@@ -33,30 +52,42 @@ func renameDir(toDir string) {
 			return nil
 		}
 
-		dir, file := filepath.Split(path)
-		log.Println(dir)
-		log.Println(file)
+		_, file := filepath.Split(path)
 
 		if strings.Contains(file, replaceFromStr) {
-			newSubDir := strings.Replace(file, replaceFromStr, "", -1)
-			if err := renameFile(path, filepath.Join(toDir, newSubDir)); err != nil {
-				log.Fatal(err)
-			}
+			dirs = append(dirs, path)
+			// ディレクトリごと移すので、中は見なくてよい
+			return fs.SkipDir
 		}
 
 		return nil
 	}); err != nil {
-		log.Fatal(err)
+		if isCanceled(err) {
+			logger.Warn("canceled", "err", err)
+			return nil
+		}
+		return err
 	}
 
-	for _, oldNewPaths := range bytesFilePathMap {
-		for _, oldNewPath := range oldNewPaths {
-			log.Printf("[oldPath:%s] [newPath:%s]\n", oldNewPath.oldPath, oldNewPath.newPath)
+	for _, dir := range dirs {
+		if ctx.Err() != nil {
+			logger.Warn("canceled", "err", ctx.Err())
+			return nil
+		}
+
+		newSubDir := strings.Replace(filepath.Base(dir), replaceFromStr, "", -1)
+		to := filepath.Join(toDir, newSubDir)
+		if err := toSt.rename(dir, to); err != nil {
+			return err
 		}
+		logger.Info("renamed", "src", dir, "dst", to)
+		report.add(reportOutcomeRenamed, dir, 0)
 	}
-	log.Printf("END  : %s\n", time.Now().Format(time.RFC3339))
+
+	logger.Info("END")
+	return nil
 }
 
-func openRenameDirLogFile(rootPath string) CloseFunc {
-	return setupLog(filepath.Join(rootPath, metaDir, renameDirLogFileName))
+func openRenameDirLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, renameDirLogFileName))
 }
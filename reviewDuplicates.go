@@ -0,0 +1,412 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/rwcarlsen/goexif/exif"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed reviewDuplicates.html
+var reviewDuplicatesHTML []byte
+
+const thumbnailSize = 240
+
+// duplicateFile は重複のグループ内のファイル1件分
+type duplicateFile struct {
+	Name string `json:"name"`
+	// checkDuplication が付けた元のディレクトリ名（<subDir>____<fileName>）
+	SubDir   string            `json:"subDir"`
+	FileName string            `json:"fileName"`
+	Path     string            `json:"path"`
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"modTime"`
+	IsImage  bool              `json:"isImage"`
+	Exif     map[string]string `json:"exif,omitempty"`
+}
+
+// duplicateGroup は checkDuplication が作った __duplicated__/<グループ>/ 1件分
+type duplicateGroup struct {
+	ID    string          `json:"id"`
+	Files []duplicateFile `json:"files"`
+}
+
+// duplicateDecision は重複のグループに対する判断（残すファイルか「重複ではない」のどちらか）
+type duplicateDecision struct {
+	Keeper       string `json:"keeper"`
+	NotDuplicate bool   `json:"notDuplicate"`
+}
+
+// listDuplicateGroups は重複のグループを返す（「重複ではない」とされたグループは元の場所に戻してあるので含まれない）
+func listDuplicateGroups(logger *slog.Logger, toSt storage, toDir string) ([]duplicateGroup, error) {
+	root := filepath.Join(toDir, dupDir)
+	if _, err := toSt.stat(root); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []duplicateGroup{}, nil
+		}
+		return nil, err
+	}
+
+	groups := make(map[string]*duplicateGroup)
+	if err := toSt.walkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		groupID, ok := getDuplicateGroupID(toDir, path)
+		if !ok {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			logger.Warn("failed to get directory info", "dst", path, "err", err)
+			return nil
+		}
+
+		g, ok := groups[groupID]
+		if !ok {
+			g = &duplicateGroup{ID: groupID}
+			groups[groupID] = g
+		}
+		g.Files = append(g.Files, newDuplicateFile(logger, toSt, path, fi))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	result := make([]duplicateGroup, 0, len(groups))
+	for _, g := range groups {
+		// 残すファイルを選んだ後のグループ（1件だけ）は確認済み
+		if len(g.Files) < 2 {
+			continue
+		}
+		sort.Slice(g.Files, func(i, j int) bool {
+			return g.Files[i].Name < g.Files[j].Name
+		})
+		result = append(result, *g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	return result, nil
+}
+
+func newDuplicateFile(logger *slog.Logger, toSt storage, path string, fi fs.FileInfo) duplicateFile {
+	name := fi.Name()
+	subDir, fileName, ok := strings.Cut(name, "____")
+	if !ok {
+		subDir, fileName = "", name
+	}
+
+	f := duplicateFile{
+		Name:     name,
+		SubDir:   subDir,
+		FileName: fileName,
+		Path:     path,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+		IsImage:  isThumbnailTarget(name),
+	}
+	if f.IsImage {
+		f.Exif = readExif(logger, toSt, path)
+	}
+	return f
+}
+
+func isThumbnailTarget(name string) bool {
+	switch strings.ToLower(getExt(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// readExif は比較に使う EXIF の項目（撮影日時・機種・画素数・位置）を返す
+func readExif(logger *slog.Logger, toSt storage, path string) map[string]string {
+	f, err := toSt.open(path)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			logger.Warn("failed to close", "dst", path, "err", err)
+		}
+	}()
+
+	x, err := exif.Decode(f)
+	if err != nil {
+		return nil
+	}
+
+	values := make(map[string]string)
+	if t, err := x.DateTime(); err == nil {
+		values["dateTime"] = t.Format(time.RFC3339)
+	}
+	for key, field := range map[string]exif.FieldName{
+		"make":   exif.Make,
+		"model":  exif.Model,
+		"width":  exif.PixelXDimension,
+		"height": exif.PixelYDimension,
+	} {
+		if tag, err := x.Get(field); err == nil {
+			values[key] = strings.Trim(tag.String(), `"`)
+		}
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		values["gps"] = fmt.Sprintf("%.6f,%.6f", lat, long)
+	}
+	return values
+}
+
+// applyDuplicateDecision は判断を反映する。
+// 残すファイルを選んだ場合は、それ以外を deDuplication と同じ removeDuplicates で削除する。
+// 「重複ではない」場合は、グループのファイルを checkDuplication が移動する前の場所に戻す。削除・戻したファイルは report に数える。
+func applyDuplicateDecision(logger *slog.Logger, toSt storage, report *runReport, toDir string, metaRoot string, groupID string, decision duplicateDecision) error {
+	groupDir := filepath.Join(toDir, dupDir, groupID)
+	files, err := listDuplicateGroupFiles(toSt, groupDir)
+	if err != nil {
+		return err
+	}
+
+	if decision.NotDuplicate {
+		return restoreDuplicateGroup(logger, toSt, report, metaRoot, groupID, groupDir, files)
+	}
+
+	keeperPath := filepath.Join(groupDir, decision.Keeper)
+	if _, err := toSt.stat(keeperPath); err != nil {
+		return fmt.Errorf("unknown keeper: %w", err)
+	}
+	var others []walkedFile
+	for _, file := range files {
+		if file.path != keeperPath {
+			others = append(others, file)
+		}
+	}
+	return removeDuplicates(logger, toSt, report, keeperPath, others)
+}
+
+func listDuplicateGroupFiles(toSt storage, groupDir string) ([]walkedFile, error) {
+	var files []walkedFile
+	if err := toSt.walkDir(groupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, walkedFile{path: path, size: fi.Size()})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// restoreDuplicateGroup はグループのファイルを移動前の場所に戻し、次の checkDuplication・deDuplication で
+// 重複として扱わないよう notDuplicateList に記録する
+func restoreDuplicateGroup(logger *slog.Logger, toSt storage, report *runReport, metaRoot string, groupID string, groupDir string, files []walkedFile) error {
+	origins := loadDuplicateOriginList(logger, metaRoot)
+
+	// 戻せないファイルがあればどれも戻さない（グループを中途半端に残さない）
+	var restores []oldNewPath
+	for _, file := range files {
+		originalPath, ok := origins[file.path]
+		if !ok {
+			return fmt.Errorf("original path of %s is not recorded", file.path)
+		}
+		if _, err := toSt.stat(originalPath); err == nil {
+			return fmt.Errorf("original path %s already exists", originalPath)
+		}
+		restores = append(restores, oldNewPath{oldPath: file.path, newPath: originalPath})
+	}
+
+	var restored []string
+	restoreErr := func() error {
+		for i, r := range restores {
+			if err := toSt.mkdirAll(filepath.Dir(r.newPath)); err != nil {
+				return err
+			}
+			if err := toSt.rename(r.oldPath, r.newPath); err != nil {
+				return err
+			}
+			logger.Info("restored", "src", r.oldPath, "dst", r.newPath, "group", groupID)
+			report.add(reportOutcomeRestored, r.newPath, files[i].size)
+			restored = append(restored, r.newPath)
+		}
+		return nil
+	}()
+	// 途中で失敗しても、戻したファイルは記録する（残りはグループに残るので、もう一度戻せる）
+	if err := appendNotDuplicateList(logger, metaRoot, groupID, restored); err != nil {
+		return err
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+
+	if err := toSt.remove(groupDir); err != nil {
+		logger.Warn("failed to remove group dir", "dst", groupDir, "err", err)
+	}
+	logger.Info("not duplicate", "group", groupID)
+	return nil
+}
+
+// writeThumbnail は画像を縮小して JPEG で書き出す
+func writeThumbnail(w io.Writer, r io.Reader) error {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(w, resizeNearest(img, thumbnailSize), &jpeg.Options{Quality: 80})
+}
+
+// resizeNearest は長辺が size 以下になるよう最近傍法で縮小する
+func resizeNearest(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, max(tw, 1), max(th, 1)))
+	for y := 0; y < dst.Bounds().Dy(); y++ {
+		for x := 0; x < dst.Bounds().Dx(); x++ {
+			dst.Set(x, y, img.At(b.Min.X+x*w/tw, b.Min.Y+y*h/th))
+		}
+	}
+	return dst
+}
+
+// isSafePathElement はグループ ID・ファイル名として使えるか（他のディレクトリを指していないか）を返す
+func isSafePathElement(s string) bool {
+	return s != "" && s != "." && s != ".." && filepath.Base(s) == s
+}
+
+func (s *apiServer) handleReviewPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := w.Write(reviewDuplicatesHTML); err != nil {
+		s.logger.Warn("failed to write response", "err", err)
+	}
+}
+
+// handleDuplicates は GET で重複のグループの一覧を返す
+func (s *apiServer) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	groups, err := listDuplicateGroups(s.logger, s.toSt, s.cfg.ToDir)
+	if err != nil {
+		s.writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, groups)
+}
+
+// handleDuplicate は POST /api/duplicates/{group} で判断を反映し、
+// GET /api/duplicates/{group}/{file}（/thumbnail）でファイル（の縮小画像）を返す
+func (s *apiServer) handleDuplicate(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/duplicates/"), "/")
+	groupID := parts[0]
+	if !isSafePathElement(groupID) {
+		s.writeJSONError(w, http.StatusNotFound, fmt.Errorf("unknown group: %s", groupID))
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodPost {
+			s.writeJSONError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		s.applyDecision(w, r, groupID)
+		return
+	}
+
+	name := parts[1]
+	if r.Method != http.MethodGet || !isSafePathElement(name) || len(parts) > 3 || (len(parts) == 3 && parts[2] != "thumbnail") {
+		s.writeJSONError(w, http.StatusNotFound, fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	f, err := s.toSt.open(filepath.Join(s.cfg.ToDir, dupDir, groupID, name))
+	if err != nil {
+		s.writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			s.logger.Warn("failed to close", "dst", name, "err", err)
+		}
+	}()
+
+	if len(parts) == 3 {
+		w.Header().Set("Content-Type", "image/jpeg")
+		if err := writeThumbnail(w, f); err != nil {
+			s.logger.Error("failed to create thumbnail", "group", groupID, "dst", name, "err", err)
+		}
+		return
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		s.logger.Warn("failed to write response", "group", groupID, "dst", name, "err", err)
+	}
+}
+
+func (s *apiServer) applyDecision(w http.ResponseWriter, r *http.Request, groupID string) {
+	var decision duplicateDecision
+	if err := json.NewDecoder(r.Body).Decode(&decision); err != nil {
+		s.writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !decision.NotDuplicate && !isSafePathElement(decision.Keeper) {
+		s.writeJSONError(w, http.StatusBadRequest, errors.New("keeper or notDuplicate is required"))
+		return
+	}
+
+	// パイプラインの実行中は出力先を変更しない
+	unlock, err := acquireRunLock(s.logger, s.metaRoot)
+	if err != nil {
+		s.writeJSONError(w, http.StatusConflict, err)
+		return
+	}
+	defer unlock()
+
+	// 判断毎に実行 ID を付け、deDuplication と同じくサマリを書き出す
+	ctx := withRunID(s.ctx, uuid.NewString())
+	logger, closeLogFile := openDeDuplicationLogFile(ctx, s.metaRoot)
+	defer closeLogFile()
+
+	report := newRunReport(ctx, logger, &s.cfg, deDuplicationLogFileName)
+	err = applyDuplicateDecision(logger, s.toSt, report, s.cfg.ToDir, s.metaRoot, groupID, decision)
+	report.setResult(ctx, err)
+	report.finish(s.metaRoot)
+	if err != nil {
+		logger.Error("failed to apply decision", "group", groupID, "err", err)
+		s.writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, map[string]string{"group": groupID})
+}
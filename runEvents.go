@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// パイプラインの実行中に発生するイベントの種類
+const (
+	runEventRunStarted  = "runStarted"
+	runEventStepStarted = "stepStarted"
+	runEventRunFinished = "runFinished"
+	runEventProgress    = "progress"
+)
+
+const runEventBufferSize = 64
+
+// runEvent はパイプラインの実行状況の通知（HTTP API の SSE 等で使う）
+type runEvent struct {
+	Type     string            `json:"type"`
+	Time     time.Time         `json:"time"`
+	RunID    string            `json:"runId,omitempty"`
+	Pipeline string            `json:"pipeline,omitempty"`
+	Step     string            `json:"step,omitempty"`
+	Run      *runRecord        `json:"run,omitempty"`
+	Progress *progressSnapshot `json:"progress,omitempty"`
+}
+
+// eventBus はイベントを購読者に配る。受け取りが遅い購読者にはイベントを捨てる（実行を止めない）。
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan runEvent]struct{}
+}
+
+var runEvents = &eventBus{subscribers: make(map[chan runEvent]struct{})}
+
+func (b *eventBus) subscribe() (<-chan runEvent, CloseFunc) {
+	ch := make(chan runEvent, runEventBufferSize)
+
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+}
+
+func (b *eventBus) publish(e runEvent) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// activeRun は実行中のパイプライン
+type activeRun struct {
+	record runRecord
+	step   string
+	cancel context.CancelFunc
+}
+
+// runRegistry は実行中のパイプラインを保持する（HTTP API から参照・停止する）
+type runRegistry struct {
+	mu   sync.Mutex
+	runs map[string]*activeRun
+}
+
+var activeRuns = &runRegistry{runs: make(map[string]*activeRun)}
+
+func (r *runRegistry) add(record runRecord, cancel context.CancelFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.runs[record.RunID] = &activeRun{record: record, cancel: cancel}
+}
+
+func (r *runRegistry) setStep(runID string, step string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if run, ok := r.runs[runID]; ok {
+		run.step = step
+	}
+}
+
+func (r *runRegistry) remove(runID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.runs, runID)
+}
+
+// stop は実行中のパイプラインをキャンセルする。実行中でなければ false を返す。
+func (r *runRegistry) stop(runID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[runID]
+	if !ok {
+		return false
+	}
+	run.cancel()
+	return true
+}
+
+// runStatus は実行中のパイプラインの状態
+type runStatus struct {
+	RunID     string    `json:"runId"`
+	Pipeline  string    `json:"pipeline"`
+	Steps     []string  `json:"steps"`
+	Step      string    `json:"step"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+func (r *runRegistry) list() []runStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := make([]runStatus, 0, len(r.runs))
+	for _, run := range r.runs {
+		statuses = append(statuses, runStatus{
+			RunID:     run.record.RunID,
+			Pipeline:  run.record.Pipeline,
+			Steps:     run.record.Steps,
+			Step:      run.step,
+			StartedAt: run.record.StartedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartedAt.Before(statuses[j].StartedAt)
+	})
+	return statuses
+}
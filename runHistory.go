@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const runHistoryFileName = "runHistory.jsonl"
+
+const (
+	runOutcomeSuccess  = "success"
+	runOutcomeErrors   = "errors"
+	runOutcomeFailed   = "failed"
+	runOutcomeCanceled = "canceled"
+	runOutcomeSkipped  = "skipped"
+)
+
+// runRecord は daemon のパイプライン1回分の実行結果
+type runRecord struct {
+	RunID      string    `json:"runId"`
+	Pipeline   string    `json:"pipeline"`
+	Steps      []string  `json:"steps"`
+	StartedAt  time.Time `json:"startedAt"`
+	EndedAt    time.Time `json:"endedAt"`
+	Outcome    string    `json:"outcome"`
+	ErrorCount int       `json:"errorCount"`
+	// この実行で追記された errorList.txt の最初の行（0 始まり）
+	ErrorListStart int    `json:"errorListStart"`
+	Message        string `json:"message,omitempty"`
+}
+
+func getRunHistoryFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, runHistoryFileName)
+}
+
+func appendRunHistory(logger *slog.Logger, rootPath string, r runRecord) {
+	f, closeFunc, err := openFile(logger, getRunHistoryFilePath(rootPath))
+	if err != nil {
+		logger.Error("failed to open run history", "pipelineRunId", r.RunID, "err", err)
+		return
+	}
+	defer closeFunc()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		logger.Error("failed to marshal run history", "pipelineRunId", r.RunID, "err", err)
+		return
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		logger.Error("failed to write run history", "pipelineRunId", r.RunID, "err", err)
+	}
+}
+
+// loadRunHistory は実行履歴を古い順に返す
+func loadRunHistory(logger *slog.Logger, rootPath string) (records []runRecord, err error) {
+	f, err := os.Open(getRunHistoryFilePath(rootPath))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			logger.Warn("invalid run history", "err", err)
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// readLines はファイルの start 行目（0 始まり）から n 行を返す
+func readLines(path string, start int, n int) (lines []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	scanner := bufio.NewScanner(f)
+	for i := 0; scanner.Scan() && i < start+n; i++ {
+		if i >= start {
+			lines = append(lines, scanner.Text())
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// readAppendedLines は offset から後に追記された行（改行まで書き終えたもの）と、次に読む位置を返す
+func readAppendedLines(path string, offset int64) (lines []string, next int64, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, offset, nil
+		}
+		return nil, offset, err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, offset, err
+	}
+	// 書きかけの行は次に読む
+	end := bytes.LastIndexByte(b, '\n') + 1
+	for _, line := range strings.SplitAfter(string(b[:end]), "\n") {
+		if line != "" {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	return lines, offset + int64(end), nil
+}
+
+// getFileSize はファイルのサイズを返す（無い場合は 0）
+func getFileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// countLines はファイルの行数を返す（errorList の増分からエラー数を数える）
+func countLines(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	// 読み込むだけなので閉じる際のエラーは行数に影響しない
+	defer func() {
+		_ = f.Close()
+	}()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const runLockFileName = "run.lock"
+
+// errRunLocked は別の実行（daemon のパイプラインや手動の実行）が動いていることを表す
+var errRunLocked = errors.New("another run is in progress")
+
+func getRunLockFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, runLockFileName)
+}
+
+// acquireRunLock は重複実行を防ぐため、ロックファイルを flock でロックする（中身はログ用の PID）。
+// ロックはプロセスが終了すると OS が外すので、異常終了した実行のロックファイルが残っていても次の実行は止まらない。
+func acquireRunLock(logger *slog.Logger, rootPath string) (CloseFunc, error) {
+	path := getRunLockFilePath(rootPath)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		pid := readRunLockPID(f)
+		if closeErr := f.Close(); closeErr != nil {
+			logger.Error("failed to close lock", "path", path, "err", closeErr)
+		}
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w (pid:%d)", errRunLocked, pid)
+		}
+		return nil, err
+	}
+
+	if err := f.Truncate(0); err != nil {
+		logger.Error("failed to write lock", "path", path, "err", err)
+	} else if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0); err != nil {
+		logger.Error("failed to write lock", "path", path, "err", err)
+	}
+	// ロックファイルは削除しない（削除すると、開いたままの別の実行と新しいファイルをロックした実行が同時に動ける）
+	return func() {
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+			logger.Error("failed to unlock", "path", path, "err", err)
+		}
+		if err := f.Close(); err != nil {
+			logger.Error("failed to close lock", "path", path, "err", err)
+		}
+	}, nil
+}
+
+// readRunLockPID はロックしている実行がロックファイルに書いた PID を返す（読めない場合は 0）
+func readRunLockPID(f *os.File) int {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	return pid
+}
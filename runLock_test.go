@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunLockIgnoresLeftoverLockFile(t *testing.T) {
+	rootPath := t.TempDir()
+	if err := createDirectory(filepath.Join(rootPath, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 異常終了した実行のロックファイル（空・壊れた内容・別のプロセスが再利用した PID）では止まらない
+	for _, content := range []string{"", "garbage", "1"} {
+		if err := os.WriteFile(getRunLockFilePath(rootPath), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		unlock, err := acquireRunLock(newTestLogger(), rootPath)
+		if err != nil {
+			t.Fatalf("lock file %q: %v", content, err)
+		}
+		unlock()
+	}
+}
+
+func TestRunLockRejectsConcurrentRun(t *testing.T) {
+	rootPath := t.TempDir()
+	if err := createDirectory(filepath.Join(rootPath, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, err := acquireRunLock(newTestLogger(), rootPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireRunLock(newTestLogger(), rootPath); !errors.Is(err, errRunLocked) {
+		t.Errorf("err = %v, want %v while locked", err, errRunLocked)
+	}
+	unlock()
+
+	unlock, err = acquireRunLock(newTestLogger(), rootPath)
+	if err != nil {
+		t.Fatalf("lock after unlock: %v", err)
+	}
+	unlock()
+}
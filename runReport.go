@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const reportDir = "reports"
+const reportTopErrors = 5
+const reportErrorExamples = 3
+const reportLargestFiles = 10
+
+// サマリに数える結果の種類
+const (
+	reportOutcomeListed    = "listed"
+	reportOutcomeSkipped   = "skipped"
+	reportOutcomeCreated   = "created"
+	reportOutcomeCopied    = "copied"
+	reportOutcomeFailed    = "failed"
+	reportOutcomeDuplicate = "duplicate"
+	reportOutcomeRemoved   = "removed"
+	reportOutcomeMoved     = "moved"
+	reportOutcomeRenamed   = "renamed"
+	reportOutcomeRestored  = "restored"
+	reportOutcomeReplaced  = "replaced"
+)
+
+// reportErrorThreshold は error-threshold のフックを呼び出す失敗したファイル数（0 の場合は呼び出さない。main で設定する）
+var reportErrorThreshold int
+
+// reportOutput はサマリの表示先（TUI のように自前で表示する場合は io.Discard にする）
+var reportOutput io.Writer = os.Stdout
+
+// runReport は1回の operation の結果（カテゴリ・結果毎の件数、バイト数、エラーの原因、大きいファイル、重複）をまとめる
+type runReport struct {
+	RunID           string                            `json:"runId"`
+	Pipeline        string                            `json:"pipeline,omitempty"`
+	Operation       string                            `json:"operation"`
+	StartedAt       time.Time                         `json:"startedAt"`
+	EndedAt         time.Time                         `json:"endedAt"`
+	DurationSeconds float64                           `json:"durationSeconds"`
+	Outcome         string                            `json:"outcome"`
+	Error           string                            `json:"error,omitempty"`
+	Outcomes        map[string]reportCount            `json:"outcomes"`
+	Categories      map[string]map[string]reportCount `json:"categories"`
+	TopErrors       []reportError                     `json:"topErrors"`
+	LargestFiles    []reportFile                      `json:"largestFiles"`
+	Duplicates      reportDuplicates                  `json:"duplicates"`
+
+	mu     sync.Mutex
+	logger *slog.Logger
+	// カテゴリの分類に使う（nil の場合は分類しない）
+	cfg    *Config
+	errors map[string]*reportError
+	// 実行中の error-threshold のフック（finish で終わるのを待つ）
+	hooks sync.WaitGroup
+}
+
+// reportCount はファイル数とバイト数
+type reportCount struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// reportError は原因毎のエラーの件数と例
+type reportError struct {
+	Cause    string   `json:"cause"`
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+type reportFile struct {
+	Path     string `json:"path"`
+	Category string `json:"category"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// reportDuplicates は重複のグループ数・ファイル数と、重複を削除した（削除できる）バイト数
+type reportDuplicates struct {
+	Groups     int   `json:"groups"`
+	Files      int   `json:"files"`
+	SavedBytes int64 `json:"savedBytes"`
+}
+
+// newRunReport は operation（ログファイル名で指定する）のサマリを作る
+func newRunReport(ctx context.Context, logger *slog.Logger, cfg *Config, logFileName string) *runReport {
+	return &runReport{
+		RunID:      getRunID(ctx),
+		Pipeline:   getPipeline(ctx),
+		Operation:  getOperationName(logFileName),
+		StartedAt:  time.Now(),
+		Outcomes:   make(map[string]reportCount),
+		Categories: make(map[string]map[string]reportCount),
+		logger:     logger,
+		cfg:        cfg,
+		errors:     make(map[string]*reportError),
+	}
+}
+
+// add はファイル1件の結果を数える
+func (r *runReport) add(outcome string, path string, size int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	category := r.getCategory(path)
+	r.Outcomes[outcome] = r.Outcomes[outcome].add(size)
+	if r.Categories[category] == nil {
+		r.Categories[category] = make(map[string]reportCount)
+	}
+	r.Categories[category][outcome] = r.Categories[category][outcome].add(size)
+
+	if outcome != reportOutcomeFailed {
+		r.addLargestFile(reportFile{Path: path, Category: category, Bytes: size})
+	}
+}
+
+// replaceListed は listed に数えた後に別のコピー元に置き換えた（計画から外した）ファイル1件を replaced に数え直す
+func (r *runReport) replaceListed(path string, size int64) {
+	if r == nil {
+		return
+	}
+	r.add(reportOutcomeReplaced, path, size)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	category := r.getCategory(path)
+	r.Outcomes[reportOutcomeListed] = r.Outcomes[reportOutcomeListed].sub(size)
+	r.Categories[category][reportOutcomeListed] = r.Categories[category][reportOutcomeListed].sub(size)
+}
+
+// getCategory は path のカテゴリを返す（cfg が無い場合は分類しない）
+func (r *runReport) getCategory(path string) string {
+	if r.cfg == nil {
+		return TargetExtsAll
+	}
+	return getOutputExtsDirectoryName(getExt(filepath.Base(path)), *r.cfg)
+}
+
+// addError は失敗したファイル1件を数え、原因毎にまとめる
+func (r *runReport) addError(path string, size int64, err error) {
+	if r == nil {
+		return
+	}
+	r.add(reportOutcomeFailed, path, size)
+
+	r.mu.Lock()
+	cause := getErrorCause(err)
+	e, ok := r.errors[cause]
+	if !ok {
+		e = &reportError{Cause: cause}
+		r.errors[cause] = e
+	}
+	e.Count++
+	if len(e.Examples) < reportErrorExamples {
+		e.Examples = append(e.Examples, path)
+	}
+	failed := r.Outcomes[reportOutcomeFailed].Files
+	r.mu.Unlock()
+
+	// 終了を待たずに知らせるため、閾値に達した時に1回だけ呼び出す（コピーを止めないよう、別の goroutine で呼び出す）
+	if reportErrorThreshold > 0 && failed == reportErrorThreshold {
+		event := hookEvent{Event: hookEventErrorThreshold, Operation: r.Operation, Pipeline: r.Pipeline, Src: path, Size: size, Failed: failed, Error: err.Error()}
+		r.hooks.Add(1)
+		go func() {
+			defer r.hooks.Done()
+			_ = runHooks(withRunID(context.Background(), r.RunID), r.logger, event)
+		}()
+	}
+}
+
+// addDuplicate は重複のファイル1件を数える（newGroup は新しく見つかったグループの場合）
+func (r *runReport) addDuplicate(path string, size int64, newGroup bool) {
+	if r == nil {
+		return
+	}
+	r.add(reportOutcomeDuplicate, path, size)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if newGroup {
+		r.Duplicates.Groups++
+	}
+	r.Duplicates.Files++
+	r.Duplicates.SavedBytes += size
+}
+
+// addRemovedDuplicate は削除した重複のファイル1件を数える
+func (r *runReport) addRemovedDuplicate(path string, size int64) {
+	if r == nil {
+		return
+	}
+	r.add(reportOutcomeRemoved, path, size)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Duplicates.Files++
+	r.Duplicates.SavedBytes += size
+}
+
+func (c reportCount) add(size int64) reportCount {
+	return reportCount{Files: c.Files + 1, Bytes: c.Bytes + size}
+}
+
+func (c reportCount) sub(size int64) reportCount {
+	return reportCount{Files: c.Files - 1, Bytes: c.Bytes - size}
+}
+
+// addLargestFile は大きい順に reportLargestFiles 件まで残す
+func (r *runReport) addLargestFile(f reportFile) {
+	if len(r.LargestFiles) == reportLargestFiles && r.LargestFiles[len(r.LargestFiles)-1].Bytes >= f.Bytes {
+		return
+	}
+	i := sort.Search(len(r.LargestFiles), func(i int) bool {
+		return r.LargestFiles[i].Bytes < f.Bytes
+	})
+	r.LargestFiles = append(r.LargestFiles, reportFile{})
+	copy(r.LargestFiles[i+1:], r.LargestFiles[i:])
+	r.LargestFiles[i] = f
+	if len(r.LargestFiles) > reportLargestFiles {
+		r.LargestFiles = r.LargestFiles[:reportLargestFiles]
+	}
+}
+
+// getErrorCause は原因毎にまとめるため、ラップされたエラーの一番内側（permission denied 等）を返す
+func getErrorCause(err error) string {
+	for {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			return err.Error()
+		}
+		err = inner
+	}
+}
+
+// setResult は operation が返したエラーと中断を結果に反映する（finish の前に呼び出す）
+func (r *runReport) setResult(ctx context.Context, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case err != nil && isCanceled(err):
+		r.Outcome = runOutcomeCanceled
+	case err != nil:
+		r.Outcome = runOutcomeFailed
+		r.Error = err.Error()
+	case ctx.Err() != nil:
+		r.Outcome = runOutcomeCanceled
+	}
+}
+
+// finish はサマリを表示して書き出し、run-finished のフックを呼び出す
+func (r *runReport) finish(rootPath string) {
+	if r == nil {
+		return
+	}
+	// error-threshold の通知が run-finished より後にならないよう、終わるのを待つ
+	r.hooks.Wait()
+	r.summarize(rootPath)
+
+	// フックがサマリを読めるよう、ロックを外してから呼び出す
+	// 中断した場合も呼び出すよう、operation の ctx ではなく新しい ctx で呼び出す
+	_ = runHooks(withRunID(context.Background(), r.RunID), r.logger, hookEvent{Event: hookEventRunFinished, Operation: r.Operation, Pipeline: r.Pipeline, Report: r})
+}
+
+// summarize は終了日時・多い原因を確定させて、サマリを表示して書き出す
+func (r *runReport) summarize(rootPath string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.EndedAt = time.Now()
+	r.DurationSeconds = r.EndedAt.Sub(r.StartedAt).Seconds()
+	if r.Outcome == "" {
+		r.Outcome = runOutcomeSuccess
+		if r.Outcomes[reportOutcomeFailed].Files > 0 {
+			r.Outcome = runOutcomeErrors
+		}
+	}
+	r.TopErrors = make([]reportError, 0, len(r.errors))
+	for _, e := range r.errors {
+		r.TopErrors = append(r.TopErrors, *e)
+	}
+	sort.Slice(r.TopErrors, func(i, j int) bool {
+		if r.TopErrors[i].Count != r.TopErrors[j].Count {
+			return r.TopErrors[i].Count > r.TopErrors[j].Count
+		}
+		return r.TopErrors[i].Cause < r.TopErrors[j].Cause
+	})
+	if len(r.TopErrors) > reportTopErrors {
+		r.TopErrors = r.TopErrors[:reportTopErrors]
+	}
+
+	fmt.Fprint(reportOutput, r.formatText())
+	r.write(rootPath)
+}
+
+// write は reports/<run ID>/<operation>.json と .md に書き出す
+func (r *runReport) write(rootPath string) {
+	dir := filepath.Join(rootPath, metaDir, reportDir, r.RunID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		r.logger.Error("failed to create report directory", "path", dir, "err", err)
+		return
+	}
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		r.logger.Error("failed to marshal report", "err", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, r.Operation+".json"), append(b, '\n'), 0644); err != nil {
+		r.logger.Error("failed to write report", "path", dir, "err", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, r.Operation+".md"), []byte(r.formatMarkdown()), 0644); err != nil {
+		r.logger.Error("failed to write report", "path", dir, "err", err)
+	}
+}
+
+func (r *runReport) formatText() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "== %s (%s) %s %s\n", r.Operation, r.RunID, r.Outcome, time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond))
+	if r.Error != "" {
+		fmt.Fprintf(&b, "  error: %s\n", r.Error)
+	}
+	for _, outcome := range sortedKeys(r.Outcomes) {
+		c := r.Outcomes[outcome]
+		fmt.Fprintf(&b, "  %-10s %6d files  %10s\n", outcome, c.Files, formatBytes(c.Bytes))
+	}
+	if r.Duplicates.Files > 0 {
+		fmt.Fprintf(&b, "  duplicates: %d groups, %d files, %s saved\n", r.Duplicates.Groups, r.Duplicates.Files, formatBytes(r.Duplicates.SavedBytes))
+	}
+	for _, e := range r.TopErrors {
+		fmt.Fprintf(&b, "  error: %s (%d)\n", e.Cause, e.Count)
+	}
+	return b.String()
+}
+
+func (r *runReport) formatMarkdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", r.Operation)
+	fmt.Fprintf(&b, "- run ID: %s\n", r.RunID)
+	fmt.Fprintf(&b, "- started: %s\n", r.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- ended: %s\n", r.EndedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "- duration: %s\n", time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond))
+	fmt.Fprintf(&b, "- outcome: %s\n", r.Outcome)
+	if r.Error != "" {
+		fmt.Fprintf(&b, "- error: %s\n", r.Error)
+	}
+
+	b.WriteString("\n## Outcomes\n\n| outcome | files | bytes |\n|---|---:|---:|\n")
+	for _, outcome := range sortedKeys(r.Outcomes) {
+		c := r.Outcomes[outcome]
+		fmt.Fprintf(&b, "| %s | %d | %s |\n", outcome, c.Files, formatBytes(c.Bytes))
+	}
+
+	b.WriteString("\n## Categories\n\n| category | outcome | files | bytes |\n|---|---|---:|---:|\n")
+	for _, category := range sortedKeys(r.Categories) {
+		for _, outcome := range sortedKeys(r.Categories[category]) {
+			c := r.Categories[category][outcome]
+			fmt.Fprintf(&b, "| %s | %s | %d | %s |\n", category, outcome, c.Files, formatBytes(c.Bytes))
+		}
+	}
+
+	if r.Duplicates.Files > 0 {
+		fmt.Fprintf(&b, "\n## Duplicates\n\n- groups: %d\n- files: %d\n- saved: %s\n", r.Duplicates.Groups, r.Duplicates.Files, formatBytes(r.Duplicates.SavedBytes))
+	}
+
+	if len(r.TopErrors) > 0 {
+		b.WriteString("\n## Top errors\n\n| cause | count | examples |\n|---|---:|---|\n")
+		for _, e := range r.TopErrors {
+			fmt.Fprintf(&b, "| %s | %d | %s |\n", escapeMarkdownCell(e.Cause), e.Count, escapeMarkdownCell(strings.Join(e.Examples, ", ")))
+		}
+	}
+
+	if len(r.LargestFiles) > 0 {
+		b.WriteString("\n## Largest files\n\n| path | category | bytes |\n|---|---|---:|\n")
+		for _, f := range r.LargestFiles {
+			fmt.Fprintf(&b, "| %s | %s | %s |\n", escapeMarkdownCell(f.Path), f.Category, formatBytes(f.Bytes))
+		}
+	}
+	return b.String()
+}
+
+func escapeMarkdownCell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunReportOutcome(t *testing.T) {
+	reportOutput = io.Discard
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		failedFiles int
+		err         error
+		want        string
+	}{
+		{name: "success", ctx: context.Background(), want: runOutcomeSuccess},
+		{name: "failed files", ctx: context.Background(), failedFiles: 1, want: runOutcomeErrors},
+		// 失敗したファイルが無くても、operation がエラーを返した場合は失敗にする
+		{name: "operation error", ctx: context.Background(), err: errors.New("not enough free space, copy is not started"), want: runOutcomeFailed},
+		{name: "canceled", ctx: canceled, want: runOutcomeCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootPath := t.TempDir()
+			report := newRunReport(withRunID(context.Background(), "run1"), newTestLogger(), nil, execCopyLogFileName)
+			for i := 0; i < tt.failedFiles; i++ {
+				report.addError("/in/a.jpg", 1, errors.New("permission denied"))
+			}
+			report.setResult(tt.ctx, tt.err)
+			report.finish(rootPath)
+
+			b, err := os.ReadFile(filepath.Join(rootPath, metaDir, reportDir, "run1", report.Operation+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got runReport
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Outcome != tt.want {
+				t.Errorf("outcome = %q, want %q", got.Outcome, tt.want)
+			}
+			if tt.err != nil && got.Error != tt.err.Error() {
+				t.Errorf("error = %q, want %q", got.Error, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	storageTypeLocal = "local"
+	storageTypeSFTP  = "sftp"
+	storageTypeS3    = "s3"
+)
+
+// storage はコピー元・出力先のファイル操作（ローカル / SFTP / S3 互換）を抽象化する
+type storage interface {
+	walkDir(root string, fn fs.WalkDirFunc) error
+	stat(path string) (fs.FileInfo, error)
+	open(path string) (io.ReadCloser, error)
+	create(path string) (io.WriteCloser, error)
+	rename(oldPath string, newPath string) error
+	remove(path string) error
+	mkdirAll(path string) error
+	// chtimes は更新日時を設定する（コピー後に出力先をコピー元と同じ更新日時にする）
+	chtimes(path string, modTime time.Time) error
+	// sync は書き込んだ内容をディスクに書き出す（移動でコピー元を削除する前に、電源断でも出力先が残るようにする）
+	sync(path string) error
+	isLocal() bool
+}
+
+// openStorage は設定に応じた storage を返す（未指定ならローカル）
+func openStorage(logger *slog.Logger, cfg StorageConfig) (storage, CloseFunc, error) {
+	switch cfg.Type {
+	case "", storageTypeLocal:
+		return localStorage{}, func() {}, nil
+	case storageTypeSFTP:
+		st, err := newSFTPStorage(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return st, func() {
+			if err := st.close(); err != nil {
+				logger.Warn("failed to close storage", "type", cfg.Type, "err", err)
+			}
+		}, nil
+	case storageTypeS3:
+		st, err := newS3Storage(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return st, func() {}, nil
+	}
+	return nil, nil, fmt.Errorf("unknown storage type: %s", cfg.Type)
+}
+
+// getMetaRoot はメタ情報（ログや copyList 等）を置くローカルのディレクトリを返す。
+// 出力先がリモートの場合は metaRoot の指定が必要（validateConfig で確認する）。
+func getMetaRoot(cfg Config) string {
+	if cfg.MetaRoot != "" {
+		return cfg.MetaRoot
+	}
+	return cfg.ToDir
+}
+
+// localStorage はローカルのファイルシステム（書庫内のファイルの仮想パスにも対応）
+type localStorage struct{}
+
+func (localStorage) walkDir(root string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(root, fn)
+}
+
+func (localStorage) stat(path string) (fs.FileInfo, error) {
+	return statSource(path)
+}
+
+func (localStorage) open(path string) (io.ReadCloser, error) {
+	return openSource(path)
+}
+
+func (localStorage) create(path string) (io.WriteCloser, error) {
+	return os.Create(path)
+}
+
+func (localStorage) rename(oldPath string, newPath string) error {
+	return renameFile(oldPath, newPath)
+}
+
+func (localStorage) remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localStorage) mkdirAll(path string) error {
+	return os.MkdirAll(path, os.ModePerm)
+}
+
+func (localStorage) chtimes(path string, modTime time.Time) error {
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// sync はファイルと、そのエントリを持つディレクトリを fsync する（シンボリックリンクはディレクトリだけ）
+func (localStorage) sync(path string) error {
+	if fi, err := os.Lstat(path); err != nil {
+		return err
+	} else if fi.Mode().IsRegular() {
+		if err := syncFile(path); err != nil {
+			return err
+		}
+	}
+	return syncFile(filepath.Dir(path))
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return f.Close()
+}
+
+func (localStorage) isLocal() bool {
+	return true
+}
+
+// hashStorageFile は storage 上のファイルの内容のハッシュを返す
+func hashStorageFile(st storage, path string) (hash string, err error) {
+	f, err := st.open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	start := time.Now()
+	r := &countingReader{r: f}
+	hash, err = hashReader(r, make([]byte, smallCopyBufferSize))
+	if err == nil {
+		observeHash(r.n, time.Since(start))
+	}
+	return hash, err
+}
+
+// hashCache は listUp 中に計算したハッシュを覚えておき、同じファイルを何度も読まないようにする
+// （importDB・nameMode=hash・取り込み済みや衝突の判定で同じコピー元のハッシュを使う）
+type hashCache struct {
+	mu     sync.Mutex
+	hashes map[hashCacheKey]string
+}
+
+type hashCacheKey struct {
+	st   storage
+	path string
+}
+
+func newHashCache() *hashCache {
+	return &hashCache{hashes: make(map[hashCacheKey]string)}
+}
+
+// hash は storage 上のファイルのハッシュを返す（計算済みなら読み直さない）
+func (c *hashCache) hash(st storage, path string) (string, error) {
+	key := hashCacheKey{st: st, path: path}
+	c.mu.Lock()
+	hash, ok := c.hashes[key]
+	c.mu.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	hash, err := hashStorageFile(st, path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.hashes[key] = hash
+	c.mu.Unlock()
+	return hash, nil
+}
+
+func (c *hashCache) sameContent(st1 storage, path1 string, st2 storage, path2 string) (bool, error) {
+	hash1, err := c.hash(st1, path1)
+	if err != nil {
+		return false, err
+	}
+	hash2, err := c.hash(st2, path2)
+	if err != nil {
+		return false, err
+	}
+	return hash1 == hash2, nil
+}
+
+// countingReader は読み込んだバイト数を数える
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// readSomeBytesFrom は storage 上のファイルの先頭 1024 バイトを返す（空ファイルなら nil）
+func readSomeBytesFrom(st storage, path string) (someBytes []byte, err error) {
+	f, err := st.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	byteArray := make([]byte, 1024)
+	n, err := io.ReadFull(f, byteArray)
+	if n == 0 {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return byteArray, nil
+}
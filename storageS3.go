@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3ModTimeMetadata は chtimes で設定した更新日時を持つユーザーメタデータ（LastModified はアップロードした日時で変えられない）
+const s3ModTimeMetadata = "Mtime"
+
+// s3PartSize はサイズ不明のまま PutObject する時のパートのサイズ（未指定だと 5TiB を前提に約 550MB のバッファを確保する）
+const s3PartSize = 16 << 20
+
+// s3Storage は S3 互換のオブジェクトストレージ（MinIO 等）上のファイル操作。
+// パスはバケット内のキーとして扱う。ディレクトリは存在しない（mkdirAll は何もしない）が、
+// walkDir ではキーの "/" 区切りからディレクトリを組み立てて返し、rename ではディレクトリ以下のオブジェクトをまとめて移す。
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+func newS3Storage(cfg StorageConfig) (*s3Storage, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{client: client, bucket: cfg.Bucket}, nil
+}
+
+func toS3Key(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+func toS3Prefix(p string) string {
+	prefix := toS3Key(p)
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// walkDir は filepath.WalkDir と同じく root とその下のディレクトリ・ファイルを辞書順に返す。
+// キーは辞書順に返るので、同じディレクトリ以下のキーは連続する（fs.SkipDir はそのディレクトリ以下を読み飛ばす）。
+func (s *s3Storage) walkDir(root string, fn fs.WalkDirFunc) error {
+	rootKey := toS3Key(root)
+	prefix := toS3Prefix(root)
+
+	// 途中で抜けた時に ListObjects の goroutine が残らないよう、抜ける時にキャンセルする
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := fn(rootKey, fs.FileInfoToDirEntry(newS3DirInfo(rootKey)), nil); err != nil {
+		if err == fs.SkipDir || err == fs.SkipAll {
+			return nil
+		}
+		return err
+	}
+
+	walkedDir := rootKey
+	skipPrefix := ""
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			if err := fn(rootKey, nil, object.Err); err != nil {
+				return err
+			}
+			continue
+		}
+		if skipPrefix != "" && strings.HasPrefix(object.Key, skipPrefix) {
+			continue
+		}
+
+		// まだ返していない親ディレクトリを上から順に返す
+		dir := path.Dir(object.Key)
+		for _, d := range getNewS3Dirs(rootKey, walkedDir, dir) {
+			walkedDir = d
+			err := fn(d, fs.FileInfoToDirEntry(newS3DirInfo(d)), nil)
+			if err == fs.SkipDir {
+				skipPrefix = d + "/"
+				break
+			}
+			if err == fs.SkipAll {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if skipPrefix != "" && strings.HasPrefix(object.Key, skipPrefix) {
+			continue
+		}
+		skipPrefix = ""
+
+		err := fn(object.Key, fs.FileInfoToDirEntry(newS3FileInfo(object)), nil)
+		if err == fs.SkipDir {
+			continue
+		}
+		if err == fs.SkipAll {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getNewS3Dirs は dir とその親のうち、root より下で、直前に返した walkedDir とその親に含まれないものを上から順に返す
+func getNewS3Dirs(root string, walkedDir string, dir string) []string {
+	var dirs []string
+	for d := dir; d != root && d != "." && d != "/" && d != walkedDir && !strings.HasPrefix(walkedDir, d+"/"); d = path.Dir(d) {
+		dirs = append([]string{d}, dirs...)
+	}
+	return dirs
+}
+
+func (s *s3Storage) stat(p string) (fs.FileInfo, error) {
+	object, err := s.client.StatObject(context.Background(), s.bucket, toS3Key(p), minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	fi := newS3FileInfo(object)
+	if modTime, err := time.Parse(time.RFC3339Nano, object.UserMetadata[s3ModTimeMetadata]); err == nil {
+		fi.modTime = modTime
+	}
+	return fi, nil
+}
+
+func (s *s3Storage) open(p string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(context.Background(), s.bucket, toS3Key(p), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject は実際に読むまでエラーにならないので、存在を確認しておく
+	if _, err := object.Stat(); err != nil {
+		_ = object.Close()
+		return nil, err
+	}
+	return object, nil
+}
+
+func (s *s3Storage) create(p string) (io.WriteCloser, error) {
+	pr, pw := io.Pipe()
+	w := &s3Writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.bucket, toS3Key(p), pr, -1, minio.PutObjectOptions{PartSize: s3PartSize})
+		_ = pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w, nil
+}
+
+// rename はオブジェクトを移す。oldPath のオブジェクトが無ければディレクトリとして扱い、その下のオブジェクトを全て移す。
+func (s *s3Storage) rename(oldPath string, newPath string) error {
+	if _, err := s.stat(oldPath); err == nil {
+		return s.renameObject(toS3Key(oldPath), toS3Key(newPath))
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// 一覧を取り終えてから移す（一覧の途中でオブジェクトを増減させない）
+	oldPrefix, newPrefix := toS3Prefix(oldPath), toS3Prefix(newPath)
+	keys, err := s.listKeys(oldPrefix)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("%s: %w", oldPath, fs.ErrNotExist)
+	}
+	for _, key := range keys {
+		if err := s.renameObject(key, newPrefix+strings.TrimPrefix(key, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Storage) renameObject(oldKey string, newKey string) error {
+	ctx := context.Background()
+	if _, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: newKey},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: oldKey},
+	); err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, oldKey, minio.RemoveObjectOptions{})
+}
+
+// listKeys は prefix 以下のオブジェクトのキーを全て返す
+func (s *s3Storage) listKeys(prefix string) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var keys []string
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+func (s *s3Storage) remove(p string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, toS3Key(p), minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) mkdirAll(string) error {
+	return nil
+}
+
+// chtimes はオブジェクトを同じキーにコピーし直して、更新日時をユーザーメタデータに設定する
+func (s *s3Storage) chtimes(p string, modTime time.Time) error {
+	key := toS3Key(p)
+	_, err := s.client.CopyObject(context.Background(),
+		minio.CopyDestOptions{Bucket: s.bucket, Object: key, ReplaceMetadata: true, UserMetadata: map[string]string{s3ModTimeMetadata: modTime.UTC().Format(time.RFC3339Nano)}},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: key},
+	)
+	return err
+}
+
+// sync は何もしない（PutObject が完了した時点でオブジェクトは保存されている）
+func (s *s3Storage) sync(string) error {
+	return nil
+}
+
+func (s *s3Storage) isLocal() bool {
+	return false
+}
+
+// s3Writer は書き込んだ内容を PutObject に流し、Close でアップロードの完了を待つ
+type s3Writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *s3Writer) Close() error {
+	if err := w.pw.Close(); err != nil {
+		return err
+	}
+	return <-w.done
+}
+
+// s3FileInfo はオブジェクト（またはキーから組み立てたディレクトリ）の情報を fs.FileInfo として扱う
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func newS3FileInfo(object minio.ObjectInfo) s3FileInfo {
+	return s3FileInfo{name: path.Base(object.Key), size: object.Size, modTime: object.LastModified}
+}
+
+func newS3DirInfo(key string) s3FileInfo {
+	return s3FileInfo{name: path.Base(key), isDir: true}
+}
+
+func (fi s3FileInfo) Name() string { return fi.name }
+func (fi s3FileInfo) Size() int64  { return fi.size }
+func (fi s3FileInfo) Mode() fs.FileMode {
+	if fi.isDir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+func (fi s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi s3FileInfo) IsDir() bool        { return fi.isDir }
+func (fi s3FileInfo) Sys() any           { return nil }
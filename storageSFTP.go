@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultSFTPPort = 22
+
+// sftpStorage は SFTP サーバー上のファイル操作
+type sftpStorage struct {
+	sshClient *ssh.Client
+	client    *sftp.Client
+}
+
+func newSFTPStorage(cfg StorageConfig) (*sftpStorage, error) {
+	var auths []ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		key, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auths = append(auths, ssh.Password(cfg.Password))
+	}
+
+	hostKeyCallback, err := getHostKeyCallback(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	port := cfg.Port
+	if port == 0 {
+		port = defaultSFTPPort
+	}
+	sshClient, err := ssh.Dial("tcp", net.JoinHostPort(cfg.Host, strconv.Itoa(port)), &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.Host, err)
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, err
+	}
+	return &sftpStorage{sshClient: sshClient, client: client}, nil
+}
+
+func getHostKeyCallback(cfg StorageConfig) (ssh.HostKeyCallback, error) {
+	if cfg.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	knownHostsFile := cfg.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	return knownhosts.New(knownHostsFile)
+}
+
+func (s *sftpStorage) close() error {
+	if err := s.client.Close(); err != nil {
+		return err
+	}
+	return s.sshClient.Close()
+}
+
+func (s *sftpStorage) walkDir(root string, fn fs.WalkDirFunc) error {
+	walker := s.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if fnErr := fn(walker.Path(), nil, err); fnErr != nil {
+				return fnErr
+			}
+			continue
+		}
+
+		err := fn(walker.Path(), fs.FileInfoToDirEntry(walker.Stat()), nil)
+		if err == fs.SkipDir {
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+			continue
+		}
+		if err == fs.SkipAll {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sftpStorage) stat(path string) (fs.FileInfo, error) {
+	return s.client.Stat(path)
+}
+
+func (s *sftpStorage) open(path string) (io.ReadCloser, error) {
+	return s.client.Open(path)
+}
+
+func (s *sftpStorage) create(path string) (io.WriteCloser, error) {
+	return s.client.Create(path)
+}
+
+func (s *sftpStorage) rename(oldPath string, newPath string) error {
+	// os.Rename と同じく上書きする（サーバーが posix-rename 拡張に未対応なら通常の rename）
+	if err := s.client.PosixRename(oldPath, newPath); err == nil {
+		return nil
+	}
+	return s.client.Rename(oldPath, newPath)
+}
+
+func (s *sftpStorage) remove(path string) error {
+	return s.client.Remove(path)
+}
+
+func (s *sftpStorage) mkdirAll(path string) error {
+	return s.client.MkdirAll(path)
+}
+
+func (s *sftpStorage) chtimes(path string, modTime time.Time) error {
+	return s.client.Chtimes(path, modTime, modTime)
+}
+
+// sync はサーバーが fsync@openssh.com 拡張に対応していればファイルを fsync する（未対応なら何もしない）
+func (s *sftpStorage) sync(path string) error {
+	if _, ok := s.client.HasExtension("fsync@openssh.com"); !ok {
+		return nil
+	}
+	f, err := s.client.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return errors.Join(err, f.Close())
+	}
+	return f.Close()
+}
+
+func (s *sftpStorage) isLocal() bool {
+	return false
+}
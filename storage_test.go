@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSFTPServer はローカルのファイルシステムをそのまま公開する SFTP サーバーを起動し、接続先の設定を返す
+func startTestSFTPServer(t *testing.T) StorageConfig {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "test" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("permission denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSFTPConn(conn, config)
+		}
+	}()
+
+	return StorageConfig{
+		Type:                  storageTypeSFTP,
+		Host:                  "127.0.0.1",
+		Port:                  ln.Addr().(*net.TCPAddr).Port,
+		User:                  "test",
+		Password:              "secret",
+		InsecureIgnoreHostKey: true,
+	}
+}
+
+func serveTestSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				// payload は長さ（4 バイト）+ サブシステム名
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				go func() {
+					defer channel.Close()
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					_ = server.Serve()
+				}()
+			}
+		}()
+	}
+}
+
+// fakeS3 は storageS3 が使う API（ListObjectsV2 / HEAD / GET / PUT / マルチパート / コピー / DELETE）だけを持つ S3 互換サーバー
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string]fakeS3Object
+	uploads map[string]map[int][]byte
+}
+
+type fakeS3Object struct {
+	data    []byte
+	modTime time.Time
+	// x-amz-meta-* のヘッダー
+	metadata http.Header
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name `xml:"ListBucketResult"`
+	Name        string
+	Prefix      string
+	KeyCount    int
+	IsTruncated bool
+	Contents    []fakeS3ListEntry
+}
+
+type fakeS3ListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+}
+
+// startTestS3Server は fakeS3 を起動し、接続先の設定を返す
+func startTestS3Server(t *testing.T) StorageConfig {
+	t.Helper()
+	s := &fakeS3{bucket: "photos", objects: make(map[string]fakeS3Object), uploads: make(map[string]map[int][]byte)}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return StorageConfig{
+		Type:     storageTypeS3,
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Bucket:   s.bucket,
+		// リージョンを指定して GetBucketLocation を省き、認証情報なし（署名なし）で接続する
+		Region: "us-east-1",
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		uploadID := uuid.NewString()
+		s.uploads[uploadID] = make(map[int][]byte)
+		writeFakeS3XML(w, fmt.Sprintf("<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, uploadID))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		var partNumber int
+		_, _ = fmt.Sscan(query.Get("partNumber"), &partNumber)
+		data, _ := io.ReadAll(r.Body)
+		s.uploads[query.Get("uploadId")][partNumber] = data
+		w.Header().Set("ETag", fakeS3ETag(data))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := s.uploads[query.Get("uploadId")]
+		delete(s.uploads, query.Get("uploadId"))
+		var data []byte
+		for i := 1; i <= len(parts); i++ {
+			data = append(data, parts[i]...)
+		}
+		s.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+		writeFakeS3XML(w, fmt.Sprintf("<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>", bucket, key, fakeS3ETag(data)))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		src, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		_, srcKey, _ := strings.Cut(strings.TrimPrefix(src, "/"), "/")
+		object, ok := s.objects[srcKey]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		object.modTime = time.Now()
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			object.metadata = getFakeS3Metadata(r.Header)
+		}
+		s.objects[key] = object
+		writeFakeS3XML(w, fmt.Sprintf("<CopyObjectResult><ETag>%s</ETag><LastModified>%s</LastModified></CopyObjectResult>", fakeS3ETag(object.data), object.modTime.UTC().Format(time.RFC3339)))
+	case r.Method == http.MethodPut:
+		data, _ := io.ReadAll(r.Body)
+		s.objects[key] = fakeS3Object{data: data, modTime: time.Now()}
+		w.Header().Set("ETag", fakeS3ETag(data))
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		object, ok := s.objects[key]
+		if !ok {
+			writeFakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fakeS3ETag(object.data))
+		w.Header().Set("Last-Modified", object.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object.data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix string) {
+	result := fakeS3ListResult{Name: s.bucket, Prefix: prefix}
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, fakeS3ListEntry{Key: key, LastModified: object.modTime.UTC().Format(time.RFC3339Nano), ETag: fakeS3ETag(object.data), Size: int64(len(object.data))})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	b, _ := xml.Marshal(result)
+	writeFakeS3XML(w, string(b))
+}
+
+func getFakeS3Metadata(header http.Header) http.Header {
+	metadata := make(http.Header)
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			metadata[name] = values
+		}
+	}
+	return metadata
+}
+
+func fakeS3ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func writeFakeS3XML(w http.ResponseWriter, body string) {
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = io.WriteString(w, xml.Header+body)
+}
+
+func writeFakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, xml.Header+"<Error><Code>"+code+"</Code></Error>")
+}
+
+// getTestMinIOConfig は環境変数で MinIO（S3 互換）が指定されていればその設定を返す
+func getTestMinIOConfig(t *testing.T) StorageConfig {
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_S3_ENDPOINT is not set")
+	}
+	return StorageConfig{
+		Type:      storageTypeS3,
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("TEST_S3_BUCKET"),
+		AccessKey: os.Getenv("TEST_S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("TEST_S3_SECRET_KEY"),
+		Region:    os.Getenv("TEST_S3_REGION"),
+		UseSSL:    os.Getenv("TEST_S3_USE_SSL") == "true",
+	}
+}
+
+func openTestStorage(t *testing.T, cfg StorageConfig) storage {
+	t.Helper()
+	st, closeStorage, err := openStorage(newTestLogger(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeStorage)
+	return st
+}
+
+func writeStorageFile(t *testing.T, st storage, p string, content string) {
+	t.Helper()
+	if err := st.mkdirAll(filepath.Dir(p)); err != nil {
+		t.Fatal(err)
+	}
+	w, err := st.create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readStorageFile(t *testing.T, st storage, p string) string {
+	t.Helper()
+	r, err := st.open(p)
+	if err != nil {
+		t.Fatalf("open %s: %v", p, err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// walkStorageFiles は root からの相対パスでファイルとディレクトリの一覧を返す
+func walkStorageFiles(t *testing.T, st storage, root string, skipDir string) (files []string, dirs []string) {
+	t.Helper()
+	if err := st.walkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			dirs = append(dirs, rel)
+			if rel == skipDir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		files = append(files, rel)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	sort.Strings(dirs)
+	return files, dirs
+}
+
+func assertNotExist(t *testing.T, st storage, p string) {
+	t.Helper()
+	if _, err := st.stat(p); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("stat %s: err = %v, want not exist", p, err)
+	}
+}
+
+// testStorageBackend は storage の実装が共通に満たすべき動作を確認する
+func testStorageBackend(t *testing.T, st storage, root string) {
+	writeStorageFile(t, st, path.Join(root, "a/b/1.txt"), "one")
+	writeStorageFile(t, st, path.Join(root, "a/2.txt"), "two")
+	writeStorageFile(t, st, path.Join(root, "3.txt"), "three")
+
+	fi, err := st.stat(path.Join(root, "a/2.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 3 || fi.IsDir() {
+		t.Errorf("stat a/2.txt: size = %d, dir = %v", fi.Size(), fi.IsDir())
+	}
+	assertNotExist(t, st, path.Join(root, "none.txt"))
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := st.chtimes(path.Join(root, "a/2.txt"), modTime); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := st.stat(path.Join(root, "a/2.txt")); err != nil || !fi.ModTime().Equal(modTime) {
+		t.Errorf("mtime after chtimes = %v (err = %v), want %v", fi.ModTime(), err, modTime)
+	}
+	if err := st.sync(path.Join(root, "a/b/1.txt")); err != nil {
+		t.Errorf("sync: %v", err)
+	}
+	if got := readStorageFile(t, st, path.Join(root, "a/b/1.txt")); got != "one" {
+		t.Errorf("a/b/1.txt = %q, want one", got)
+	}
+
+	files, dirs := walkStorageFiles(t, st, root, "")
+	if want := []string{"3.txt", "a/2.txt", "a/b/1.txt"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("walk files = %q, want %q", files, want)
+	}
+	if want := []string{".", "a", "a/b"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("walk dirs = %q, want %q", dirs, want)
+	}
+	if files, _ := walkStorageFiles(t, st, root, "a"); !reflect.DeepEqual(files, []string{"3.txt"}) {
+		t.Errorf("walk with SkipDir(a) = %q, want only 3.txt", files)
+	}
+
+	if err := st.rename(path.Join(root, "3.txt"), path.Join(root, "c.txt")); err != nil {
+		t.Fatal(err)
+	}
+	assertNotExist(t, st, path.Join(root, "3.txt"))
+	if got := readStorageFile(t, st, path.Join(root, "c.txt")); got != "three" {
+		t.Errorf("c.txt = %q, want three", got)
+	}
+
+	// ディレクトリのリネームは中のファイルごと移る
+	if err := st.rename(path.Join(root, "a"), path.Join(root, "z")); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := walkStorageFiles(t, st, root, ""); !reflect.DeepEqual(files, []string{"c.txt", "z/2.txt", "z/b/1.txt"}) {
+		t.Errorf("after rename dir = %q", files)
+	}
+
+	for _, p := range []string{"c.txt", "z/2.txt", "z/b/1.txt"} {
+		if err := st.remove(path.Join(root, p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertNotExist(t, st, path.Join(root, "c.txt"))
+}
+
+func TestLocalStorage(t *testing.T) {
+	testStorageBackend(t, localStorage{}, t.TempDir())
+}
+
+func TestSFTPStorage(t *testing.T) {
+	testStorageBackend(t, openTestStorage(t, startTestSFTPServer(t)), t.TempDir())
+}
+
+func TestS3Storage(t *testing.T) {
+	testStorageBackend(t, openTestStorage(t, startTestS3Server(t)), "photos")
+}
+
+func TestS3StorageMinIO(t *testing.T) {
+	testStorageBackend(t, openTestStorage(t, getTestMinIOConfig(t)), "organiser-test-"+uuid.NewString())
+}
+
+func TestS3WalkDirStopsListing(t *testing.T) {
+	st := openTestStorage(t, startTestS3Server(t))
+	for i := 0; i < 5; i++ {
+		writeStorageFile(t, st, fmt.Sprintf("photos/%d.txt", i), "x")
+	}
+	var n int
+	if err := st.walkDir("photos", func(p string, d fs.DirEntry, err error) error {
+		if d.IsDir() {
+			return nil
+		}
+		n++
+		return fs.SkipAll
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("visited %d files after SkipAll, want 1", n)
+	}
+}
+
+// TestRemoteOperations は出力先がリモートの場合の checkDup / moveDir / renameDir を確認する
+func TestRemoteOperations(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	for _, tc := range []struct {
+		name  string
+		st    func(*testing.T) StorageConfig
+		toDir func(*testing.T) string
+	}{
+		{"sftp", startTestSFTPServer, func(t *testing.T) string { return t.TempDir() }},
+		{"s3", startTestS3Server, func(*testing.T) string { return "out" }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			metaRoot := t.TempDir()
+			if err := createDirectory(filepath.Join(metaRoot, metaDir)); err != nil {
+				t.Fatal(err)
+			}
+			cfg := Config{ToDir: tc.toDir(t), MetaRoot: metaRoot, ToStorage: tc.st(t)}
+			st := openTestStorage(t, cfg.ToStorage)
+
+			content := bytes.Repeat([]byte("x"), 2048)
+			writeStorageFile(t, st, path.Join(cfg.ToDir, "A/1.jpg"), string(content))
+			writeStorageFile(t, st, path.Join(cfg.ToDir, "B/1.jpg"), string(content))
+			writeStorageFile(t, st, path.Join(cfg.ToDir, "xxxxC/2.jpg"), "other")
+
+			if err := checkDuplication(context.Background(), cfg); err != nil {
+				t.Fatal(err)
+			}
+			files, _ := walkStorageFiles(t, st, cfg.ToDir, "")
+			var duplicated []string
+			for _, f := range files {
+				if strings.HasPrefix(f, dupDir+"/") {
+					duplicated = append(duplicated, path.Base(f))
+				}
+			}
+			sort.Strings(duplicated)
+			if want := []string{"A____1.jpg", "B____1.jpg"}; !reflect.DeepEqual(duplicated, want) {
+				t.Fatalf("duplicated = %q (all: %q), want %q", duplicated, files, want)
+			}
+
+			if err := moveDir(context.Background(), cfg); err != nil {
+				t.Fatal(err)
+			}
+			if err := renameDir(context.Background(), cfg); err != nil {
+				t.Fatal(err)
+			}
+			files, _ = walkStorageFiles(t, st, cfg.ToDir, "")
+			if want := []string{"A____1.jpg", "B____1.jpg", "C/2.jpg"}; !reflect.DeepEqual(files, want) {
+				t.Errorf("files = %q, want %q", files, want)
+			}
+		})
+	}
+}
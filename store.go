@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	storeModeHardlink = "hardlink"
+	storeModeSymlink  = "symlink"
+)
+
+const storeObjectsDir = "objects"
+const storeTmpDir = "tmp"
+
+// getStoreMode は内容アドレス方式のストアの実体化方法を返す（未指定なら ""＝ストアを使わない。不正な値は validateConfig で確認する）
+func getStoreMode(cfg Config) string {
+	switch cfg.Store {
+	case storeModeHardlink, storeModeSymlink:
+		return cfg.Store
+	}
+	return ""
+}
+
+// getStoreObjectsDir はストアの実体（objects/ab/cdef…）を置くディレクトリを返す（未指定なら toDir の下）
+func getStoreObjectsDir(cfg Config) string {
+	storeDir := cfg.StoreDir
+	if storeDir == "" {
+		storeDir = cfg.ToDir
+	}
+	return filepath.Join(storeDir, storeObjectsDir)
+}
+
+// isStoreObjectPath は path がストアの実体かどうかを返す（重複チェックの対象外にする）
+func isStoreObjectPath(cfg Config, path string) bool {
+	if getStoreMode(cfg) == "" {
+		return false
+	}
+	objectsDir := getStoreObjectsDir(cfg)
+	return path == objectsDir || strings.HasPrefix(path, objectsDir+string(filepath.Separator))
+}
+
+func getStoreObjectPath(objectsDir string, hash string) string {
+	return filepath.Join(objectsDir, hash[:2], hash[2:])
+}
+
+// contentStore は内容（ハッシュ）毎に実体を1つだけ保存し、出力先にはリンクを作る
+type contentStore struct {
+	mode       string
+	objectsDir string
+}
+
+func newContentStore(cfg Config) *contentStore {
+	mode := getStoreMode(cfg)
+	if mode == "" {
+		return nil
+	}
+	return &contentStore{mode: mode, objectsDir: getStoreObjectsDir(cfg)}
+}
+
+// storeFile はコピー元をストアに保存し（同じ内容が保存済みならコピーしない）、出力先にリンクを作る
+func (w *copyWorker) storeFile(ctx context.Context, entry copyEntry) error {
+	fromPath, toPath := entry.fromPath, entry.toPath
+
+	// 保存済みの内容ならコピーせずにリンクだけ作るよう、先にコピー元のハッシュを計算する。
+	// tar 内のファイルは読み直すと書庫を先頭から読み直すことになるので、コピーしながら計算する。
+	if !isTarEntry(fromPath) {
+		hash, err := hashStorageFile(w.fromSt, fromPath)
+		if err != nil {
+			return fmt.Errorf("failed to hash: %w", err)
+		}
+		objectPath := getStoreObjectPath(w.store.objectsDir, hash)
+		if _, err := os.Stat(objectPath); err == nil {
+			w.counter.skipBytes(entry.size)
+			return w.linkObject(fromPath, toPath, objectPath, hash, false)
+		}
+	}
+
+	tmpDir := filepath.Join(w.store.objectsDir, storeTmpDir)
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create store: %w", err)
+	}
+
+	// ハッシュはコピーした内容から計算し直す（ハッシュの計算後にコピー元が変わっていても内容と実体の名前が一致するように）
+	tmpPath := filepath.Join(tmpDir, uuid.NewString())
+	hash, err := w.copyContent(ctx, fromPath, tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to copy: %w", err)
+	}
+
+	objectPath := getStoreObjectPath(w.store.objectsDir, hash)
+	stored, err := w.store.put(w.logger, tmpPath, objectPath)
+	if err != nil {
+		return fmt.Errorf("failed to store: %w", err)
+	}
+	return w.linkObject(fromPath, toPath, objectPath, hash, stored)
+}
+
+// linkObject は出力先に実体へのリンクを作り、取り込み済みとして記録する（stored は実体を新しく保存した場合）
+func (w *copyWorker) linkObject(fromPath string, toPath string, objectPath string, hash string, stored bool) error {
+	if err := w.store.link(w.logger, objectPath, toPath); err != nil {
+		return fmt.Errorf("failed to link: %w", err)
+	}
+	if stored {
+		w.logger.Info("stored", "src", fromPath, "dst", toPath, "object", objectPath)
+	} else {
+		w.logger.Info("stored (exists)", "src", fromPath, "dst", toPath, "object", objectPath)
+	}
+	w.db.record(w.fromSt, fromPath, toPath, hash)
+
+	return nil
+}
+
+// put は一時ファイルを実体として保存する。同じ内容が保存済みの場合は一時ファイルを削除して false を返す。
+func (s *contentStore) put(logger *slog.Logger, tmpPath string, objectPath string) (bool, error) {
+	if _, err := os.Stat(objectPath); err == nil {
+		if err := os.Remove(tmpPath); err != nil {
+			logger.Warn("failed to remove", "path", tmpPath, "err", err)
+		}
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		return false, err
+	}
+	if err := renameFile(tmpPath, objectPath); err != nil {
+		return false, errors.Join(err, os.Remove(tmpPath))
+	}
+	return true, nil
+}
+
+// link は出力先に実体へのリンクを作る（既にファイルがあれば置き換える）。
+// storeDir と出力先が別のファイルシステムでハードリンクを作れない場合は、シンボリックリンクを作る。
+func (s *contentStore) link(logger *slog.Logger, objectPath string, toPath string) error {
+	tmpPath := toPath + "." + uuid.NewString()
+
+	mode := s.mode
+	if mode == storeModeHardlink {
+		err := os.Link(objectPath, tmpPath)
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.EXDEV):
+			logger.Warn("failed to hardlink across filesystems, symlinked instead", "object", objectPath, "dst", toPath, "err", err)
+			mode = storeModeSymlink
+		default:
+			return err
+		}
+	}
+	if mode == storeModeSymlink {
+		target, err := filepath.Abs(objectPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, tmpPath); err != nil {
+			return err
+		}
+	}
+
+	if err := renameFile(tmpPath, toPath); err != nil {
+		return errors.Join(err, os.Remove(tmpPath))
+	}
+	return nil
+}
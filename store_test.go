@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStoreFileSkipsCopyWhenObjectExists(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a.jpg", "b.jpg"} {
+		if err := os.WriteFile(filepath.Join(fromDir, name), []byte("same"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &copyWorker{
+		logger:   newTestLogger(),
+		fromSt:   localStorage{},
+		toSt:     localStorage{},
+		store:    &contentStore{mode: storeModeHardlink, objectsDir: filepath.Join(toDir, storeObjectsDir)},
+		progress: newProgress(2, 8),
+	}
+	w = w.withCopyCounter()
+
+	entryA := copyEntry{fromPath: filepath.Join(fromDir, "a.jpg"), toPath: filepath.Join(toDir, "a.jpg"), kind: copyKindFile, size: 4}
+	if err := w.storeFile(context.Background(), entryA); err != nil {
+		t.Fatal(err)
+	}
+	// 2件目は同じ内容が保存済みなので、一時ファイルへのコピー（tmp の作成）をせずにリンクだけ作る
+	tmpDir := filepath.Join(w.store.objectsDir, storeTmpDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	entryB := copyEntry{fromPath: filepath.Join(fromDir, "b.jpg"), toPath: filepath.Join(toDir, "b.jpg"), kind: copyKindFile, size: 4}
+	if err := w.storeFile(context.Background(), entryB); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmpDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("tmp dir exists (err = %v), want no copy for a stored object", err)
+	}
+
+	fiA, err := os.Stat(entryA.toPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fiB, err := os.Stat(entryB.toPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fiA, fiB) {
+		t.Error("both files must link to the same object")
+	}
+	if got := w.progress.snapshot().DoneBytes; got != 8 {
+		t.Errorf("done bytes = %d, want 8 (copied + skipped)", got)
+	}
+}
+
+func TestStoreLinkFallsBackToSymlinkAcrossFilesystems(t *testing.T) {
+	// 別のファイルシステム（tmpfs）に実体を置けない環境ではテストしない
+	objectsDir, err := os.MkdirTemp("/dev/shm", "objects")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(objectsDir)
+	toDir := t.TempDir()
+	if isSameDevice(t, objectsDir, toDir) {
+		t.Skip("/dev/shm is on the same filesystem")
+	}
+
+	objectPath := filepath.Join(objectsDir, "ab", "cdef")
+	if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(objectPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &contentStore{mode: storeModeHardlink, objectsDir: objectsDir}
+	toPath := filepath.Join(toDir, "a.jpg")
+	if err := s.link(newTestLogger(), objectPath, toPath); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(toPath); err != nil || target != objectPath {
+		t.Errorf("link = %q, %v, want a symlink to %s", target, err, objectPath)
+	}
+}
+
+func isSameDevice(t *testing.T, a string, b string) bool {
+	t.Helper()
+	fiA, err := os.Stat(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fiB, err := os.Stat(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fiA.Sys().(*syscall.Stat_t).Dev == fiB.Sys().(*syscall.Stat_t).Dev
+}
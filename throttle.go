@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const bandwidthControlFileName = "bandwidthLimit.txt"
+const bandwidthControlInterval = 2 * time.Second
+
+// tokenBucket はコピー時の読み込み速度（bytes/s）を制限する。rate が 0 以下なら無制限。
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rate = rate
+	b.tokens = min(b.tokens, rate)
+	b.last = time.Now()
+}
+
+func (b *tokenBucket) getRate() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// wait は n バイト分のトークンを取得する。足りない分は前借りし、その分だけ待つ。
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	// バーストは 1 秒分まで
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader は tokenBucket の速度で読み込む
+type throttledReader struct {
+	ctx    context.Context
+	r      io.Reader
+	bucket *tokenBucket
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 && r.bucket != nil {
+		if waitErr := r.bucket.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func mbpsToBytes(mbps float64) float64 {
+	return mbps * 1024 * 1024
+}
+
+func getBandwidthControlFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, bandwidthControlFileName)
+}
+
+// watchBandwidthControlFile は制御ファイル（MB/s の数値1つ、0 は無制限）の更新を監視し、実行中に帯域制限を変更する
+func watchBandwidthControlFile(ctx context.Context, logger *slog.Logger, path string, bucket *tokenBucket) {
+	var lastModTime time.Time
+	ticker := time.NewTicker(bandwidthControlInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().After(lastModTime) {
+			continue
+		}
+		lastModTime = fi.ModTime()
+
+		mbps, err := readBandwidthControlFile(path)
+		if err != nil {
+			logger.Error("failed to read bandwidth control file", "path", path, "err", err)
+			continue
+		}
+		bucket.setRate(mbpsToBytes(mbps))
+		logger.Info("bandwidth limit changed", "MBps", mbps)
+	}
+}
+
+func readBandwidthControlFile(path string) (float64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	mbps, err := strconv.ParseFloat(strings.TrimSpace(string(b)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q: %w", string(b), err)
+	}
+	return mbps, nil
+}
+
+// deviceQueue はコピー元・コピー先のデバイスの組み合わせ1つ分の作業の列と、その列を処理する goroutine の数
+type deviceQueue struct {
+	key     string
+	units   chan copyUnit
+	workers int
+}
+
+// queueByDevice は作業をデバイスの組み合わせ毎の列に分ける（列の中は copyList の順）。
+// 列毎に limit 個までの goroutine で処理することで、デバイス毎の同時実行数を制限する。limit が 0 以下なら無制限（全体で1つの列）。
+func queueByDevice(units []copyUnit, limit int, workers int) []deviceQueue {
+	var keys []string
+	byKey := make(map[string][]copyUnit)
+	for _, unit := range units {
+		key := ""
+		if limit > 0 {
+			key = getDeviceKey(unit.entries[0].fromPath, unit.entries[0].toPath)
+		}
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], unit)
+	}
+
+	queues := make([]deviceQueue, 0, len(keys))
+	for _, key := range keys {
+		n := workers
+		if limit > 0 && limit < n {
+			n = limit
+		}
+		queue := deviceQueue{key: key, units: make(chan copyUnit, len(byKey[key])), workers: min(n, len(byKey[key]))}
+		for _, unit := range byKey[key] {
+			queue.units <- unit
+		}
+		close(queue.units)
+		queues = append(queues, queue)
+	}
+	return queues
+}
+
+func getDeviceKey(fromPath string, toPath string) string {
+	return fmt.Sprintf("%d:%d", getDeviceID(fromPath), getDeviceID(toPath))
+}
+
+// getDeviceID は path（まだ無い場合は存在する親ディレクトリ）のデバイス ID を返す
+func getDeviceID(path string) uint64 {
+	for {
+		if fi, err := os.Stat(path); err == nil {
+			id, _ := getDevIno(fi)
+			return id.dev
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0
+		}
+		path = parent
+	}
+}
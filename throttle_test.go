@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func newTestCopyUnits(fromDir string, toDir string, n int) []copyUnit {
+	units := make([]copyUnit, n)
+	for i := range units {
+		name := fmt.Sprintf("%d.jpg", i)
+		units[i] = copyUnit{entries: []copyEntry{{fromPath: filepath.Join(fromDir, name), toPath: filepath.Join(toDir, name), kind: copyKindFile}}}
+	}
+	return units
+}
+
+func TestQueueByDevice(t *testing.T) {
+	// 同じデバイスの作業は1つの列にまとめ、列を処理する goroutine は limit 個まで
+	units := newTestCopyUnits(t.TempDir(), t.TempDir(), 5)
+	queues := queueByDevice(units, 2, 8)
+	if len(queues) != 1 || queues[0].workers != 2 || len(queues[0].units) != 5 {
+		t.Fatalf("queues = %+v, want one queue of 5 units with 2 workers", queues)
+	}
+	var i int
+	for unit := range queues[0].units {
+		if unit.entries[0].fromPath != units[i].entries[0].fromPath {
+			t.Errorf("unit %d = %s, want copyList order", i, unit.entries[0].fromPath)
+		}
+		i++
+	}
+
+	// 無制限なら全体で1つの列を workers 個（作業がそれより少なければその数）で処理する
+	if queues := queueByDevice(units, 0, 3); len(queues) != 1 || queues[0].workers != 3 {
+		t.Errorf("unlimited queues = %+v, want one queue with 3 workers", queues)
+	}
+	if queues := queueByDevice(units[:2], 0, 3); queues[0].workers != 2 {
+		t.Errorf("workers = %d, want 2 for 2 units", queues[0].workers)
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	tea "github.com/charmbracelet/bubbletea"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const tuiLogFileName = "tui.log"
+
+const tuiTickInterval = 200 * time.Millisecond
+const tuiFolderRows = 12
+const tuiErrorRows = 5
+
+// TUI の各段階
+type tuiState int
+
+const (
+	tuiStateListing tuiState = iota
+	tuiStatePlan
+	tuiStateMkdirs
+	tuiStateCopying
+	tuiStateAskCheckDup
+	tuiStateCheckDup
+	tuiStateAskDeDup
+	tuiStateDeDup
+	tuiStateDone
+	tuiStateFailed
+)
+
+// tuiItem はカテゴリ・出力先フォルダの一覧の1行分
+type tuiItem struct {
+	name    string
+	count   int
+	bytes   int64
+	enabled bool
+}
+
+// tuiModel は list → 計画の確認 → create dirs → copy → dedup を既存の operation の処理で順に行う
+type tuiModel struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cfg      Config
+	metaRoot string
+	logger   *slog.Logger
+
+	state    tuiState
+	quitting bool
+
+	entries    []copyEntry
+	categories []tuiItem
+	folders    []tuiItem
+	// 0: カテゴリ / 1: フォルダ
+	focus  int
+	cursor [2]int
+
+	// errorList.txt の読み終えた位置（200ms 毎に追記された分だけを読む）
+	errorListOffset int64
+	progress        *progressSnapshot
+	errorCount      int
+	recentErrors    []string
+	dupGroups       int
+	message         string
+	// 段階が失敗した場合のエラーと、失敗した段階（画面上部の位置）
+	err      error
+	failedAt int
+}
+
+// tuiListedMsg は listUp が終わった時に、計画の確認に使うエントリを送る
+type tuiListedMsg struct {
+	entries []copyEntry
+	err     error
+}
+type tuiStepDoneMsg struct {
+	err error
+}
+type tuiTickMsg struct{}
+
+// interactive は operation: 14 で TUI を起動する
+func interactive(ctx context.Context, cfg Config) {
+	metaRoot := getMetaRoot(cfg)
+
+	// 各 operation のログはそれぞれのファイルに、TUI 自体のログは tui.log に書き、画面には出さない
+	progressOutput = io.Discard
+	logConsoleOutput = io.Discard
+	reportOutput = io.Discard
+	logger, closeLogFile := openTUILogFile(ctx, metaRoot)
+	defer closeLogFile()
+
+	logger.Info("START")
+
+	// 各段階の処理は q / ctrl+c でキャンセルできるようにする
+	stepCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := &tuiModel{ctx: stepCtx, cancel: cancel, cfg: cfg, metaRoot: metaRoot, logger: logger}
+	if _, err := tea.NewProgram(m, tea.WithContext(ctx)).Run(); err != nil && !errors.Is(err, tea.ErrProgramKilled) {
+		logger.Error("failed to run TUI", "err", err)
+	}
+	logger.Info("END")
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return func() tea.Msg {
+		entries, err := listUpEntries(m.ctx, m.cfg)
+		return tuiListedMsg{entries: entries, err: err}
+	}
+}
+
+// runStep は operation の処理をバックグラウンドで実行し、終わったら（エラーと共に）tuiStepDoneMsg を送る
+func (m *tuiModel) runStep(step func(context.Context, Config) error) tea.Cmd {
+	return func() tea.Msg {
+		return tuiStepDoneMsg{err: step(m.ctx, m.cfg)}
+	}
+}
+
+func tuiTick() tea.Cmd {
+	return tea.Tick(tuiTickInterval, func(time.Time) tea.Msg {
+		return tuiTickMsg{}
+	})
+}
+
+func (m *tuiModel) isRunning() bool {
+	switch m.state {
+	case tuiStateListing, tuiStateMkdirs, tuiStateCopying, tuiStateCheckDup, tuiStateDeDup:
+		return true
+	}
+	return false
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		return m.handleKey(msg)
+	case tuiTickMsg:
+		if m.state != tuiStateCopying {
+			return m, nil
+		}
+		m.refreshCopyStatus()
+		return m, tuiTick()
+	case tuiListedMsg:
+		if m.quitting || m.ctx.Err() != nil {
+			return m, tea.Quit
+		}
+		if msg.err != nil {
+			return m.fail(msg.err)
+		}
+		m.loadPlan(msg.entries)
+		m.state = tuiStatePlan
+	case tuiStepDoneMsg:
+		if m.quitting || m.ctx.Err() != nil {
+			return m, tea.Quit
+		}
+		if msg.err != nil {
+			return m.fail(msg.err)
+		}
+		return m.nextState()
+	}
+	return m, nil
+}
+
+// fail は段階の失敗を画面に表示し、以降の段階には進まない
+func (m *tuiModel) fail(err error) (tea.Model, tea.Cmd) {
+	m.logger.Error("step failed", "err", err)
+	m.err = err
+	m.failedAt = m.stepIndex()
+	m.state = tuiStateFailed
+	return m, nil
+}
+
+// nextState は実行中の段階が終わった後の段階に進む
+func (m *tuiModel) nextState() (tea.Model, tea.Cmd) {
+	switch m.state {
+	case tuiStateMkdirs:
+		m.state = tuiStateCopying
+		m.errorListOffset = getFileSize(filepath.Join(m.metaRoot, metaDir, errorListName))
+		return m, tea.Batch(m.runStep(execCopy), tuiTick())
+	case tuiStateCopying:
+		m.refreshCopyStatus()
+		m.state = tuiStateAskCheckDup
+	case tuiStateCheckDup:
+		if err := m.countDuplicateGroups(); err != nil {
+			return m.fail(err)
+		}
+		m.state = tuiStateAskDeDup
+		if m.dupGroups == 0 {
+			m.state = tuiStateDone
+		}
+	case tuiStateDeDup:
+		m.state = tuiStateDone
+	}
+	return m, nil
+}
+
+func (m *tuiModel) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if msg.String() == "ctrl+c" || (msg.String() == "q" && !m.isRunning()) {
+		// 実行中の処理はキャンセルしてロールバックが終わるのを待つ
+		m.cancel()
+		if m.isRunning() {
+			m.quitting = true
+			return m, nil
+		}
+		return m, tea.Quit
+	}
+
+	switch m.state {
+	case tuiStatePlan:
+		return m.handlePlanKey(msg)
+	case tuiStateAskCheckDup:
+		switch msg.String() {
+		case "y":
+			m.state = tuiStateCheckDup
+			return m, m.runStep(checkDuplication)
+		case "n":
+			m.state = tuiStateDone
+		}
+	case tuiStateAskDeDup:
+		switch msg.String() {
+		case "y":
+			m.state = tuiStateDeDup
+			return m, m.runStep(deDuplication)
+		case "n":
+			m.state = tuiStateDone
+		}
+	}
+	return m, nil
+}
+
+func (m *tuiModel) handlePlanKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	items := &m.categories
+	if m.focus == 1 {
+		items = &m.folders
+	}
+
+	switch msg.String() {
+	case "tab":
+		m.focus = 1 - m.focus
+	case "up", "k":
+		if m.cursor[m.focus] > 0 {
+			m.cursor[m.focus]--
+		}
+	case "down", "j":
+		if m.cursor[m.focus] < len(*items)-1 {
+			m.cursor[m.focus]++
+		}
+	case " ":
+		if len(*items) > 0 {
+			item := &(*items)[m.cursor[m.focus]]
+			item.enabled = !item.enabled
+		}
+	case "enter":
+		selected := m.selectedEntries()
+		if len(selected) == 0 {
+			m.message = "コピーするファイルがありません"
+			return m, nil
+		}
+		if err := m.writePlan(selected); err != nil {
+			return m.fail(err)
+		}
+		m.message = ""
+		m.state = tuiStateMkdirs
+		return m, m.runStep(createOutputDir)
+	}
+	return m, nil
+}
+
+// loadPlan は listUp のエントリ（走査した時のサイズ付き）を、カテゴリ・出力先フォルダ毎に集計する
+func (m *tuiModel) loadPlan(entries []copyEntry) {
+	m.entries = entries
+
+	categories := make(map[string]*tuiItem)
+	folders := make(map[string]*tuiItem)
+	for _, entry := range m.entries {
+		addTUIItem(categories, m.getCategory(entry), entry.size)
+		addTUIItem(folders, m.getFolder(entry), entry.size)
+	}
+	m.categories = sortTUIItems(categories)
+	m.folders = sortTUIItems(folders)
+}
+
+func addTUIItem(items map[string]*tuiItem, name string, size int64) {
+	item, ok := items[name]
+	if !ok {
+		item = &tuiItem{name: name, enabled: true}
+		items[name] = item
+	}
+	item.count++
+	item.bytes += size
+}
+
+func sortTUIItems(items map[string]*tuiItem) []tuiItem {
+	result := make([]tuiItem, 0, len(items))
+	for _, item := range items {
+		result = append(result, *item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].name < result[j].name
+	})
+	return result
+}
+
+func (m *tuiModel) getCategory(entry copyEntry) string {
+	return getOutputExtsDirectoryName(getExt(filepath.Base(entry.fromPath)), m.cfg)
+}
+
+func (m *tuiModel) getFolder(entry copyEntry) string {
+	dir, err := filepath.Rel(m.cfg.ToDir, filepath.Dir(entry.toPath))
+	if err != nil {
+		return filepath.Dir(entry.toPath)
+	}
+	return dir
+}
+
+func isTUIItemEnabled(items []tuiItem, name string) bool {
+	for _, item := range items {
+		if item.name == name {
+			return item.enabled
+		}
+	}
+	return false
+}
+
+func (m *tuiModel) isSelected(entry copyEntry) bool {
+	return isTUIItemEnabled(m.categories, m.getCategory(entry)) && isTUIItemEnabled(m.folders, m.getFolder(entry))
+}
+
+func (m *tuiModel) selectedEntries() []copyEntry {
+	var selected []copyEntry
+	for _, entry := range m.entries {
+		if m.isSelected(entry) {
+			selected = append(selected, entry)
+		}
+	}
+	return selected
+}
+
+// writePlan は選んだエントリだけで copyList と outputDirSet を書き直す（元の copyList はバックアップされる）
+func (m *tuiModel) writePlan(selected []copyEntry) error {
+	copyListFile, closeCopyListFile, err := openCopyListFile(m.logger, m.metaRoot)
+	if err != nil {
+		return err
+	}
+	defer closeCopyListFile()
+
+	outputDirSetFile, closeOutputDirSetFile, err := createFile(m.logger, getOutputDirSetFilePath(m.metaRoot))
+	if err != nil {
+		return err
+	}
+	defer closeOutputDirSetFile()
+
+	outputDirs := make(map[string]struct{})
+	for _, entry := range selected {
+		if _, err := copyListFile.WriteString(formatCopyListLine(entry)); err != nil {
+			return err
+		}
+		outputDirs[filepath.Dir(entry.toPath)] = struct{}{}
+	}
+	for outputDir := range outputDirs {
+		if _, err := outputDirSetFile.WriteString(outputDir + "\n"); err != nil {
+			return err
+		}
+	}
+	m.logger.Info("plan", "selected", len(selected), "entries", len(m.entries))
+	return nil
+}
+
+// refreshCopyStatus は execCopy の進捗と、前回から errorList.txt に追記されたエラーを読む
+func (m *tuiModel) refreshCopyStatus() {
+	if prog := activeProgress.Load(); prog != nil {
+		ps := prog.snapshot()
+		m.progress = &ps
+	}
+
+	errorListPath := filepath.Join(m.metaRoot, metaDir, errorListName)
+	lines, offset, err := readAppendedLines(errorListPath, m.errorListOffset)
+	if err != nil {
+		m.logger.Error("failed to read errorList", "path", errorListPath, "err", err)
+		return
+	}
+	m.errorListOffset = offset
+	m.errorCount += len(lines)
+	for _, line := range lines {
+		fromPath, _, _ := strings.Cut(line, seps)
+		m.recentErrors = append(m.recentErrors, fromPath)
+	}
+	if len(m.recentErrors) > tuiErrorRows {
+		m.recentErrors = m.recentErrors[len(m.recentErrors)-tuiErrorRows:]
+	}
+}
+
+func (m *tuiModel) countDuplicateGroups() error {
+	toSt, closeToSt, err := openStorage(m.logger, m.cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	groups, err := listDuplicateGroups(m.logger, toSt, m.cfg.ToDir)
+	if err != nil {
+		return err
+	}
+	m.dupGroups = len(groups)
+	return nil
+}
+
+func (m *tuiModel) View() string {
+	var b strings.Builder
+	b.WriteString("organiser-filene-dine\n\n")
+
+	current := m.stepIndex()
+	for i, step := range []string{"list", "plan", "create dirs", "copy", "dedup"} {
+		mark := " "
+		switch {
+		case i < current:
+			mark = "✓"
+		case i == current && m.state == tuiStateFailed:
+			mark = "✗"
+		case i == current:
+			mark = "▶"
+		}
+		fmt.Fprintf(&b, "%s %s  ", mark, step)
+	}
+	b.WriteString("\n\n")
+
+	switch m.state {
+	case tuiStateListing:
+		b.WriteString("コピー元を走査しています…\n")
+	case tuiStatePlan:
+		m.viewPlan(&b)
+	case tuiStateMkdirs:
+		b.WriteString("出力先のフォルダを作成しています…\n")
+	case tuiStateCopying, tuiStateAskCheckDup:
+		m.viewCopy(&b)
+		if m.state == tuiStateAskCheckDup {
+			b.WriteString("\n重複をチェックしますか？ (y/n)\n")
+		}
+	case tuiStateCheckDup:
+		b.WriteString("重複をチェックしています…\n")
+	case tuiStateAskDeDup:
+		fmt.Fprintf(&b, "重複のグループが %d 件見つかりました（__duplicated__ に移動済み）。\n", m.dupGroups)
+		b.WriteString("今すぐ重複を削除しますか？ (y/n)  ※ 1件ずつ確認する場合は n を選び、HTTP API の /review を使ってください\n")
+	case tuiStateDeDup:
+		b.WriteString("重複を削除しています…\n")
+	case tuiStateDone:
+		m.viewCopy(&b)
+		b.WriteString("\n完了しました。q で終了します。\n")
+	case tuiStateFailed:
+		fmt.Fprintf(&b, "エラーで中断しました: %v\n", m.err)
+		fmt.Fprintf(&b, "詳細は %s 以下のログを確認してください。q で終了します。\n", filepath.Join(m.metaRoot, metaDir))
+	}
+
+	if m.message != "" {
+		fmt.Fprintf(&b, "\n%s\n", m.message)
+	}
+	if m.quitting {
+		b.WriteString("\nキャンセルしています（実行中のコピーの終了を待っています）…\n")
+	}
+	return b.String()
+}
+
+// stepIndex は画面上部の list / plan / create dirs / copy / dedup のうち、現在の段階の位置を返す
+func (m *tuiModel) stepIndex() int {
+	switch m.state {
+	case tuiStateListing:
+		return 0
+	case tuiStatePlan:
+		return 1
+	case tuiStateMkdirs:
+		return 2
+	case tuiStateCopying:
+		return 3
+	case tuiStateDone:
+		return 5
+	case tuiStateFailed:
+		return m.failedAt
+	}
+	return 4
+}
+
+func (m *tuiModel) viewPlan(b *strings.Builder) {
+	selectedCount := 0
+	var selectedBytes int64
+	for _, entry := range m.entries {
+		if m.isSelected(entry) {
+			selectedCount++
+			selectedBytes += entry.size
+		}
+	}
+	fmt.Fprintf(b, "コピー予定: %d / %d ファイル  %s\n\n", selectedCount, len(m.entries), formatBytes(selectedBytes))
+
+	viewTUIItems(b, "カテゴリ", m.categories, m.cursor[0], m.focus == 0, len(m.categories))
+	b.WriteString("\n")
+	viewTUIItems(b, "出力先フォルダ", m.folders, m.cursor[1], m.focus == 1, tuiFolderRows)
+	b.WriteString("\n↑↓: 移動  space: 切り替え  tab: カテゴリ/フォルダ  enter: コピー開始  q: 終了\n")
+}
+
+func viewTUIItems(b *strings.Builder, title string, items []tuiItem, cursor int, focused bool, rows int) {
+	fmt.Fprintf(b, "%s\n", title)
+
+	// カーソルが見える範囲だけ表示する
+	start := 0
+	if cursor >= rows {
+		start = cursor - rows + 1
+	}
+	end := min(start+rows, len(items))
+	for i := start; i < end; i++ {
+		item := items[i]
+		pointer := "  "
+		if focused && i == cursor {
+			pointer = "> "
+		}
+		check := "[ ]"
+		if item.enabled {
+			check = "[x]"
+		}
+		fmt.Fprintf(b, "%s%s %-40s %6d files  %10s\n", pointer, check, item.name, item.count, formatBytes(item.bytes))
+	}
+	if len(items) > end {
+		fmt.Fprintf(b, "   … 他 %d 件\n", len(items)-end)
+	}
+}
+
+func (m *tuiModel) viewCopy(b *strings.Builder) {
+	switch {
+	case m.progress != nil:
+		ps := m.progress
+		rate := 0.0
+		if ps.ElapsedSeconds > 0 {
+			rate = float64(ps.DoneBytes) / ps.ElapsedSeconds
+		}
+		fmt.Fprintf(b, "%s %d/%d files  %s/%s  %.1f MB/s\n",
+			progressBar(ps.DoneBytes, ps.TotalBytes), ps.DoneFiles, ps.TotalFiles,
+			formatBytes(ps.DoneBytes), formatBytes(ps.TotalBytes), rate/1024/1024)
+	case m.state == tuiStateCopying:
+		b.WriteString("コピーを準備しています…\n")
+	default:
+		// 進捗を読む前にコピーが終わった場合
+		b.WriteString("コピーが終わりました\n")
+	}
+
+	fmt.Fprintf(b, "\nエラー: %d 件\n", m.errorCount)
+	for _, e := range m.recentErrors {
+		fmt.Fprintf(b, "  %s\n", e)
+	}
+}
+
+func openTUILogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, tuiLogFileName))
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestTUIModel(state tuiState) *tuiModel {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &tuiModel{ctx: ctx, cancel: cancel, cfg: Config{ToDir: "/out"}, metaRoot: "/out", logger: newTestLogger(), state: state}
+}
+
+func TestTUIShowsStepError(t *testing.T) {
+	m := newTestTUIModel(tuiStateMkdirs)
+	defer m.cancel()
+
+	m.Update(tuiStepDoneMsg{err: errors.New("permission denied")})
+	if m.state != tuiStateFailed {
+		t.Fatalf("state = %d, want failed", m.state)
+	}
+	view := m.View()
+	if !strings.Contains(view, "permission denied") || !strings.Contains(view, "✗ create dirs") {
+		t.Errorf("view does not show the error:\n%s", view)
+	}
+	if m.isRunning() {
+		t.Error("failed state must not be running so that q quits")
+	}
+}
+
+func TestTUILoadPlanUsesListedSizes(t *testing.T) {
+	m := newTestTUIModel(tuiStateListing)
+	defer m.cancel()
+
+	// 存在しないパスなので、stat し直していればサイズは 0 になる
+	entries := []copyEntry{
+		{fromPath: "/nowhere/a.jpg", toPath: "/out/images/a.jpg", kind: copyKindFile, size: 100},
+		{fromPath: "/nowhere/b.jpg", toPath: "/out/images/b.jpg", kind: copyKindFile, size: 20},
+	}
+	m.Update(tuiListedMsg{entries: entries})
+	if m.state != tuiStatePlan {
+		t.Fatalf("state = %d, want plan", m.state)
+	}
+	if len(m.folders) != 1 || m.folders[0].count != 2 || m.folders[0].bytes != 120 {
+		t.Errorf("folders = %+v, want 2 files of 120 bytes", m.folders)
+	}
+}
+
+func TestTUIReadsOnlyAppendedErrors(t *testing.T) {
+	m := newTestTUIModel(tuiStateCopying)
+	defer m.cancel()
+	m.metaRoot = t.TempDir()
+	if err := createDirectory(filepath.Join(m.metaRoot, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	errorListPath := filepath.Join(m.metaRoot, metaDir, errorListName)
+	// 前回の実行のエラーは数えない
+	if err := os.WriteFile(errorListPath, []byte("/in/old.jpg"+seps+"/out/old.jpg\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.errorListOffset = getFileSize(errorListPath)
+
+	f, err := os.OpenFile(errorListPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// 書きかけの行は次に読む
+	if _, err := f.WriteString("/in/a.jpg" + seps + "/out/a.jpg\n/in/b.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	m.refreshCopyStatus()
+	if m.errorCount != 1 || len(m.recentErrors) != 1 || m.recentErrors[0] != "/in/a.jpg" {
+		t.Fatalf("errors = %d %v, want only a.jpg", m.errorCount, m.recentErrors)
+	}
+
+	if _, err := f.WriteString(seps + "/out/b.jpg\n"); err != nil {
+		t.Fatal(err)
+	}
+	m.refreshCopyStatus()
+	if m.errorCount != 2 || len(m.recentErrors) != 2 || m.recentErrors[1] != "/in/b.jpg" {
+		t.Errorf("errors = %d %v, want a.jpg and b.jpg", m.errorCount, m.recentErrors)
+	}
+}
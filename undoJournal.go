@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const undoJournalFileName = "undoJournal.txt"
+const undoMoveLogFileName = "undoMove.log"
+
+const journalOpMove = "move"
+
+// journalOpMoveAcrossStorage は異なる storage 間の移動（SFTP・S3 が含まれる）。fromStorage・toStorage を通して元に戻す
+const journalOpMoveAcrossStorage = "moveAcrossStorage"
+
+func getUndoJournalFilePath(rootPath string) string {
+	return filepath.Join(rootPath, metaDir, undoJournalFileName)
+}
+
+// undoJournal は元に戻せるように移動（コピー元の削除を含む）を記録する
+type undoJournal struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	f      *os.File
+}
+
+func openUndoJournal(logger *slog.Logger, rootPath string) (*undoJournal, CloseFunc, error) {
+	f, closeFunc, err := openFile(logger, getUndoJournalFilePath(rootPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &undoJournal{logger: logger, f: f}, closeFunc, nil
+}
+
+// recordMove は移動を記録し、ディスクに書き出す。
+// コピー元を削除する前に呼び出し、失敗した場合は削除しない（元に戻せない削除をしない）。
+func (j *undoJournal) recordMove(op string, fromPath string, toPath string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.f.WriteString(fmt.Sprintf("%s%s%s%s%s\n", op, seps, fromPath, seps, toPath)); err != nil {
+		return fmt.Errorf("failed to write undoJournal: %w", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync undoJournal: %w", err)
+	}
+	return nil
+}
+
+// undoMove は undoJournal を新しい順に辿り、移動したファイルを元の場所に戻す。
+// 異なる storage 間の移動は、設定の fromStorage・toStorage を通して戻す。
+func undoMove(ctx context.Context, cfg Config) (err error) {
+	toDir := getMetaRoot(cfg)
+	logger, closeLogFile := openUndoMoveLogFile(ctx, toDir)
+	defer closeLogFile()
+
+	report := newRunReport(ctx, logger, nil, undoMoveLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(toDir)
+	}()
+
+	logger.Info("START")
+
+	journalPath := getUndoJournalFilePath(toDir)
+	journalFile, closeJournalFile, err := open(logger, journalPath)
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(journalFile)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	closeJournalFile()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fromSt, toSt, closeStorages, err := openUndoStorages(logger, cfg, lines)
+	if err != nil {
+		return err
+	}
+	defer closeStorages()
+
+	failed := false
+	for i := len(lines) - 1; i >= 0; i-- {
+		if ctx.Err() != nil {
+			logger.Warn("canceled", "err", ctx.Err())
+			failed = true
+			break
+		}
+
+		fields := strings.Split(lines[i], seps)
+		if len(fields) != 3 || (fields[0] != journalOpMove && fields[0] != journalOpMoveAcrossStorage) {
+			logger.Warn("skip unknown journal entry", "entry", lines[i])
+			continue
+		}
+		op, fromPath, toPath := fields[0], fields[1], fields[2]
+
+		if op == journalOpMoveAcrossStorage {
+			err = restoreAcrossStorage(ctx, logger, fromSt, toSt, toPath, fromPath)
+		} else if err = os.MkdirAll(filepath.Dir(fromPath), os.ModePerm); err == nil {
+			err = restoreFile(ctx, logger, toPath, fromPath)
+		}
+		if err != nil {
+			logger.Error("failed to restore", "src", toPath, "dst", fromPath, "err", err)
+			report.addError(toPath, 0, err)
+			failed = true
+			continue
+		}
+		logger.Info("restored", "src", toPath, "dst", fromPath)
+		report.add(reportOutcomeRestored, fromPath, 0)
+	}
+
+	// 全て戻せた場合のみ journal を退避する（失敗があれば再実行できるよう残す）
+	if !failed {
+		if err := renameFile(journalPath, journalPath+"_"+time.Now().Format("20060102150405")); err != nil {
+			logger.Error("failed to rename undoJournal", "path", journalPath, "err", err)
+		}
+	}
+
+	logger.Info("END")
+	return nil
+}
+
+func restoreFile(ctx context.Context, logger *slog.Logger, currentPath string, originalPath string) error {
+	err := renameFile(currentPath, originalPath)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	fi, err := os.Lstat(currentPath)
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(currentPath)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, originalPath); err != nil {
+			return err
+		}
+	} else if err := (&copyWorker{logger: logger, fromSt: localStorage{}, toSt: localStorage{}}).copyAndVerify(ctx, currentPath, originalPath); err != nil {
+		return err
+	}
+	// 戻した先をディスクに書き出してから移動先のファイルを削除する
+	if err := (localStorage{}).sync(originalPath); err != nil {
+		return err
+	}
+	return os.Remove(currentPath)
+}
+
+// openUndoStorages は異なる storage 間の移動を戻す場合だけ fromStorage・toStorage を開く
+func openUndoStorages(logger *slog.Logger, cfg Config, lines []string) (storage, storage, CloseFunc, error) {
+	needed := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, journalOpMoveAcrossStorage+seps) {
+			needed = true
+			break
+		}
+	}
+	if !needed {
+		return nil, nil, func() {}, nil
+	}
+
+	fromSt, closeFromSt, err := openStorage(logger, cfg.FromStorage)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		closeFromSt()
+		return nil, nil, nil, err
+	}
+	return fromSt, toSt, func() {
+		closeToSt()
+		closeFromSt()
+	}, nil
+}
+
+// restoreAcrossStorage は toSt の currentPath を fromSt の originalPath にコピー・検証し、書き出してから削除する
+func restoreAcrossStorage(ctx context.Context, logger *slog.Logger, fromSt storage, toSt storage, currentPath string, originalPath string) error {
+	if err := fromSt.mkdirAll(filepath.Dir(originalPath)); err != nil {
+		return err
+	}
+	w := &copyWorker{logger: logger, engine: copyEngineStream, fromSt: toSt, toSt: fromSt}
+	if err := w.copyAndVerify(ctx, currentPath, originalPath); err != nil {
+		return err
+	}
+	if err := fromSt.sync(originalPath); err != nil {
+		return err
+	}
+	return toSt.remove(currentPath)
+}
+
+func openUndoMoveLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, undoMoveLogFileName))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMoveRecordsJournalBeforeRemovingSource(t *testing.T) {
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	fromPath, toPath := filepath.Join(fromDir, "a.jpg"), filepath.Join(toDir, "a.jpg")
+	if err := os.WriteFile(fromPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, closeJournal, err := openUndoJournal(newTestLogger(), toDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &copyWorker{logger: newTestLogger(), journal: journal, engine: copyEngineStream, fromSt: localStorage{}, toSt: localStorage{}}
+	if err := w.moveFileAcrossStorage(context.Background(), fromPath, toPath); err != nil {
+		t.Fatal(err)
+	}
+	closeJournal()
+	b, err := os.ReadFile(getUndoJournalFilePath(toDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), fromPath+seps+toPath) {
+		t.Errorf("undoJournal = %q, want the move", b)
+	}
+
+	// undoJournal に書けない場合はコピー元を削除しない
+	if err := os.WriteFile(fromPath, []byte("bbbb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	toPath = filepath.Join(toDir, "b.jpg")
+	if err := w.moveFileAcrossStorage(context.Background(), fromPath, toPath); err == nil {
+		t.Error("move must fail when the journal cannot be written")
+	}
+	if _, err := os.Stat(fromPath); err != nil {
+		t.Errorf("source must stay when the journal cannot be written: %v", err)
+	}
+}
+
+func TestUndoMoveAcrossStorage(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, metaRoot := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(metaRoot, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ToDir: "/out", MetaRoot: metaRoot, ToStorage: startTestS3Server(t)}
+	toSt, closeToSt, err := openStorage(newTestLogger(), cfg.ToStorage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeToSt()
+
+	fromPath, toPath := filepath.Join(fromDir, "a.jpg"), "/out/a.jpg"
+	if err := os.WriteFile(fromPath, []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	journal, closeJournal, err := openUndoJournal(newTestLogger(), metaRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &copyWorker{logger: newTestLogger(), journal: journal, engine: copyEngineStream, fromSt: localStorage{}, toSt: toSt}
+	if err := w.moveFileAcrossStorage(context.Background(), fromPath, toPath); err != nil {
+		t.Fatal(err)
+	}
+	closeJournal()
+
+	// S3 に移動したファイルも、toStorage を通して元に戻す
+	if err := undoMove(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := os.ReadFile(fromPath); err != nil || string(b) != "aaaa" {
+		t.Errorf("source = %q, %v, want restored", b, err)
+	}
+	if _, err := toSt.stat(toPath); err == nil {
+		t.Errorf("%s must be removed from S3", toPath)
+	}
+}
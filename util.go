@@ -1,7 +1,11 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
@@ -16,43 +20,61 @@ const outputDirSetFileName = "outputDirSet.txt"
 
 type CloseFunc func()
 
-func open(path string) (*os.File, CloseFunc) {
+func open(logger *slog.Logger, path string) (*os.File, CloseFunc, error) {
 	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	return f, func() {
 		if err := f.Close(); err != nil {
-			log.Println(err)
+			logger.Error("failed to close", "path", path, "err", err)
 		}
-	}
+	}, nil
 }
 
-func openFile(path string) (*os.File, CloseFunc) {
+func openFile(logger *slog.Logger, path string) (*os.File, CloseFunc, error) {
 	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
 
 	return f, func() {
+		// キャンセル時もログや journal を失わないようディスクに書き出してから閉じる
+		if err := f.Sync(); err != nil {
+			logger.Error("failed to sync", "path", path, "err", err)
+		}
 		if err := f.Close(); err != nil {
-			log.Println(err)
+			logger.Error("failed to close", "path", path, "err", err)
 		}
+	}, nil
+}
+
+func createFile(logger *slog.Logger, path string) (*os.File, CloseFunc, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	return f, func() {
+		if err := f.Close(); err != nil {
+			logger.Error("failed to close", "path", path, "err", err)
+		}
+	}, nil
 }
 
 func renameFile(oldPath string, newPath string) error {
 	return os.Rename(oldPath, newPath)
 }
 
-func createDirectory(path string) {
+func createDirectory(path string) error {
 	if err := os.Mkdir(path, os.ModePerm); err != nil {
 		if strings.Contains(err.Error(), "file exists") {
-			return
+			return nil
 		}
-		log.Fatal(err)
+		return err
 	}
+	return nil
 }
 
 func getCopyListFilePath(rootPath string) string {
@@ -86,27 +108,15 @@ type oldNewPath struct {
 	newPath string
 }
 
-func readSomeBytes(path string) ([]byte, error) {
-	f1, c1 := open(path)
-	defer c1()
-
-	byteArray := make([]byte, 1024)
-	_, err := f1.Read(byteArray)
-	if err != nil {
-		if err.Error() == "EOF" {
-			return nil, nil
-		}
-		return nil, err
-	}
+func hashString(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
 
-	return byteArray, nil
+func shortHash(hash string) string {
+	return hash[:12]
 }
 
-func containsSomeBytes(someBytes []byte, bytesFilePathMap map[string][]oldNewPath) bool {
-	for k, _ := range bytesFilePathMap {
-		if string(someBytes) == k {
-			return true
-		}
-	}
-	return false
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled)
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	symlinkPolicySkip   = "skip"
+	symlinkPolicyFollow = "follow"
+	symlinkPolicyLink   = "link"
+)
+
+type walkSourceFunc func(path string, fi fs.FileInfo) error
+
+// devIno はファイルの実体を識別する（同一デバイス上の同一 inode なら同じ実体）
+type devIno struct {
+	dev uint64
+	ino uint64
+}
+
+func getDevIno(fi fs.FileInfo) (devIno, bool) {
+	statT, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return devIno{}, false
+	}
+	return devIno{dev: uint64(statT.Dev), ino: uint64(statT.Ino)}, true
+}
+
+func getNlink(fi fs.FileInfo) uint64 {
+	statT, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	return uint64(statT.Nlink)
+}
+
+func getSymlinkPolicy(cfg Config) string {
+	switch cfg.SymlinkPolicy {
+	case symlinkPolicyFollow, symlinkPolicyLink:
+		return cfg.SymlinkPolicy
+	}
+	return symlinkPolicySkip
+}
+
+// sourceWalker は filepath.WalkDir の代わりにシンボリックリンク・ハードリンク・特殊ファイルを考慮して走査する
+type sourceWalker struct {
+	ctx           context.Context
+	logger        *slog.Logger
+	symlinkPolicy string
+	// 走査中のディレクトリ（シンボリックリンクのループ検出用）
+	visitingDirs map[devIno]string
+	// 既に渡したファイル（ハードリンク等の重複検出用。複数のコピー元ディレクトリで共有する）
+	seenFiles map[devIno]string
+}
+
+// newSourceWalker は1回の listUp で使う walker を作る（コピー元ディレクトリ間のハードリンクも重複として検出するため、ディレクトリ毎に作らない）
+func newSourceWalker(ctx context.Context, logger *slog.Logger, symlinkPolicy string) *sourceWalker {
+	return &sourceWalker{
+		ctx:           ctx,
+		logger:        logger,
+		symlinkPolicy: symlinkPolicy,
+		visitingDirs:  make(map[devIno]string),
+		seenFiles:     make(map[devIno]string),
+	}
+}
+
+// walk は root 以下を走査する
+func (w *sourceWalker) walk(root string, fn walkSourceFunc) error {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+	return w.walkDir(root, fi, fn)
+}
+
+func (w *sourceWalker) walkDir(dir string, dirFi fs.FileInfo, fn walkSourceFunc) error {
+	if id, ok := getDevIno(dirFi); ok {
+		if already, exists := w.visitingDirs[id]; exists {
+			w.logger.Warn("symlink loop", "src", dir, "visiting", already)
+			return nil
+		}
+		w.visitingDirs[id] = dir
+		defer delete(w.visitingDirs, id)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		fi, err := os.Lstat(path)
+		if err != nil {
+			w.logger.Warn("failed to lstat", "src", path, "err", err)
+			continue
+		}
+
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if err := w.walkSymlink(path, fi, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fi.IsDir() {
+			if err := w.walkDir(path, fi, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := w.walkFile(path, fi, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *sourceWalker) walkSymlink(path string, fi fs.FileInfo, fn walkSourceFunc) error {
+	switch w.symlinkPolicy {
+	case symlinkPolicyLink:
+		return fn(path, fi)
+	case symlinkPolicyFollow:
+		targetFi, err := os.Stat(path)
+		if err != nil {
+			w.logger.Warn("broken symlink", "src", path, "err", err)
+			return nil
+		}
+		if targetFi.IsDir() {
+			return w.walkDir(path, targetFi, fn)
+		}
+		return w.walkFile(path, targetFi, fn)
+	default:
+		w.logger.Info("symlink skipped", "src", path)
+		return nil
+	}
+}
+
+func (w *sourceWalker) walkFile(path string, fi fs.FileInfo, fn walkSourceFunc) error {
+	if !fi.Mode().IsRegular() {
+		w.logger.Info("not regular", "src", path, "type", fi.Mode().Type())
+		return nil
+	}
+
+	// ハードリンクや follow したシンボリックリンクで同じ実体に再度到達した場合は1回だけ渡す
+	if id, ok := getDevIno(fi); ok {
+		if already, exists := w.seenFiles[id]; exists {
+			if getNlink(fi) > 1 {
+				w.logger.Info("hardlink", "src", path, "sameAs", already)
+			} else {
+				w.logger.Info("already listed", "src", path, "sameAs", already)
+			}
+			return nil
+		}
+		w.seenFiles[id] = path
+	}
+
+	return fn(path, fi)
+}
+
+// walkStorage はリモートの storage を走査する（シンボリックリンク等はリモート側の扱いに従う）
+func walkStorage(ctx context.Context, logger *slog.Logger, st storage, root string, fn walkSourceFunc) error {
+	return st.walkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			logger.Warn("failed to get file info", "src", path, "err", err)
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			logger.Info("not regular", "src", path, "type", fi.Mode().Type())
+			return nil
+		}
+		return fn(path, fi)
+	})
+}
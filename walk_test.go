@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestSourceWalkerSkipsHardlinks(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(dir, "a.jpg"), filepath.Join(dir, "sub", "a.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同じ実体へのハードリンクは1回だけ渡す
+	var paths []string
+	w := newSourceWalker(context.Background(), newTestLogger(), symlinkPolicySkip)
+	if err := w.walk(dir, func(path string, fi fs.FileInfo) error {
+		paths = append(paths, path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 1 {
+		t.Errorf("walked = %v, want the hardlinked file once", paths)
+	}
+}
+
+func TestListUpSkipsHardlinksAcrossFromDirs(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	root, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	fromDir1, fromDir2 := filepath.Join(root, "in1"), filepath.Join(root, "in2")
+	for _, dir := range []string{fromDir1, fromDir2} {
+		if err := os.Mkdir(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(fromDir1, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(fromDir1, "a.jpg"), filepath.Join(fromDir2, "b.jpg")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 別のコピー元ディレクトリにあるハードリンクも、同じ実体として1回だけコピーする
+	cfg := Config{FromDirs: []FromDirConfig{{Path: fromDir1, Label: "in1"}, {Path: fromDir2, Label: "in2"}}, ToDir: toDir, TargetExts: TargetExtsAll}
+	entries, err := listUpEntries(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("entries = %+v, want the hardlinked file once", entries)
+	}
+}
+
+func TestSourceWalkerSymlinkPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "b.jpg")
+	if err := os.WriteFile(outside, []byte("bbbb"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 外のファイルへのリンク・ループするリンク・壊れたリンク
+	for target, name := range map[string]string{outside: "b.jpg", dir: "loop", filepath.Join(dir, "none.jpg"): "broken.jpg"} {
+		if err := os.Symlink(target, filepath.Join(dir, "sub", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{policy: symlinkPolicySkip, want: []string{"sub/a.jpg"}},
+		// ループは1回だけ辿り、同じ実体は1回だけ渡す
+		{policy: symlinkPolicyFollow, want: []string{"sub/a.jpg", "sub/b.jpg"}},
+		// リンクのままコピーする場合は辿らない
+		{policy: symlinkPolicyLink, want: []string{"sub/a.jpg", "sub/b.jpg", "sub/broken.jpg", "sub/loop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			var got []string
+			w := newSourceWalker(context.Background(), newTestLogger(), tt.policy)
+			if err := w.walk(dir, func(path string, fi fs.FileInfo) error {
+				rel, err := filepath.Rel(dir, path)
+				if err != nil {
+					return err
+				}
+				got = append(got, filepath.ToSlash(rel))
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("walked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceWalkerSkipsSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Skip(err)
+	}
+	// 名前付きパイプ等の特殊ファイルは開くと止まることがあるので渡さない
+	w := newSourceWalker(context.Background(), newTestLogger(), symlinkPolicySkip)
+	if err := w.walk(dir, func(path string, fi fs.FileInfo) error {
+		t.Errorf("%s must not be walked", path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const watchLogFileName = "watch.log"
+
+// 新しいファイルのサイズが変わらなくなってから取り込むまでの秒数（未指定時）
+const defaultWatchSettleSeconds = 5
+
+const watchTickInterval = time.Second
+
+// 取り込み待ちのファイルを取り込む goroutine に渡すキューの長さ（一杯の場合は次の tick で渡し直す）
+const watchQueueSize = 1024
+
+// pendingFile は書き込みが終わるのを待っているファイル
+type pendingFile struct {
+	fromDir   FromDirConfig
+	size      int64
+	changedAt time.Time
+}
+
+// settledFile は書き込みが終わり、取り込む goroutine に渡したファイル
+type settledFile struct {
+	fromDir FromDirConfig
+	path    string
+	fi      fs.FileInfo
+}
+
+// fileWatcher は watch で届いたファイルを listUp・execCopy と同じ分類・命名・コピーで取り込む
+type fileWatcher struct {
+	cfg           Config
+	fromDirs      []FromDirConfig
+	allTargetExts []string
+	settle        time.Duration
+	fromSt        storage
+	toSt          storage
+	worker        *copyWorker
+	watcher       *fsnotify.Watcher
+	pending       map[string]pendingFile
+	// 取り込みは fsnotify のイベントを止めないよう、別の goroutine で1件ずつ行う（連番を振る順も保つ）
+	settled chan settledFile
+	counter *nameCounter
+}
+
+func watch(ctx context.Context, cfg Config) (err error) {
+	// 末尾の / 等があっても findFromDir の前方一致で判定できるよう、パスを正規化する
+	cfg.ToDir = filepath.Clean(cfg.ToDir)
+	metaRoot := getMetaRoot(cfg)
+
+	logger, closeLogFile := openWatchLogFile(ctx, metaRoot)
+	defer closeLogFile()
+
+	closeMetricsSummary := startMetricsSummary(logger, metaRoot, watchLogFileName)
+	defer closeMetricsSummary()
+
+	report := newRunReport(ctx, logger, &cfg, watchLogFileName)
+	defer func() {
+		report.setResult(ctx, err)
+		report.finish(metaRoot)
+	}()
+
+	logger.Info("START")
+
+	fromSt, closeFromSt, err := openStorage(logger, cfg.FromStorage)
+	if err != nil {
+		return err
+	}
+	defer closeFromSt()
+	if !fromSt.isLocal() {
+		return errors.New("watch is only supported for local fromStorage")
+	}
+	toSt, closeToSt, err := openStorage(logger, cfg.ToStorage)
+	if err != nil {
+		return err
+	}
+	defer closeToSt()
+
+	errorList, closeErrorListFile, err := openErrorListFile(logger, metaRoot)
+	if err != nil {
+		return err
+	}
+	defer closeErrorListFile()
+
+	db, closeImportDB, err := openImportDBWriter(logger, metaRoot)
+	if err != nil {
+		return err
+	}
+	defer closeImportDB()
+
+	journal, closeJournal, err := openUndoJournal(logger, metaRoot)
+	if err != nil {
+		return err
+	}
+	defer closeJournal()
+
+	bucket := newTokenBucket(mbpsToBytes(cfg.BandwidthLimitMBps))
+	go watchBandwidthControlFile(ctx, logger, getBandwidthControlFilePath(metaRoot), bucket)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := watcher.Close(); err != nil {
+			logger.Warn("failed to close watcher", "err", err)
+		}
+	}()
+
+	fw := &fileWatcher{
+		cfg:           cfg,
+		fromDirs:      getWatchFromDirs(cfg),
+		allTargetExts: getAllTargetExts(cfg),
+		settle:        getWatchSettle(cfg),
+		fromSt:        fromSt,
+		toSt:          toSt,
+		worker:        &copyWorker{logger: logger, errorList: errorList, db: db, journal: journal, bucket: bucket, engine: getCopyEngine(cfg), fromSt: fromSt, toSt: toSt, store: newContentStore(cfg), report: report},
+		watcher:       watcher,
+		pending:       make(map[string]pendingFile),
+		settled:       make(chan settledFile, watchQueueSize),
+		counter:       newNameCounter(toSt, cfg.ToDir),
+	}
+
+	// 終了時は取り込み中のファイルを待ってから、エラー一覧等を閉じる
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fw.organiseLoop(ctx)
+	}()
+	defer func() {
+		close(fw.settled)
+		wg.Wait()
+	}()
+
+	// 監視を始める前からあるファイルも取り込み待ちにする（取り込み済みのものは organise で除く）
+	for _, fromDir := range fw.fromDirs {
+		logger.Info("watch", "src", fromDir.Path, "label", fromDir.Label, "targetExts", fromDir.TargetExts, "settle", fw.settle)
+		if err := fw.addDir(fromDir, fromDir.Path, true); err != nil {
+			return err
+		}
+	}
+
+	// metrics.addr を指定した場合は /metrics も公開する（listen できない場合も、取り込み中のファイルを待ってから終了する）
+	waitMetrics := func() {}
+	if cfg.Metrics.Addr != "" {
+		if waitMetrics, err = startMetricsServer(ctx, logger, cfg.Metrics.Addr); err != nil {
+			return err
+		}
+	}
+
+	ticker := time.NewTicker(watchTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Warn("canceled", "err", ctx.Err())
+			waitMetrics()
+			logger.Info("END")
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			fw.handleEvent(event)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error("watch error", "err", err)
+		case now := <-ticker.C:
+			fw.organiseSettled(ctx, now)
+		}
+	}
+}
+
+// getWatchFromDirs は監視するコピー元ディレクトリを正規化したパスで返す
+func getWatchFromDirs(cfg Config) []FromDirConfig {
+	fromDirs := getFromDirs(cfg)
+	for i := range fromDirs {
+		fromDirs[i].Path = filepath.Clean(fromDirs[i].Path)
+	}
+	return fromDirs
+}
+
+func getWatchSettle(cfg Config) time.Duration {
+	if cfg.WatchSettleSeconds > 0 {
+		return time.Duration(cfg.WatchSettleSeconds) * time.Second
+	}
+	return defaultWatchSettleSeconds * time.Second
+}
+
+// addDir はディレクトリ以下を監視対象に加える（fsnotify はサブディレクトリを監視しないため）。
+// enqueue が true の場合、既にあるファイルも取り込み待ちにする（起動時と、ディレクトリごと移動してきた場合）。
+func (fw *fileWatcher) addDir(fromDir FromDirConfig, root string, enqueue bool) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fw.worker.logger.Warn("failed to walk", "src", path, "err", err)
+			return nil
+		}
+
+		if d.IsDir() {
+			if d.Name() == metaDir {
+				return filepath.SkipDir
+			}
+			if err := fw.watcher.Add(path); err != nil {
+				fw.worker.logger.Error("failed to watch", "src", path, "err", err)
+			}
+			return nil
+		}
+
+		// 出力先がコピー元の中にある場合、コピーしたファイルは取り込まない
+		if _, ok := fw.findFromDir(path); enqueue && ok {
+			if fi, err := d.Info(); err == nil {
+				fw.enqueue(fromDir, path, fi)
+			}
+		}
+		return nil
+	})
+}
+
+func (fw *fileWatcher) handleEvent(event fsnotify.Event) {
+	if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+		delete(fw.pending, event.Name)
+		return
+	}
+	if !event.Has(fsnotify.Create) && !event.Has(fsnotify.Write) {
+		return
+	}
+
+	fromDir, ok := fw.findFromDir(event.Name)
+	if !ok {
+		return
+	}
+
+	fi, err := os.Lstat(event.Name)
+	if err != nil {
+		return
+	}
+	if fi.IsDir() {
+		if event.Has(fsnotify.Create) {
+			if err := fw.addDir(fromDir, event.Name, true); err != nil {
+				fw.worker.logger.Error("failed to watch", "src", event.Name, "err", err)
+			}
+		}
+		return
+	}
+	fw.enqueue(fromDir, event.Name, fi)
+}
+
+// enqueue は書き込み中かもしれないファイルを取り込み待ちにする（変更の度に待ち時間をやり直す）
+func (fw *fileWatcher) enqueue(fromDir FromDirConfig, path string, fi fs.FileInfo) {
+	if !fi.Mode().IsRegular() {
+		fw.worker.logger.Debug("not regular", "src", path, "type", fi.Mode().Type())
+		return
+	}
+	if fi.Name() == ".DS_Store" {
+		return
+	}
+	fw.pending[path] = pendingFile{fromDir: fromDir, size: fi.Size(), changedAt: time.Now()}
+}
+
+// findFromDir は path を含むコピー元ディレクトリを返す（出力先の中のファイルは対象外）
+func (fw *fileWatcher) findFromDir(path string) (FromDirConfig, bool) {
+	// 出力先がコピー元の中にある場合、コピーしたファイルを再び取り込まない
+	if strings.HasPrefix(path, fw.cfg.ToDir+string(filepath.Separator)) {
+		return FromDirConfig{}, false
+	}
+	for _, fromDir := range fw.fromDirs {
+		if strings.HasPrefix(path, fromDir.Path+string(filepath.Separator)) {
+			return fromDir, true
+		}
+	}
+	return FromDirConfig{}, false
+}
+
+// organiseSettled はサイズが settle の間変わらなかったファイルを取り込む goroutine に渡す
+func (fw *fileWatcher) organiseSettled(ctx context.Context, now time.Time) {
+	for path, p := range fw.pending {
+		if now.Sub(p.changedAt) < fw.settle {
+			continue
+		}
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			delete(fw.pending, path)
+			continue
+		}
+		if fi.Size() != p.size {
+			// まだ大きくなっている
+			p.size = fi.Size()
+			p.changedAt = now
+			fw.pending[path] = p
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case fw.settled <- settledFile{fromDir: p.fromDir, path: path, fi: fi}:
+			delete(fw.pending, path)
+		default:
+			// 取り込みが追いついていないので、次の tick で渡し直す
+			return
+		}
+	}
+}
+
+// organiseLoop は渡されたファイルを順に取り込む（settled が閉じられるまで）
+func (fw *fileWatcher) organiseLoop(ctx context.Context) {
+	for f := range fw.settled {
+		if ctx.Err() != nil {
+			continue
+		}
+		fw.organise(ctx, f.fromDir, f.path, f.fi)
+	}
+}
+
+// organise は1件を listUp と同じ分類・命名で出力先を決め、execCopy と同じ方法でコピーする
+func (fw *fileWatcher) organise(ctx context.Context, fromDir FromDirConfig, path string, fi fs.FileInfo) {
+	if !isTargetFile(fw.cfg, fromDir, fw.allTargetExts, fi.Name()) {
+		fw.worker.logger.Debug("not target", "src", path)
+		return
+	}
+
+	// 1件ずつコピーするので、出力先に既にあるファイルとの重複だけを解決すればよい
+	plan := newCopyPlan(fw.worker.logger, getCollisionStrategy(fw.cfg), fw.fromSt, fw.toSt)
+
+	entry, _, err := prepare(path, fi, fw.cfg, fromDir, fw.counter, fw.fromSt, plan.hashes)
+	if err != nil {
+		fw.worker.logger.Error("failed to prepare", "src", path, "err", err)
+		return
+	}
+	if isAlreadyImported(fw.worker.logger, entry, fw.cfg, plan.hashes, fw.fromSt, fw.toSt) {
+		fw.worker.logger.Info("already imported", "src", path, "dst", entry.toPath)
+		return
+	}
+
+	if !plan.add(entry) {
+		return
+	}
+	entry = plan.entries[0]
+	metricFilesListed.Inc()
+
+	if err := fw.toSt.mkdirAll(filepath.Dir(entry.toPath)); err != nil {
+		fw.worker.fail(entry, fmt.Errorf("failed to mkdir: %w", err))
+		return
+	}
+	fw.worker.execEntry(ctx, fw.cfg, entry)
+}
+
+func openWatchLogFile(ctx context.Context, rootPath string) (*slog.Logger, CloseFunc) {
+	return setupLog(ctx, filepath.Join(rootPath, metaDir, watchLogFileName))
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// findCopied は出力先（metaDir 以外）にある name のファイルを返す
+func findCopied(t *testing.T, toDir string, name string) string {
+	t.Helper()
+	found := ""
+	if err := filepath.WalkDir(toDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == metaDir {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && d.Name() == name {
+			found = path
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
+
+func TestWatchWithTrailingSlash(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	// 末尾に / があっても監視しているディレクトリのファイルとして取り込む
+	cfg := Config{FromDir: fromDir + "/", ToDir: toDir + "/", TargetExts: TargetExtsAll, WatchSettleSeconds: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watch(ctx, cfg)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	// 監視を始めるのを待ってから書き込む
+	time.Sleep(200 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(fromDir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for findCopied(t, toDir, "a.jpg") == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("a.jpg was not copied")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestGetWatchFromDirsCleansPaths(t *testing.T) {
+	fw := &fileWatcher{
+		cfg:      Config{ToDir: "/photos/out"},
+		fromDirs: getWatchFromDirs(Config{FromDirs: []FromDirConfig{{Path: "/photos/"}}}),
+	}
+	if _, ok := fw.findFromDir("/photos/a.jpg"); !ok {
+		t.Error("/photos/a.jpg must be in /photos/")
+	}
+	if _, ok := fw.findFromDir("/photos/out/a.jpg"); ok {
+		t.Error("files in toDir must not be imported again")
+	}
+}
+
+func TestWatchImportsExistingFiles(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	// 監視を始める前からあるファイルも取り込む
+	if err := os.WriteFile(filepath.Join(fromDir, "a.jpg"), []byte("aaaa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll, WatchSettleSeconds: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- watch(ctx, cfg)
+	}()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for findCopied(t, toDir, "a.jpg") == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("a.jpg was not copied")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestWatchReturnsMetricsListenError(t *testing.T) {
+	reportOutput = io.Discard
+	logConsoleOutput = io.Discard
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	fromDir, toDir := t.TempDir(), t.TempDir()
+	if err := createDirectory(filepath.Join(toDir, metaDir)); err != nil {
+		t.Fatal(err)
+	}
+	// 使用中のアドレスでは終了せずにエラーを返す（log.Fatal だと取り込み中のファイルやエラー一覧を閉じずに終了する）
+	cfg := Config{FromDir: fromDir, ToDir: toDir, TargetExts: TargetExtsAll, Metrics: MetricsConfig{Addr: ln.Addr().String()}}
+	if err := watch(context.Background(), cfg); err == nil {
+		t.Error("watch must return the listen error")
+	}
+}